@@ -7,6 +7,7 @@ import (
 	"github.com/dvcrn/codex-proxy/internal/auth"
 	"github.com/dvcrn/codex-proxy/internal/credentials"
 	"github.com/dvcrn/codex-proxy/internal/logger"
+	"github.com/dvcrn/codex-proxy/internal/server"
 	"github.com/syumai/workers"
 )
 
@@ -24,7 +25,10 @@ func main() {
 	oauthFetcher := auth.NewOAuthFetcher(kvFetcher, &log)
 
 	// Create server using OAuth-wrapped fetcher
-	srv := app.NewServer(oauthFetcher, log)
+	srv, err := app.NewServer(oauthFetcher, log, server.UpstreamConfigFromEnv())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid upstream configuration")
+	}
 
 	// Serve using workers - it handles all the HTTP server setup
 	workers.Serve(srv)
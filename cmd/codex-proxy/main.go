@@ -9,6 +9,7 @@ import (
 	"github.com/dvcrn/codex-proxy/internal/auth"
 	"github.com/dvcrn/codex-proxy/internal/credentials"
 	"github.com/dvcrn/codex-proxy/internal/logger"
+	"github.com/dvcrn/codex-proxy/internal/server"
 	"github.com/rs/zerolog"
 )
 
@@ -16,9 +17,14 @@ func main() {
 	credsStore := flag.String("creds-store", "auto", "Credential store mode: auto|xdg|legacy|keychain|env")
 	credsPath := flag.String("creds-path", "", "Override path for filesystem credentials (for xdg/legacy modes)")
 	disableRefresh := flag.Bool("disable-migrate-refresh", false, "Skip immediate token refresh after migration")
+	upstreamBaseURL := flag.String("upstream-base-url", "", "Codex backend base URL (default $UPSTREAM_BASE_URL or https://chatgpt.com/backend-api/codex)")
+	upstreamResponsesPath := flag.String("upstream-responses-path", "", "Responses endpoint path under the base URL (default $UPSTREAM_RESPONSES_PATH or /responses)")
+	oauthTokenURL := flag.String("oauth-token-url", "", "OAuth token refresh URL (default $OAUTH_TOKEN_URL or "+auth.OAuthTokenURL+")")
+	oauthClientID := flag.String("oauth-client-id", "", "OAuth client ID (default $OAUTH_CLIENT_ID or the Codex CLI client)")
 	flag.Parse()
 
 	log := logger.New()
+	auth.SetOAuthConfig(*oauthTokenURL, *oauthClientID)
 
 	log.Info().
 		Str("creds_store", *credsStore).
@@ -93,8 +99,19 @@ func main() {
 	// Validate credentials at startup
 	validateCredentialsAtStartup(credsFetcher, log)
 
+	upstream := server.UpstreamConfigFromEnv()
+	if *upstreamBaseURL != "" {
+		upstream.BaseURL = *upstreamBaseURL
+	}
+	if *upstreamResponsesPath != "" {
+		upstream.ResponsesPath = *upstreamResponsesPath
+	}
+
 	// Create server using shared setup
-	srv := app.NewServer(credsFetcher, log)
+	srv, err := app.NewServer(credsFetcher, log, upstream)
+	if err != nil {
+		log.Fatal().Err(err).Msg("❌ Invalid upstream configuration")
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
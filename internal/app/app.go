@@ -7,7 +7,9 @@ import (
 )
 
 // NewServer creates a new server instance with the given credentials fetcher
-func NewServer(credsFetcher credentials.CredentialsFetcher, logger zerolog.Logger) *server.Server {
+// and upstream config. Both entrypoints go through here so an invalid
+// upstream config is rejected the same way everywhere.
+func NewServer(credsFetcher credentials.CredentialsFetcher, logger zerolog.Logger, upstream server.UpstreamConfig) (*server.Server, error) {
 	// Create server with the credentials fetcher
-	return server.New(logger, credsFetcher)
+	return server.New(logger, credsFetcher, upstream)
 }
@@ -5,18 +5,57 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
 )
 
 const (
-	// OAuthTokenURL is the endpoint for refreshing OAuth tokens
+	// OAuthTokenURL is the default endpoint for refreshing OAuth tokens
 	OAuthTokenURL = "https://auth.openai.com/oauth/token"
-	// ClientID is the OAuth client ID for ChatGPT/Codex
+	// ClientID is the default OAuth client ID for ChatGPT/Codex
 	ClientID = "app_EMoamEEZ73f0CkXaXp7hrann"
 	// TokenExpiryBuffer is the buffer time before token expiry to trigger refresh (60 minutes)
 	TokenExpiryBuffer = 60 * time.Minute
 )
 
+var (
+	oauthConfigMu    sync.RWMutex
+	tokenURLOverride string
+	clientIDOverride string
+)
+
+// SetOAuthConfig overrides the OAuth token URL and client ID. Empty values
+// fall back to OAUTH_TOKEN_URL and OAUTH_CLIENT_ID, then to the defaults.
+func SetOAuthConfig(tokenURL, clientID string) {
+	oauthConfigMu.Lock()
+	defer oauthConfigMu.Unlock()
+	tokenURLOverride = strings.TrimSpace(tokenURL)
+	clientIDOverride = strings.TrimSpace(clientID)
+}
+
+// TokenURL returns the OAuth token endpoint in use.
+func TokenURL() string {
+	oauthConfigMu.RLock()
+	defer oauthConfigMu.RUnlock()
+	if tokenURLOverride != "" {
+		return tokenURLOverride
+	}
+	return env.GetOrDefault("OAUTH_TOKEN_URL", OAuthTokenURL)
+}
+
+// OAuthClientID returns the OAuth client ID in use.
+func OAuthClientID() string {
+	oauthConfigMu.RLock()
+	defer oauthConfigMu.RUnlock()
+	if clientIDOverride != "" {
+		return clientIDOverride
+	}
+	return env.GetOrDefault("OAUTH_CLIENT_ID", ClientID)
+}
+
 // TokenExpired checks if the token is expired or will expire soon
 func TokenExpired(expiresAtMs int64) bool {
 	bufferMs := TokenExpiryBuffer.Milliseconds()
@@ -29,7 +68,7 @@ func RefreshToken(refreshToken string) (*TokenRefreshResponse, error) {
 	request := TokenRefreshRequest{
 		GrantType:    "refresh_token",
 		RefreshToken: refreshToken,
-		ClientID:     ClientID,
+		ClientID:     OAuthClientID(),
 		Scope:        "openid profile email",
 	}
 
@@ -38,7 +77,7 @@ func RefreshToken(refreshToken string) (*TokenRefreshResponse, error) {
 		return nil, fmt.Errorf("failed to marshal refresh request: %w", err)
 	}
 
-	resp, err := http.Post(OAuthTokenURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := http.Post(TokenURL(), "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to make refresh request: %w", err)
 	}
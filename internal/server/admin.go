@@ -14,7 +14,7 @@ func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		adminKey, ok := env.Get("ADMIN_API_KEY")
 		if !ok || adminKey == "" {
 			s.logger.Error().Msg("ADMIN_API_KEY environment variable not set")
-			http.Error(w, "Admin API not configured", http.StatusInternalServerError)
+			writeAPIError(w, internalError(http.StatusInternalServerError, "Admin API not configured"))
 			return
 		}
 
@@ -31,7 +31,7 @@ func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 					Str("uri", r.RequestURI).
 					Str("remote_addr", r.RemoteAddr).
 					Msg("Invalid Authorization header format for admin endpoint")
-				http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+				writeAPIError(w, unauthorizedError("Invalid Authorization header format"))
 				return
 			}
 			providedToken = parts[1]
@@ -44,7 +44,7 @@ func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 				Str("uri", r.RequestURI).
 				Str("remote_addr", r.RemoteAddr).
 				Msg("Missing required Authorization or X-API-Key header for admin endpoint")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeAPIError(w, unauthorizedError("Unauthorized"))
 			return
 		}
 
@@ -55,7 +55,7 @@ func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 				Str("uri", r.RequestURI).
 				Str("remote_addr", r.RemoteAddr).
 				Msg("Invalid admin API key provided")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeAPIError(w, unauthorizedError("Unauthorized"))
 			return
 		}
 
@@ -69,3 +69,22 @@ func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// validAdminKey reports whether token is ADMIN_API_KEY.
+func validAdminKey(token string) bool {
+	adminKey, _ := env.Get("ADMIN_API_KEY")
+	return adminKey != "" && token == adminKey
+}
+
+// requestAPIKey returns the key the client authenticated with, from either
+// 'Authorization: Bearer <key>' or 'X-API-Key: <key>'.
+func requestAPIKey(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+			return parts[1]
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// bufferAnthropicMessageFromSSE consumes an upstream Codex SSE stream and
+// aggregates the completed output items into a single Anthropic Messages API
+// response. Output items are taken from response.output_item.done events so
+// that text, reasoning summaries and tool calls keep their upstream order.
+// With limits, message text is rebuilt from the limited deltas and reading
+// stops once a limit is hit.
+func bufferAnthropicMessageFromSSE(body io.Reader, model string, limits outputLimits) (*AnthropicMessageResponse, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	limiter := newOutputLimiter(limits)
+
+	var (
+		dataLines    [][]byte
+		responseID   string
+		blocks       []AnthropicContentBlock
+		textDeltas   strings.Builder
+		itemText     strings.Builder
+		sawItemDone  bool
+		sawToolUse   bool
+		stopped      bool
+		stopReason   string
+		stopSequence *string
+		usage        AnthropicUsage
+	)
+
+	flushEvent := func() error {
+		if len(dataLines) == 0 {
+			return nil
+		}
+		raw := bytes.TrimSpace(bytes.Join(dataLines, []byte("\n")))
+		dataLines = dataLines[:0]
+		if len(raw) == 0 || bytes.Equal(raw, []byte("[DONE]")) {
+			return nil
+		}
+
+		var evt map[string]interface{}
+		if err := json.Unmarshal(raw, &evt); err != nil {
+			return fmt.Errorf("invalid upstream JSON chunk: %w", err)
+		}
+
+		eventType, _ := evt["type"].(string)
+		switch eventType {
+		case "response.created":
+			if resp, ok := evt["response"].(map[string]interface{}); ok {
+				responseID, _ = resp["id"].(string)
+			}
+		case "response.output_text.delta":
+			delta, _ := evt["delta"].(string)
+			finish := ""
+			if limiter != nil {
+				delta, finish = limiter.feed(delta)
+			}
+			textDeltas.WriteString(delta)
+			itemText.WriteString(delta)
+			if finish != "" {
+				// A proxy-enforced limit was hit: keep the text so far and
+				// stop reading; the caller cancels the upstream request.
+				if itemText.Len() > 0 {
+					blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: itemText.String()})
+				}
+				stopped = true
+				stopReason, stopSequence = anthropicLimitStop(limiter, finish)
+				usage = anthropicStopUsage(limiter)
+			}
+		case "response.output_item.done":
+			item, _ := evt["item"].(map[string]interface{})
+			if item == nil {
+				return nil
+			}
+			sawItemDone = true
+			if typ, _ := item["type"].(string); typ == "message" && limiter != nil {
+				text := itemText.String() + limiter.flush()
+				itemText.Reset()
+				if text != "" {
+					blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: text})
+				}
+				return nil
+			}
+			if block, ok := anthropicBlockFromOutputItem(item); ok {
+				if block.Type == "tool_use" {
+					sawToolUse = true
+				}
+				blocks = append(blocks, block)
+			}
+		case "response.completed", "response.incomplete":
+			resp, _ := evt["response"].(map[string]interface{})
+			usage = anthropicUsageFromResponse(resp)
+			if limiter != nil {
+				textDeltas.WriteString(limiter.flush())
+			}
+			if eventType == "response.incomplete" {
+				stopReason = "max_tokens"
+			}
+		case "response.failed", "error":
+			return fmt.Errorf("upstream response failed: %s", upstreamErrorMessage(evt))
+		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			if err := flushEvent(); err != nil {
+				return nil, err
+			}
+			if stopped {
+				break
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(":")) {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("data:")) {
+			payload := bytes.TrimPrefix(line, []byte("data:"))
+			if len(payload) > 0 && payload[0] == ' ' {
+				payload = payload[1:]
+			}
+			cp := make([]byte, len(payload))
+			copy(cp, payload)
+			dataLines = append(dataLines, cp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning SSE stream: %w", err)
+	}
+	if err := flushEvent(); err != nil {
+		return nil, err
+	}
+
+	// Fall back to streamed text deltas when upstream did not emit completed items.
+	if !sawItemDone && !stopped && textDeltas.Len() > 0 {
+		blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: textDeltas.String()})
+	}
+	if blocks == nil {
+		blocks = []AnthropicContentBlock{}
+	}
+	if stopReason == "" {
+		stopReason = "end_turn"
+		if sawToolUse {
+			stopReason = "tool_use"
+		}
+	}
+
+	return &AnthropicMessageResponse{
+		ID:           anthropicMessageID(responseID),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        model,
+		Content:      blocks,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        usage,
+	}, nil
+}
+
+// anthropicLimitStop maps a proxy-enforced finish reason onto the Anthropic
+// stop_reason and stop_sequence.
+func anthropicLimitStop(limiter *outputLimiter, finish string) (string, *string) {
+	if finish == "stop" {
+		seq := limiter.stopSequence
+		return "stop_sequence", &seq
+	}
+	return "max_tokens", nil
+}
+
+// anthropicStopUsage returns the usage to report when the proxy stopped the
+// response itself. Counts are zero unless the tokenizer measured them.
+func anthropicStopUsage(limiter *outputLimiter) AnthropicUsage {
+	prompt, completion, _ := limiter.stopUsage()
+	return AnthropicUsage{InputTokens: prompt, OutputTokens: completion}
+}
+
+// anthropicBlockFromOutputItem converts a completed Codex output item into an
+// Anthropic content block. Items without an Anthropic equivalent report false.
+func anthropicBlockFromOutputItem(item map[string]interface{}) (AnthropicContentBlock, bool) {
+	switch typ, _ := item["type"].(string); typ {
+	case "message":
+		var parts []string
+		if contents, ok := item["content"].([]interface{}); ok {
+			for _, c := range contents {
+				cm, ok := c.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if text, _ := cm["text"].(string); text != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+		if len(parts) == 0 {
+			return AnthropicContentBlock{}, false
+		}
+		return AnthropicContentBlock{Type: "text", Text: strings.Join(parts, "")}, true
+	case "reasoning":
+		var parts []string
+		if summary, ok := item["summary"].([]interface{}); ok {
+			for _, s := range summary {
+				sm, ok := s.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if text, _ := sm["text"].(string); text != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+		if len(parts) == 0 {
+			return AnthropicContentBlock{}, false
+		}
+		return AnthropicContentBlock{Type: "thinking", Thinking: strings.Join(parts, "\n\n")}, true
+	case "function_call":
+		callID, _ := item["call_id"].(string)
+		if callID == "" {
+			id, _ := item["id"].(string)
+			callID = "call_" + id
+		}
+		name, _ := item["name"].(string)
+		arguments, _ := item["arguments"].(string)
+		return AnthropicContentBlock{
+			Type:  "tool_use",
+			ID:    callID,
+			Name:  name,
+			Input: anthropicToolInput(arguments),
+		}, true
+	default:
+		return AnthropicContentBlock{}, false
+	}
+}
+
+// anthropicUsageFromResponse maps Codex usage onto Anthropic usage. Anthropic
+// reports cached prompt tokens separately from input_tokens.
+func anthropicUsageFromResponse(resp map[string]interface{}) AnthropicUsage {
+	var usage AnthropicUsage
+	u, _ := resp["usage"].(map[string]interface{})
+	if u == nil {
+		return usage
+	}
+	input, _ := u["input_tokens"].(float64)
+	output, _ := u["output_tokens"].(float64)
+	var cached float64
+	if details, ok := u["input_tokens_details"].(map[string]interface{}); ok {
+		cached, _ = details["cached_tokens"].(float64)
+	}
+	usage.InputTokens = int(input - cached)
+	usage.OutputTokens = int(output)
+	usage.CacheReadInputTokens = int(cached)
+	return usage
+}
+
+// upstreamErrorMessage extracts a human-readable message from a Codex
+// response.failed or error event.
+func upstreamErrorMessage(evt map[string]interface{}) string {
+	if resp, ok := evt["response"].(map[string]interface{}); ok {
+		if e, ok := resp["error"].(map[string]interface{}); ok {
+			if msg, _ := e["message"].(string); msg != "" {
+				return msg
+			}
+		}
+	}
+	if e, ok := evt["error"].(map[string]interface{}); ok {
+		if msg, _ := e["message"].(string); msg != "" {
+			return msg
+		}
+	}
+	if msg, _ := evt["message"].(string); msg != "" {
+		return msg
+	}
+	return "unknown upstream error"
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiError is an error reported to clients in the OpenAI error schema
+// {"error":{"message","type","param","code"}}, so SDKs can parse it and
+// back off on Retry-After.
+type apiError struct {
+	Status     int
+	Message    string
+	Type       string
+	Code       string
+	Param      interface{}
+	RetryAfter time.Duration // 0 omits the Retry-After header
+}
+
+func (e apiError) object() map[string]interface{} {
+	obj := map[string]interface{}{
+		"message": e.Message,
+		"type":    e.Type,
+		"param":   e.Param,
+		"code":    nil,
+	}
+	if e.Code != "" {
+		obj["code"] = e.Code
+	}
+	return obj
+}
+
+// writeAPIError writes e as an OpenAI error response.
+func writeAPIError(w http.ResponseWriter, e apiError) {
+	setRetryAfter(w, e.RetryAfter)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": e.object()})
+}
+
+// setRetryAfter sets Retry-After in whole seconds, rounding up.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	if d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	}
+}
+
+// invalidRequestError is a 400 for malformed client input.
+func invalidRequestError(message string) apiError {
+	return apiError{Status: http.StatusBadRequest, Message: message, Type: "invalid_request_error"}
+}
+
+// unauthorizedError rejects a request without a valid proxy API key.
+func unauthorizedError(message string) apiError {
+	return apiError{Status: http.StatusUnauthorized, Message: message, Type: "invalid_request_error", Code: "invalid_api_key"}
+}
+
+// internalError is a proxy-side failure that is not the client's fault.
+func internalError(status int, message string) apiError {
+	return apiError{Status: status, Message: message, Type: "server_error"}
+}
+
+// credentialsError marks failures to load the proxy's own ChatGPT
+// credentials, as opposed to transport errors talking to upstream.
+type credentialsError struct {
+	msg string
+	err error
+}
+
+func (e *credentialsError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e *credentialsError) Unwrap() error { return e.err }
+
+// upstreamRequestError maps an error from makeChatGPTRequestWithRetry.
+// statusCode is the status that accompanied the error, if any.
+func upstreamRequestError(statusCode int, err error) apiError {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return apiError{
+			Status:  http.StatusUnauthorized,
+			Message: "The proxy's ChatGPT credentials expired and could not be refreshed: " + err.Error(),
+			Type:    "authentication_error",
+			Code:    "upstream_token_expired",
+		}
+	case errors.As(err, new(*credentialsError)):
+		return apiError{
+			Status:     http.StatusServiceUnavailable,
+			Message:    "Proxy credentials unavailable: " + err.Error(),
+			Type:       "server_error",
+			Code:       "credentials_unavailable",
+			RetryAfter: 30 * time.Second,
+		}
+	default:
+		return apiError{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Failed to communicate with upstream API: " + err.Error(),
+			Type:    "server_error",
+			Code:    "upstream_unavailable",
+		}
+	}
+}
+
+// codexErrorClass returns the client status and OpenAI error type for a
+// Codex error code. ok is false for codes without a specific mapping.
+func codexErrorClass(code string) (status int, typ string, ok bool) {
+	switch code {
+	case "usage_limit_reached", "usage_not_included":
+		return http.StatusTooManyRequests, "insufficient_quota", true
+	case "rate_limit_exceeded":
+		return http.StatusTooManyRequests, "rate_limit_error", true
+	case "context_length_exceeded", "invalid_prompt", "invalid_request_error", "invalid_image", "invalid_image_format":
+		return http.StatusBadRequest, "invalid_request_error", true
+	case "model_not_found":
+		return http.StatusNotFound, "invalid_request_error", true
+	default:
+		return 0, "", false
+	}
+}
+
+// translateUpstreamError converts a non-200 Codex response into an apiError.
+// Codex reports errors either as {"error":{"type"|"code","message",...}} or
+// as {"detail":"..."}; usage limits carry resets_in_seconds / resets_at.
+func translateUpstreamError(statusCode int, header http.Header, body []byte) apiError {
+	var parsed struct {
+		Error *struct {
+			Message         string      `json:"message"`
+			Type            string      `json:"type"`
+			Code            interface{} `json:"code"`
+			Param           interface{} `json:"param"`
+			ResetsInSeconds float64     `json:"resets_in_seconds"`
+			ResetsAt        float64     `json:"resets_at"`
+		} `json:"error"`
+		Detail interface{} `json:"detail"`
+	}
+	_ = json.Unmarshal(body, &parsed)
+
+	e := apiError{Status: statusCode}
+	var code string
+	if pe := parsed.Error; pe != nil {
+		e.Message = pe.Message
+		e.Param = pe.Param
+		code, _ = pe.Code.(string)
+		if code == "" {
+			code = pe.Type
+		}
+		switch {
+		case pe.ResetsInSeconds > 0:
+			e.RetryAfter = time.Duration(pe.ResetsInSeconds * float64(time.Second))
+		case pe.ResetsAt > 0:
+			e.RetryAfter = time.Until(time.Unix(int64(pe.ResetsAt), 0))
+		}
+	}
+	if e.Message == "" {
+		switch d := parsed.Detail.(type) {
+		case string:
+			e.Message = d
+		case nil:
+		default:
+			if b, err := json.Marshal(d); err == nil {
+				e.Message = string(b)
+			}
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+		if len(e.Message) > 500 {
+			e.Message = e.Message[:500] + "…"
+		}
+	}
+	if e.Message == "" {
+		e.Message = fmt.Sprintf("Upstream returned %d %s", statusCode, http.StatusText(statusCode))
+	}
+
+	lower := strings.ToLower(e.Message)
+	if code == "" {
+		switch {
+		case strings.Contains(lower, "usage limit"):
+			code = "usage_limit_reached"
+		case strings.Contains(lower, "context window") || strings.Contains(lower, "context length"):
+			code = "context_length_exceeded"
+		case statusCode == http.StatusBadRequest && strings.Contains(lower, "model") &&
+			(strings.Contains(lower, "not supported") || strings.Contains(lower, "unsupported") || strings.Contains(lower, "does not exist")):
+			code = "model_not_found"
+		}
+	}
+
+	if status, typ, ok := codexErrorClass(code); ok {
+		e.Status, e.Type = status, typ
+	} else {
+		switch {
+		case statusCode == http.StatusUnauthorized:
+			e.Type = "authentication_error"
+			code = "upstream_unauthorized"
+			e.Message = "The proxy's ChatGPT credentials were rejected: " + e.Message
+		case statusCode == http.StatusForbidden:
+			e.Type = "permission_error"
+		case statusCode == http.StatusTooManyRequests:
+			e.Type = "rate_limit_error"
+		case statusCode >= 500:
+			e.Type = "server_error"
+		default:
+			e.Type = "invalid_request_error"
+		}
+	}
+	if code != e.Type {
+		e.Code = code
+	}
+
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(v); err == nil {
+			e.RetryAfter = time.Until(at)
+		}
+	}
+	if e.RetryAfter < 0 {
+		e.RetryAfter = 0
+	}
+	return e
+}
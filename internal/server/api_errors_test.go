@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateUpstreamError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		header     http.Header
+		body       string
+		wantStatus int
+		wantType   string
+		wantCode   string
+		retryAfter time.Duration
+	}{
+		{
+			name:       "usage limit",
+			status:     http.StatusTooManyRequests,
+			body:       `{"error":{"type":"usage_limit_reached","message":"The usage limit has been reached","resets_in_seconds":90}}`,
+			wantStatus: http.StatusTooManyRequests,
+			wantType:   "insufficient_quota",
+			wantCode:   "usage_limit_reached",
+			retryAfter: 90 * time.Second,
+		},
+		{
+			name:       "context too long",
+			status:     http.StatusBadRequest,
+			body:       `{"error":{"message":"Your input exceeds the context window of this model.","type":"invalid_request_error","code":"context_length_exceeded","param":"input"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+			wantCode:   "context_length_exceeded",
+		},
+		{
+			name:       "invalid model",
+			status:     http.StatusBadRequest,
+			body:       `{"detail":"The 'gpt-9' model is not supported when using Codex with a ChatGPT account."}`,
+			wantStatus: http.StatusNotFound,
+			wantType:   "invalid_request_error",
+			wantCode:   "model_not_found",
+		},
+		{
+			name:       "auth failure",
+			status:     http.StatusUnauthorized,
+			body:       `{"detail":"Could not parse your authentication token."}`,
+			wantStatus: http.StatusUnauthorized,
+			wantType:   "authentication_error",
+			wantCode:   "upstream_unauthorized",
+		},
+		{
+			name:       "overloaded with retry-after",
+			status:     http.StatusServiceUnavailable,
+			header:     http.Header{"Retry-After": []string{"7"}},
+			body:       `upstream connect error`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantType:   "server_error",
+			retryAfter: 7 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			e := translateUpstreamError(tt.status, header, []byte(tt.body))
+			assert.Equal(t, tt.wantStatus, e.Status)
+			assert.Equal(t, tt.wantType, e.Type)
+			assert.Equal(t, tt.wantCode, e.Code)
+			assert.Equal(t, tt.retryAfter, e.RetryAfter)
+			assert.NotEmpty(t, e.Message)
+		})
+	}
+}
+
+func TestUpstreamRequestError(t *testing.T) {
+	e := upstreamRequestError(0, &credentialsError{msg: "failed to get credentials", err: errors.New("keychain locked")})
+	assert.Equal(t, http.StatusServiceUnavailable, e.Status)
+	assert.Equal(t, "credentials_unavailable", e.Code)
+	assert.Positive(t, e.RetryAfter)
+
+	e = upstreamRequestError(http.StatusUnauthorized, errors.New("token expired and refresh failed"))
+	assert.Equal(t, http.StatusUnauthorized, e.Status)
+	assert.Equal(t, "authentication_error", e.Type)
+}
+
+func TestChatCompletions_UpstreamErrorUsesOpenAISchema(t *testing.T) {
+	s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusTooManyRequests, `{"error":{"type":"usage_limit_reached","message":"The usage limit has been reached","resets_in_seconds":120}}`
+	}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "120", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var body struct {
+		Error map[string]interface{} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "The usage limit has been reached", body.Error["message"])
+	assert.Equal(t, "usage_limit_reached", body.Error["code"])
+}
+
+func TestChatCompletions_ParseErrorUsesOpenAISchema(t *testing.T) {
+	s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusOK, textSSE("unused", 1, 1)
+	}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{not json`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	var body struct {
+		Error map[string]interface{} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "invalid_request_error", body.Error["type"])
+}
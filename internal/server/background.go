@@ -0,0 +1,8 @@
+//go:build !js || !wasm
+
+package server
+
+// runInBackground runs task without blocking the current request.
+func runInBackground(task func()) {
+	go task()
+}
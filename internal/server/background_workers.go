@@ -0,0 +1,12 @@
+//go:build js && wasm
+
+package server
+
+import "github.com/syumai/workers/cloudflare"
+
+// runInBackground runs task without blocking the current request. Workers
+// stop a request's goroutines once its response is sent, so the task is
+// registered with waitUntil to keep the request alive until it finishes.
+func runInBackground(task func()) {
+	cloudflare.WaitUntil(task)
+}
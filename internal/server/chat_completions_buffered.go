@@ -11,8 +11,29 @@ import (
 
 // streamingDelta represents the delta portion of a streamed chat completion chunk.
 type streamingDelta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role             string              `json:"role,omitempty"`
+	Content          string              `json:"content,omitempty"`
+	ReasoningContent string              `json:"reasoning_content,omitempty"`
+	Reasoning        string              `json:"reasoning,omitempty"`
+	Refusal          string              `json:"refusal,omitempty"`
+	ToolCalls        []streamingToolCall `json:"tool_calls,omitempty"`
+	FunctionCall     *ToolCallFunction   `json:"function_call,omitempty"`
+}
+
+// streamingToolCall is a tool call fragment in a streamed delta. The first
+// fragment for an index carries id and name; later ones append arguments.
+type streamingToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function *struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function,omitempty"`
+	Custom *struct {
+		Name  string `json:"name,omitempty"`
+		Input string `json:"input,omitempty"`
+	} `json:"custom,omitempty"`
 }
 
 // streamingChoice represents a single choice in a streamed chat completion chunk.
@@ -29,14 +50,19 @@ type streamingChunk struct {
 	Created int64             `json:"created"`
 	Model   string            `json:"model"`
 	Choices []streamingChoice `json:"choices"`
+	Usage   *Usage            `json:"usage,omitempty"`
+	// Error is set on in-stream error objects instead of choices.
+	Error map[string]interface{} `json:"error,omitempty"`
 }
 
 // bufferChatCompletionFromSSE consumes an upstream Codex SSE stream, uses the SSETransformer
 // to convert it into OpenAI-style chat.completion.chunk events, and then aggregates those
 // chunks into a single non-streaming ChatCompletionResponse suitable for clients that expect
-// the classic /v1/chat/completions JSON shape.
-func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionResponse, error) {
-	transformer := NewSSETransformer(model)
+// the classic /v1/chat/completions JSON shape. Content, reasoning_content, tool call
+// fragments (merged by tool index) and the final usage object are all carried over.
+// Stop sequences and max tokens from opts end the completion early.
+func bufferChatCompletionFromSSE(body io.Reader, model string, opts chatStreamOptions) (*ChatCompletionResponse, error) {
+	transformer := NewSSETransformer(model).WithOptions(opts)
 
 	scanner := bufio.NewScanner(body)
 	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
@@ -48,6 +74,13 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 		created        int64
 		role           string
 		contentBuilder bytes.Buffer
+		reasoning      bytes.Buffer
+		reasoningField bytes.Buffer
+		refusal        bytes.Buffer
+		toolCalls      []ToolCall
+		toolSlot       = map[int]int{}
+		functionCall   *ToolCallFunction
+		usage          *Usage
 		finishReason   string
 	)
 
@@ -82,6 +115,9 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 				continue
 			}
 
+			if chunk.Error != nil {
+				return &completionError{streamErrorFromObject(chunk.Error)}
+			}
 			if responseID == "" && chunk.ID != "" {
 				responseID = chunk.ID
 			}
@@ -91,6 +127,9 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 			if created == 0 && chunk.Created != 0 {
 				created = chunk.Created
 			}
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+			}
 
 			for _, ch := range chunk.Choices {
 				if ch.Delta.Role != "" && role == "" {
@@ -99,6 +138,57 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 				if ch.Delta.Content != "" {
 					contentBuilder.WriteString(ch.Delta.Content)
 				}
+				if ch.Delta.ReasoningContent != "" {
+					reasoning.WriteString(ch.Delta.ReasoningContent)
+				}
+				if ch.Delta.Reasoning != "" {
+					reasoningField.WriteString(ch.Delta.Reasoning)
+				}
+				if ch.Delta.Refusal != "" {
+					refusal.WriteString(ch.Delta.Refusal)
+				}
+				for _, tc := range ch.Delta.ToolCalls {
+					slot, ok := toolSlot[tc.Index]
+					if !ok {
+						slot = len(toolCalls)
+						toolSlot[tc.Index] = slot
+						toolCalls = append(toolCalls, ToolCall{Type: "function"})
+					}
+					call := &toolCalls[slot]
+					if tc.ID != "" {
+						call.ID = tc.ID
+					}
+					if tc.Type != "" {
+						call.Type = tc.Type
+					}
+					if tc.Function != nil {
+						if call.Function == nil {
+							call.Function = &ToolCallFunction{}
+						}
+						if tc.Function.Name != "" {
+							call.Function.Name = tc.Function.Name
+						}
+						call.Function.Arguments += tc.Function.Arguments
+					}
+					if tc.Custom != nil {
+						if call.Custom == nil {
+							call.Custom = &CustomToolCall{}
+						}
+						if tc.Custom.Name != "" {
+							call.Custom.Name = tc.Custom.Name
+						}
+						call.Custom.Input += tc.Custom.Input
+					}
+				}
+				if fc := ch.Delta.FunctionCall; fc != nil {
+					if functionCall == nil {
+						functionCall = &ToolCallFunction{}
+					}
+					if fc.Name != "" {
+						functionCall.Name = fc.Name
+					}
+					functionCall.Arguments += fc.Arguments
+				}
 				if ch.FinishReason != nil && *ch.FinishReason != "" {
 					finishReason = *ch.FinishReason
 				}
@@ -116,6 +206,10 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 			if err := flushEvent(); err != nil {
 				return nil, err
 			}
+			// A proxy-enforced stop or length limit ended the completion.
+			if transformer.Stopped() {
+				break
+			}
 			continue
 		}
 
@@ -176,12 +270,18 @@ func bufferChatCompletionFromSSE(body io.Reader, model string) (*ChatCompletionR
 			{
 				Index: 0,
 				Message: ChatMessage{
-					Role:    role,
-					Content: contentBuilder.String(),
+					Role:             role,
+					Content:          contentBuilder.String(),
+					ReasoningContent: reasoning.String(),
+					Reasoning:        reasoningField.String(),
+					Refusal:          refusal.String(),
+					ToolCalls:        toolCalls,
+					FunctionCall:     functionCall,
 				},
 				FinishReason: finishReason,
 			},
 		},
+		Usage: usage,
 	}
 	return resp, nil
 }
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferChatCompletionFromSSE_ToolCallsReasoningUsage(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_1"}}`,
+		"",
+		`data: {"type":"response.reasoning_summary_text.delta","sequence_number":1,"output_index":0,"delta":"Need weather"}`,
+		"",
+		`data: {"type":"response.output_text.delta","sequence_number":2,"delta":"Checking."}`,
+		"",
+		`data: {"type":"response.output_item.added","sequence_number":3,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"get_weather"}}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","sequence_number":4,"item_id":"fc_1","delta":"{\"city\":"}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","sequence_number":5,"item_id":"fc_1","delta":"\"Paris\"}"}`,
+		"",
+		`data: {"type":"response.output_item.added","sequence_number":6,"item":{"type":"function_call","id":"fc_2","call_id":"call_2","name":"get_time"}}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","sequence_number":7,"item_id":"fc_2","delta":"{}"}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":8,"response":{"usage":{"input_tokens":12,"output_tokens":7,"total_tokens":19}}}`,
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(src), "gpt-5", chatStreamOptions{})
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 1)
+
+	choice := resp.Choices[0]
+	assert.Equal(t, "tool_calls", choice.FinishReason)
+	assert.Equal(t, "Checking.", choice.Message.Content)
+	assert.Contains(t, choice.Message.ReasoningContent, "Need weather")
+
+	require.Len(t, choice.Message.ToolCalls, 2)
+	assert.Equal(t, "call_1", choice.Message.ToolCalls[0].ID)
+	assert.Equal(t, "function", choice.Message.ToolCalls[0].Type)
+	assert.Equal(t, "get_weather", choice.Message.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"Paris"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, "get_time", choice.Message.ToolCalls[1].Function.Name)
+	assert.Equal(t, "{}", choice.Message.ToolCalls[1].Function.Arguments)
+
+	require.NotNil(t, resp.Usage)
+	assert.Equal(t, Usage{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}, *resp.Usage)
+}
+
+func TestStructuredOutputValidationSkipsRefusalsAndTruncatedChoices(t *testing.T) {
+	t.Setenv("VALIDATE_STRUCTURED_OUTPUTS", "true")
+	refusal := strings.Join([]string{
+		`data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_x"}}`,
+		"",
+		`data: {"type":"response.refusal.delta","sequence_number":1,"delta":"I can't help with that."}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":2,"response":{}}`,
+		"",
+	}, "\n")
+	for _, tc := range []struct {
+		name, sse, extra, finish string
+	}{
+		{"refusal", refusal, "", "stop"},
+		{"max tokens", textSSE(`{"answer": "this is cut`, 3, 8), `,"max_tokens":2`, "length"},
+		{"invalid", textSSE("not json", 3, 2), "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+				return http.StatusOK, tc.sse
+			}})
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+				`{"model":"gpt-5","response_format":{"type":"json_object"}`+tc.extra+`,"messages":[{"role":"user","content":"hi"}]}`))
+			rec := httptest.NewRecorder()
+			s.chatCompletionsHandler(rec, req)
+
+			if tc.finish == "" {
+				assert.Equal(t, http.StatusBadGateway, rec.Code, "normal choices are still validated")
+				return
+			}
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			var resp ChatCompletionResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tc.finish, resp.Choices[0].FinishReason)
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// defaultMaxChoices is the n cap used when MAX_CHOICES is not set. Each
+// choice is a separate upstream request, so the cap bounds the fan-out.
+const defaultMaxChoices = 4
+
+func maxChoices() int {
+	if n, err := strconv.Atoi(strings.TrimSpace(env.GetOrDefault("MAX_CHOICES", ""))); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxChoices
+}
+
+// requestedChoiceCount returns the chat completions n parameter, defaulting to
+// 1 and rejecting values outside 1..maxChoices().
+func requestedChoiceCount(requestData map[string]interface{}) (int, error) {
+	raw, ok := requestData["n"]
+	if !ok || raw == nil {
+		return 1, nil
+	}
+	f, ok := raw.(float64)
+	if !ok || f < 1 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("n must be a positive integer")
+	}
+	if limit := maxChoices(); f > float64(limit) {
+		return 0, fmt.Errorf("n must be at most %d", limit)
+	}
+	return int(f), nil
+}
+
+// fanOutChatCompletions serves n>1 by issuing n concurrent upstream requests
+// (the Codex backend returns a single candidate per request) and merging the
+// results: choice i comes from upstream request i. If any request fails before
+// output starts, that error is returned to the client and the others are
+// discarded.
+func (s *Server) fanOutChatCompletions(w http.ResponseWriter, r *http.Request, url string, body []byte, model string, n int, stream bool, requestData map[string]interface{}, opts chatStreamOptions) {
+	type result struct {
+		resp   *http.Response
+		status int
+		err    error
+	}
+	results := make([]result, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, status, err := s.makeChatGPTRequestWithRetry(r, url, body, model)
+			results[i] = result{resp: resp, status: status, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	failed := -1
+	for i, res := range results {
+		if res.err != nil || res.status != http.StatusOK {
+			failed = i
+			break
+		}
+	}
+	if failed >= 0 {
+		for i, res := range results {
+			if i != failed && res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}
+		res := results[failed]
+		if res.err != nil {
+			s.logger.Error().Err(res.err).Int("choice_index", failed).Msg("Error making request to ChatGPT backend")
+			writeAPIError(w, upstreamRequestError(res.status, res.err))
+			return
+		}
+		s.writeResponse(w, res.resp, res.status, model, false, chatStreamOptions{})
+		return
+	}
+
+	resps := make([]*http.Response, n)
+	for i, res := range results {
+		resps[i] = res.resp
+	}
+	setRateLimitHeaders(w.Header(), resps[n-1].Header)
+	// Choices may fall back independently; the first one names the model.
+	setServedModelHeader(w.Header(), resps[0].Header)
+	model = servedModel(resps[0], model)
+	if stream {
+		s.streamMergedChoices(w, r, resps, model, opts)
+		return
+	}
+
+	respObj, err := mergeBufferedChoices(resps, model, opts)
+	var upstreamErr *completionError
+	if errors.As(err, &upstreamErr) {
+		s.logger.Warn().Err(err).Int("status", upstreamErr.Status).Msg("Upstream response failed mid-stream")
+		writeAPIError(w, upstreamErr.apiError)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error buffering SSE stream for non-streaming client")
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to process streaming response"))
+		return
+	}
+	s.writeBufferedChatCompletion(w, respObj, requestData)
+}
+
+// mergeBufferedChoices buffers each upstream stream concurrently and combines
+// them into one response, with usage summed across requests.
+func mergeBufferedChoices(resps []*http.Response, model string, opts chatStreamOptions) (*ChatCompletionResponse, error) {
+	buffered := make([]*ChatCompletionResponse, len(resps))
+	errs := make([]error, len(resps))
+	var wg sync.WaitGroup
+	for i, resp := range resps {
+		wg.Add(1)
+		go func(i int, resp *http.Response) {
+			defer wg.Done()
+			defer resp.Body.Close()
+			buffered[i], errs[i] = bufferChatCompletionFromSSE(resp.Body, model, opts)
+		}(i, resp)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("choice %d: %w", i, err)
+		}
+	}
+
+	merged := *buffered[0]
+	merged.Choices = make([]ChatCompletionChoice, 0, len(buffered))
+	var usage *Usage
+	for i, b := range buffered {
+		for _, choice := range b.Choices {
+			choice.Index = i
+			merged.Choices = append(merged.Choices, choice)
+		}
+		if b.Usage != nil {
+			if usage == nil {
+				usage = &Usage{}
+			}
+			usage.add(b.Usage)
+		}
+	}
+	merged.Usage = usage
+	return &merged, nil
+}
+
+// streamMergedChoices transforms each upstream stream into chat completion
+// chunks and writes them to the client in arrival order. Every chunk is
+// rewritten to share one completion id and to carry its choice index. Per-choice
+// usage is stripped and reported once, summed: on the last finish chunk, or
+// with stream_options.include_usage in a final usage-only chunk before [DONE],
+// as in the single-choice stream.
+func (s *Server) streamMergedChoices(w http.ResponseWriter, r *http.Request, resps []*http.Response, model string, opts chatStreamOptions) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	var out io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+		out = sseFlushWriter{w: w, f: flusher}
+	}
+
+	completionID := "chatcmpl-" + newUUIDv4()
+	ctx := r.Context()
+	chunks := make(chan mergedChunk)
+
+	var (
+		wg        sync.WaitGroup
+		usageMu   sync.Mutex
+		usage     Usage
+		sawUsage  bool
+		streamErr = make([]error, len(resps))
+	)
+	for i, resp := range resps {
+		wg.Add(1)
+		go func(i int, resp *http.Response) {
+			defer wg.Done()
+			defer resp.Body.Close()
+			transformer := NewSSETransformer(model).WithOptions(opts)
+			streamErr[i] = scanSSEData(resp.Body, func(raw []byte) error {
+				transformed, done, err := transformer.Transform(raw)
+				if err != nil || done || len(transformed) == 0 {
+					return err
+				}
+
+				for _, line := range bytes.Split(transformed, []byte("\n")) {
+					chunk, u, finish, err := reindexChunk(line, completionID, i)
+					if err != nil {
+						return err
+					}
+					if u != nil {
+						usageMu.Lock()
+						usage.add(u)
+						sawUsage = true
+						usageMu.Unlock()
+					}
+					if chunk == nil {
+						continue
+					}
+					select {
+					case chunks <- mergedChunk{data: chunk, finish: finish}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				// A stop/length limit ended this choice; closing the body
+				// (deferred above) aborts its upstream request.
+				if transformer.Stopped() {
+					return errStopScan
+				}
+				return nil
+			})
+		}(i, resp)
+	}
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+
+	writeFailed := false
+	finished := 0
+	for chunk := range chunks {
+		if writeFailed {
+			continue
+		}
+		data := chunk.data
+		if chunk.finish {
+			// Every choice adds its usage before sending its finish chunk,
+			// so the sum is complete once the last choice finishes.
+			if finished++; finished == len(resps) && !opts.includeUsage {
+				usageMu.Lock()
+				if sawUsage {
+					data = withChunkUsage(data, usage)
+				}
+				usageMu.Unlock()
+			}
+		}
+		if _, err := fmt.Fprintf(out, "data: %s\n\n", data); err != nil {
+			s.logger.Error().Err(err).Msg("Error writing merged SSE chunk to client")
+			writeFailed = true
+		}
+	}
+	for i, err := range streamErr {
+		if err != nil {
+			s.logger.Error().Err(err).Int("choice_index", i).Msg("Error rewriting SSE stream")
+		}
+	}
+	if writeFailed {
+		return
+	}
+
+	if opts.includeUsage && sawUsage {
+		final, err := json.Marshal(map[string]interface{}{
+			"id":      completionID,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []interface{}{},
+			"usage":   usage,
+		})
+		if err == nil {
+			fmt.Fprintf(out, "data: %s\n\n", final)
+		}
+	}
+	io.WriteString(out, "data: [DONE]\n\n")
+}
+
+// mergedChunk is a reindexed chunk on its way to the merged stream. finish is
+// set on the chunk that carries its choice's finish_reason.
+type mergedChunk struct {
+	data   []byte
+	finish bool
+}
+
+// reindexChunk rewrites a chat.completion.chunk for choice index and strips
+// its usage object, which is returned separately. Usage-only chunks are
+// dropped entirely (nil chunk) since the merged stream sends its own. finish
+// reports whether the chunk closes its choice.
+func reindexChunk(line []byte, completionID string, index int) ([]byte, *Usage, bool, error) {
+	var chunk map[string]interface{}
+	if err := json.Unmarshal(line, &chunk); err != nil {
+		return nil, nil, false, fmt.Errorf("invalid transformed chunk: %w", err)
+	}
+	if _, isError := chunk["error"]; isError {
+		return line, nil, false, nil
+	}
+	chunk["id"] = completionID
+	finish := false
+	if choices, ok := chunk["choices"].([]interface{}); ok {
+		for _, c := range choices {
+			if cm, ok := c.(map[string]interface{}); ok {
+				cm["index"] = index
+				if reason, _ := cm["finish_reason"].(string); reason != "" {
+					finish = true
+				}
+			}
+		}
+	}
+	var usage *Usage
+	if raw, ok := chunk["usage"]; ok {
+		delete(chunk, "usage")
+		if b, err := json.Marshal(raw); err == nil {
+			var u Usage
+			if json.Unmarshal(b, &u) == nil {
+				usage = &u
+			}
+		}
+	}
+	if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) == 0 && usage != nil {
+		return nil, usage, false, nil
+	}
+	b, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to marshal reindexed chunk: %w", err)
+	}
+	return b, usage, finish, nil
+}
+
+// withChunkUsage returns chunk with usage set, or chunk unchanged when it
+// cannot be rewritten.
+func withChunkUsage(chunk []byte, usage Usage) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(chunk, &m); err != nil {
+		return chunk
+	}
+	m["usage"] = usage
+	b, err := json.Marshal(m)
+	if err != nil {
+		return chunk
+	}
+	return b
+}
+
+// errStopScan can be returned from a scanSSEData callback to stop reading
+// without reporting an error.
+var errStopScan = errors.New("stop scanning SSE stream")
+
+// scanSSEData calls fn with the joined data payload of each SSE event in r.
+func scanSSEData(r io.Reader, fn func(raw []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	var dataLines [][]byte
+	flush := func() error {
+		if len(dataLines) == 0 {
+			return nil
+		}
+		raw := bytes.Join(dataLines, []byte("\n"))
+		dataLines = dataLines[:0]
+		return fn(raw)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err := flush(); err != nil {
+				if errors.Is(err, errStopScan) {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(":")) {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("data:")) {
+			payload := bytes.TrimPrefix(line, []byte("data:"))
+			if len(payload) > 0 && payload[0] == ' ' {
+				payload = payload[1:]
+			}
+			cp := make([]byte, len(payload))
+			copy(cp, payload)
+			dataLines = append(dataLines, cp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil && !errors.Is(err, errStopScan) {
+		return err
+	}
+	return nil
+}
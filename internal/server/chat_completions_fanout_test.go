@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticCreds struct{}
+
+func (staticCreds) GetCredentials() (string, string, error) { return "token", "account", nil }
+func (staticCreds) RefreshCredentials() error               { return nil }
+
+// fakeUpstream answers every request with an SSE stream produced by respond,
+// which receives the zero-based call number.
+type fakeUpstream struct {
+	calls   int32
+	respond func(call int, req *http.Request) (int, string)
+}
+
+func (f *fakeUpstream) Do(req *http.Request) (*http.Response, error) {
+	call := int(atomic.AddInt32(&f.calls, 1)) - 1
+	status, body := f.respond(call, req)
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func newTestServer(upstream *fakeUpstream) *Server {
+	s, err := New(zerolog.Nop(), staticCreds{}, UpstreamConfig{})
+	if err != nil {
+		panic(err)
+	}
+	s.httpClient = upstream
+	s.modelCatalog = nil
+	return s
+}
+
+func textSSE(text string, inputTokens, outputTokens int) string {
+	return strings.Join([]string{
+		`data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_x"}}`,
+		"",
+		fmt.Sprintf(`data: {"type":"response.output_text.delta","sequence_number":1,"delta":%q}`, text),
+		"",
+		fmt.Sprintf(`data: {"type":"response.completed","sequence_number":2,"response":{"usage":{"input_tokens":%d,"output_tokens":%d}}}`, inputTokens, outputTokens),
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+}
+
+func TestChatCompletions_FanOutNonStreaming(t *testing.T) {
+	upstream := &fakeUpstream{respond: func(call int, _ *http.Request) (int, string) {
+		return http.StatusOK, textSSE(fmt.Sprintf("candidate-%d", call), 10, 2)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","n":3,"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&upstream.calls))
+
+	var resp ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 3)
+	seen := map[string]bool{}
+	for i, choice := range resp.Choices {
+		assert.Equal(t, i, choice.Index)
+		seen[choice.Message.Content] = true
+	}
+	assert.Len(t, seen, 3)
+	require.NotNil(t, resp.Usage)
+	assert.Equal(t, 30, resp.Usage.PromptTokens)
+	assert.Equal(t, 6, resp.Usage.CompletionTokens)
+}
+
+func TestChatCompletions_FanOutStreaming(t *testing.T) {
+	upstream := &fakeUpstream{respond: func(call int, _ *http.Request) (int, string) {
+		return http.StatusOK, textSSE(fmt.Sprintf("candidate-%d", call), 5, 1)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","n":2,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `"index":0`)
+	assert.Contains(t, body, `"index":1`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+	assert.Equal(t, 1, strings.Count(body, "[DONE]"))
+
+	// Without stream_options.include_usage the summed usage rides on the last
+	// finish chunk and every chunk has a choice.
+	var finishes []map[string]interface{}
+	for _, line := range strings.Split(body, "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(payload), &chunk))
+		choices, _ := chunk["choices"].([]interface{})
+		require.NotEmpty(t, choices, payload)
+		if choices[0].(map[string]interface{})["finish_reason"] != nil {
+			finishes = append(finishes, chunk)
+		}
+	}
+	require.Len(t, finishes, 2)
+	assert.Nil(t, finishes[0]["usage"])
+	assert.Equal(t, map[string]interface{}{"prompt_tokens": float64(10), "completion_tokens": float64(2), "total_tokens": float64(12)}, finishes[1]["usage"])
+}
+
+func TestChatCompletions_FanOutStreamingIncludeUsage(t *testing.T) {
+	upstream := &fakeUpstream{respond: func(call int, _ *http.Request) (int, string) {
+		return http.StatusOK, textSSE(fmt.Sprintf("candidate-%d", call), 5, 1)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","n":2,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `"choices":[],"created"`)
+	assert.Equal(t, 1, strings.Count(body, `"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}`))
+}
+
+func TestChatCompletions_RejectsNAboveCap(t *testing.T) {
+	t.Setenv("MAX_CHOICES", "2")
+	upstream := &fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusOK, textSSE("x", 1, 1)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","n":3,"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstream.calls))
+}
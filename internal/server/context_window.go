@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+	"github.com/dvcrn/codex-proxy/internal/tokenizer"
+)
+
+// Long agent conversations eventually outgrow the model's context window,
+// after which every request fails upstream. Before forwarding, the proxy
+// counts the request's tokens and, once it passes CONTEXT_THRESHOLD of the
+// model's window, applies the CONTEXT_POLICY steps in order until it fits:
+//
+//	truncate_tool_outputs  shorten tool outputs longer than
+//	                       CONTEXT_TOOL_OUTPUT_MAX_CHARS, oldest first
+//	drop_tool_outputs      replace tool outputs with a placeholder, oldest first
+//	summarize              replace the turns before the last user message with
+//	                       a summary written by CONTEXT_SUMMARY_MODEL
+//
+// The default policy is "truncate_tool_outputs,drop_tool_outputs"; "off"
+// disables compaction. CONTEXT_LIMITS ("model=tokens,...") overrides the
+// windows advertised in the model catalog.
+
+const (
+	contextStepTruncate  = "truncate_tool_outputs"
+	contextStepDrop      = "drop_tool_outputs"
+	contextStepSummarize = "summarize"
+
+	defaultContextThreshold      = 0.9
+	defaultToolOutputMaxChars    = 8000
+	defaultContextSummaryModel   = modelGPT51CodexMini
+	droppedToolOutputPlaceholder = "[tool output omitted to fit the context window]"
+
+	contextSummaryPrompt = "Summarize the conversation below so an assistant can continue it without the original messages. " +
+		"Keep the user's goals and constraints, decisions made, files and commands involved, tool results that still matter, and open tasks. " +
+		"Be concise and factual; reply with the summary only."
+)
+
+// contextPolicy is the context-window configuration.
+type contextPolicy struct {
+	steps              []string
+	threshold          float64
+	toolOutputMaxChars int
+	summaryModel       string
+	limits             map[string]int
+	// tokenizer counts request tokens; nil estimates them.
+	tokenizer *tokenizer.Tokenizer
+}
+
+func newContextPolicyFromEnv() contextPolicy {
+	p := contextPolicy{
+		threshold:          defaultContextThreshold,
+		toolOutputMaxChars: defaultToolOutputMaxChars,
+		summaryModel:       env.GetOrDefault("CONTEXT_SUMMARY_MODEL", defaultContextSummaryModel),
+		limits:             map[string]int{},
+	}
+	for _, step := range strings.Split(env.GetOrDefault("CONTEXT_POLICY", contextStepTruncate+","+contextStepDrop), ",") {
+		switch step = strings.ToLower(strings.TrimSpace(step)); step {
+		case contextStepTruncate, contextStepDrop, contextStepSummarize:
+			p.steps = append(p.steps, step)
+		}
+	}
+	if v, ok := env.Get("CONTEXT_THRESHOLD"); ok {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f > 0 && f <= 1 {
+			p.threshold = f
+		}
+	}
+	if v, ok := env.Get("CONTEXT_TOOL_OUTPUT_MAX_CHARS"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > 0 {
+			p.toolOutputMaxChars = n
+		}
+	}
+	for _, pair := range strings.Split(env.GetOrDefault("CONTEXT_LIMITS", ""), ",") {
+		model, tokens, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(tokens)); err == nil && n > 0 {
+			p.limits[strings.TrimSpace(model)] = n
+		}
+	}
+	return p
+}
+
+// contextLimit returns the context window of a canonical backend model, or 0
+// when it is unknown.
+func (p contextPolicy) contextLimit(model string) int {
+	if n, ok := p.limits[model]; ok {
+		return n
+	}
+	meta, ok := currentModels().metadata[model]
+	if !ok {
+		return 0
+	}
+	limits, _ := meta.Capabilities["limits"].(map[string]interface{})
+	n, _ := limits["max_context_window_tokens"].(int)
+	return n
+}
+
+// contextCompaction describes how a request was compacted.
+type contextCompaction struct {
+	limit  int
+	before int
+	after  int
+	steps  []string
+}
+
+// summarizeFunc writes a summary of Codex input items.
+type summarizeFunc func(items []interface{}) (string, error)
+
+// compact applies the policy to body in place. It returns nil when body was
+// under budget. A failed summary is reported as an error after the remaining
+// steps have run.
+func (p contextPolicy) compact(body map[string]interface{}, summarize summarizeFunc) (*contextCompaction, error) {
+	model, _ := body["model"].(string)
+	limit := p.contextLimit(model)
+	input, ok := body["input"].([]interface{})
+	if len(p.steps) == 0 || limit <= 0 || !ok {
+		return nil, nil
+	}
+	count := newTokenCounter(p.tokenizer)
+	b := &tokenBudget{count: count, budget: int(float64(limit) * p.threshold), total: count.request(body)}
+	if b.fits() {
+		return nil, nil
+	}
+
+	c := &contextCompaction{limit: limit, before: b.total}
+	var summaryErr error
+	for _, step := range p.steps {
+		if b.fits() {
+			break
+		}
+		changed := false
+		switch step {
+		case contextStepTruncate:
+			changed = rewriteToolOutputs(input, b, func(output string) string {
+				return truncateMiddle(output, p.toolOutputMaxChars)
+			})
+		case contextStepDrop:
+			changed = rewriteToolOutputs(input, b, func(string) string {
+				return droppedToolOutputPlaceholder
+			})
+		case contextStepSummarize:
+			if summarize == nil {
+				continue
+			}
+			summarized, err := summarizeEarlierTurns(input, summarize)
+			if err != nil {
+				summaryErr = err
+				continue
+			}
+			if summarized != nil {
+				input = summarized
+				body["input"] = input
+				b.total = count.request(body)
+				changed = true
+			}
+		}
+		if changed {
+			c.steps = append(c.steps, step)
+		}
+	}
+	c.after = b.total
+	return c, summaryErr
+}
+
+func isToolOutputItem(item map[string]interface{}) bool {
+	switch typ, _ := item["type"].(string); typ {
+	case "function_call_output", "custom_tool_call_output":
+		return true
+	}
+	return false
+}
+
+// tokenBudget tracks the token count of a request while its input items are
+// rewritten, so each rewrite only recounts the item it changed.
+type tokenBudget struct {
+	count  tokenCounter
+	total  int
+	budget int
+}
+
+func (b *tokenBudget) fits() bool {
+	return b.total <= b.budget
+}
+
+// rewriteToolOutputs rewrites string tool outputs oldest first until the
+// request fits b. It reports whether any output changed.
+func rewriteToolOutputs(input []interface{}, b *tokenBudget, rewrite func(string) string) bool {
+	changed := false
+	for _, item := range input {
+		m, ok := item.(map[string]interface{})
+		if !ok || !isToolOutputItem(m) {
+			continue
+		}
+		output, ok := m["output"].(string)
+		if !ok {
+			continue
+		}
+		if rewritten := rewrite(output); rewritten != output {
+			before := b.count.inputItem(m)
+			m["output"] = rewritten
+			b.total += b.count.inputItem(m) - before
+			changed = true
+			if b.fits() {
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// truncateMiddle keeps the head and tail of s within max characters.
+func truncateMiddle(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	head := max * 2 / 3
+	tail := max - head
+	return string(runes[:head]) +
+		fmt.Sprintf("\n[… %d characters truncated to fit the context window …]\n", len(runes)-max) +
+		string(runes[len(runes)-tail:])
+}
+
+// summarizeEarlierTurns replaces everything between the leading developer
+// messages and the last user message with a single summary message. It
+// returns nil when there are no earlier turns to summarize.
+func summarizeEarlierTurns(input []interface{}, summarize summarizeFunc) ([]interface{}, error) {
+	start := 0
+	for start < len(input) {
+		m, ok := input[start].(map[string]interface{})
+		if !ok {
+			break
+		}
+		if role, _ := m["role"].(string); role != "developer" {
+			break
+		}
+		start++
+	}
+	end := -1
+	for i := len(input) - 1; i >= start; i-- {
+		if m, ok := input[i].(map[string]interface{}); ok {
+			if role, _ := m["role"].(string); role == "user" {
+				end = i
+				break
+			}
+		}
+	}
+	if end <= start {
+		return nil, nil
+	}
+
+	summary, err := summarize(input[start:end])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, 0, start+1+len(input)-end)
+	out = append(out, input[:start]...)
+	out = append(out, map[string]interface{}{
+		"type": "message",
+		"role": "developer",
+		"content": []interface{}{map[string]interface{}{
+			"type": "input_text",
+			"text": "Summary of the earlier conversation, which was compacted to fit the context window:\n\n" + strings.TrimSpace(summary),
+		}},
+	})
+	out = append(out, input[end:]...)
+	return out, nil
+}
+
+// renderTranscript formats Codex input items as plain text for summarizing.
+func renderTranscript(items []interface{}, maxOutputChars int) string {
+	var b strings.Builder
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch typ, _ := m["type"].(string); {
+		case isToolOutputItem(m):
+			output, _ := m["output"].(string)
+			fmt.Fprintf(&b, "tool result: %s\n\n", truncateMiddle(output, maxOutputChars))
+		case typ == "function_call" || typ == "custom_tool_call":
+			name, _ := m["name"].(string)
+			args, _ := m["arguments"].(string)
+			if args == "" {
+				args, _ = m["input"].(string)
+			}
+			fmt.Fprintf(&b, "tool call %s: %s\n\n", name, args)
+		default:
+			role, _ := m["role"].(string)
+			if text := messageText(m["content"]); role != "" && text != "" {
+				fmt.Fprintf(&b, "%s: %s\n\n", role, text)
+			}
+		}
+	}
+	return b.String()
+}
+
+// compactContext applies the context policy to a Codex request body, using
+// side requests to url for summaries, and logs any compaction. Requests that
+// cannot be compacted are forwarded as they are.
+func (s *Server) compactContext(r *http.Request, url string, body map[string]interface{}) {
+	summarize := func(items []interface{}) (string, error) {
+		return s.summarizeTranscript(r, url, renderTranscript(items, s.contextPolicy.toolOutputMaxChars))
+	}
+	c, err := s.contextPolicy.compact(body, summarize)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to summarize earlier turns for context compaction")
+	}
+	if c != nil {
+		model, _ := body["model"].(string)
+		s.logger.Warn().
+			Str("model", model).
+			Int("context_limit", c.limit).
+			Int("estimated_tokens_before", c.before).
+			Int("estimated_tokens_after", c.after).
+			Strs("steps", c.steps).
+			Msg("Compacted request to fit the context window")
+	}
+}
+
+// summarizeTranscript asks the summary model to summarize transcript. The
+// request runs in a session of its own so it does not share the client
+// turn's session_id, turn id or prompt cache routing.
+func (s *Server) summarizeTranscript(r *http.Request, url, transcript string) (string, error) {
+	r = r.WithContext(withUpstreamSession(r.Context(), newUpstreamSession()))
+	model := normalizeModel(s.contextPolicy.summaryModel)
+	body := map[string]interface{}{
+		"model":        model,
+		"instructions": codexInstructionsPrefix(),
+		"store":        false,
+		"stream":       true,
+		"input": []interface{}{
+			map[string]interface{}{
+				"type":    "message",
+				"role":    "developer",
+				"content": []interface{}{map[string]interface{}{"type": "input_text", "text": contextSummaryPrompt}},
+			},
+			map[string]interface{}{
+				"type":    "message",
+				"role":    "user",
+				"content": []interface{}{map[string]interface{}{"type": "input_text", "text": transcript}},
+			},
+		},
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	resp, statusCode, err := s.makeChatGPTRequestWithRetry(r, url, payload, model)
+	if err != nil {
+		return "", fmt.Errorf("summary request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if statusCode != http.StatusOK {
+		return "", fmt.Errorf("summary request failed with status %d", statusCode)
+	}
+	completion, err := bufferChatCompletionFromSSE(resp.Body, model, chatStreamOptions{})
+	if err != nil {
+		return "", fmt.Errorf("summary request failed: %w", err)
+	}
+	if len(completion.Choices) == 0 || strings.TrimSpace(completion.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("summary request returned no text")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func toolHistory(outputs ...string) []interface{} {
+	input := []interface{}{
+		map[string]interface{}{"type": "message", "role": "developer", "content": []interface{}{map[string]interface{}{"type": "input_text", "text": "dev"}}},
+		map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{map[string]interface{}{"type": "input_text", "text": "list the repo"}}},
+	}
+	for i, output := range outputs {
+		callID := fmt.Sprintf("call_%d", i)
+		input = append(input,
+			map[string]interface{}{"type": "function_call", "call_id": callID, "name": "shell", "arguments": `{"cmd":"ls"}`},
+			map[string]interface{}{"type": "function_call_output", "call_id": callID, "output": output},
+		)
+	}
+	return append(input, map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{map[string]interface{}{"type": "input_text", "text": "now fix it"}}})
+}
+
+func toolOutput(input []interface{}, i int) string {
+	n := 0
+	for _, item := range input {
+		if m := item.(map[string]interface{}); m["type"] == "function_call_output" {
+			if n == i {
+				return m["output"].(string)
+			}
+			n++
+		}
+	}
+	return ""
+}
+
+func TestContextPolicyTruncatesOldestToolOutputsFirst(t *testing.T) {
+	p := contextPolicy{
+		steps:              []string{contextStepTruncate, contextStepDrop},
+		threshold:          1,
+		toolOutputMaxChars: 100,
+		limits:             map[string]int{"gpt-5": 1500},
+	}
+	big := strings.Repeat("x", 4000)
+	body := map[string]interface{}{"model": "gpt-5", "input": toolHistory(big, big)}
+
+	c, err := p.compact(body, nil)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	assert.Equal(t, []string{contextStepTruncate}, c.steps)
+	assert.LessOrEqual(t, c.after, 1500)
+	assert.Less(t, c.after, c.before)
+
+	input := body["input"].([]interface{})
+	assert.Contains(t, toolOutput(input, 0), "characters truncated")
+	assert.Equal(t, big, toolOutput(input, 1), "newer outputs are kept while the request fits")
+}
+
+func TestContextPolicyDropsToolOutputs(t *testing.T) {
+	p := contextPolicy{
+		steps:              []string{contextStepTruncate, contextStepDrop},
+		threshold:          1,
+		toolOutputMaxChars: 2000,
+		limits:             map[string]int{"gpt-5": 300},
+	}
+	body := map[string]interface{}{"model": "gpt-5", "input": toolHistory(strings.Repeat("a", 4000), strings.Repeat("b", 4000))}
+
+	c, err := p.compact(body, nil)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	assert.Equal(t, []string{contextStepTruncate, contextStepDrop}, c.steps)
+	input := body["input"].([]interface{})
+	assert.Equal(t, droppedToolOutputPlaceholder, toolOutput(input, 0))
+	assert.Equal(t, droppedToolOutputPlaceholder, toolOutput(input, 1))
+	assert.Equal(t, countRequestTokens(nil, body), c.after, "the running total matches a full recount")
+}
+
+func TestContextPolicyUnderBudget(t *testing.T) {
+	p := contextPolicy{steps: []string{contextStepDrop}, threshold: 0.9, limits: map[string]int{}}
+	body := map[string]interface{}{"model": modelGPT5, "input": toolHistory("small")}
+
+	c, err := p.compact(body, nil)
+	require.NoError(t, err)
+	assert.Nil(t, c)
+	assert.Equal(t, "small", toolOutput(body["input"].([]interface{}), 0))
+}
+
+func TestSummarizeEarlierTurns(t *testing.T) {
+	input := toolHistory("file list")
+	var transcript string
+	out, err := summarizeEarlierTurns(input, func(items []interface{}) (string, error) {
+		transcript = renderTranscript(items, 100)
+		return "The user asked to list the repo.", nil
+	})
+	require.NoError(t, err)
+	require.Len(t, out, 3)
+
+	assert.Contains(t, transcript, "user: list the repo")
+	assert.Contains(t, transcript, `tool call shell: {"cmd":"ls"}`)
+	assert.Contains(t, transcript, "tool result: file list")
+
+	assert.Equal(t, input[0], out[0], "leading developer messages are kept")
+	assert.Contains(t, messageText(out[1].(map[string]interface{})["content"]), "The user asked to list the repo.")
+	assert.Equal(t, "now fix it", messageText(out[2].(map[string]interface{})["content"]))
+
+	out, err = summarizeEarlierTurns(input[:2], nil)
+	require.NoError(t, err)
+	assert.Nil(t, out, "nothing precedes the only user message")
+}
+
+func TestChatCompletionsSummarizesWhenOverContextLimit(t *testing.T) {
+	t.Setenv("CONTEXT_POLICY", "summarize")
+	t.Setenv("CONTEXT_LIMITS", normalizeModel("gpt-5")+"=200")
+
+	var summaryModel, mainCacheKey string
+	var mainInput []interface{}
+	var sessionIDs, turnMetadata []string
+	s := newTestServer(&fakeUpstream{respond: func(call int, req *http.Request) (int, string) {
+		var body map[string]interface{}
+		b, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(b, &body)
+		sessionIDs = append(sessionIDs, req.Header.Get("session_id"))
+		turnMetadata = append(turnMetadata, req.Header.Get("x-codex-turn-metadata"))
+		if call == 0 {
+			summaryModel, _ = body["model"].(string)
+			assert.Nil(t, body["prompt_cache_key"])
+			return http.StatusOK, textSSE("They discussed the build.", 1, 1)
+		}
+		mainInput, _ = body["input"].([]interface{})
+		mainCacheKey, _ = body["prompt_cache_key"].(string)
+		return http.StatusOK, textSSE("ok", 1, 1)
+	}})
+
+	long := strings.Repeat("earlier context ", 100)
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"model": "gpt-5",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": long},
+			map[string]interface{}{"role": "assistant", "content": long},
+			map[string]interface{}{"role": "user", "content": "what next?"},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(string(reqBody)))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, normalizeModel(defaultContextSummaryModel), summaryModel)
+	require.Len(t, sessionIDs, 2)
+	assert.Equal(t, mainCacheKey, sessionIDs[1])
+	assert.NotEqual(t, sessionIDs[1], sessionIDs[0], "the summary request must not reuse the client session")
+	assert.NotEqual(t, turnMetadata[1], turnMetadata[0])
+	require.NotEmpty(t, mainInput)
+	var texts []string
+	for _, item := range mainInput {
+		texts = append(texts, messageText(item.(map[string]interface{})["content"]))
+	}
+	joined := strings.Join(texts, "\n")
+	assert.Contains(t, joined, "They discussed the build.")
+	assert.Contains(t, joined, "what next?")
+	assert.NotContains(t, joined, long)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Instruction profiles control how chat completions and Anthropic messages
+// requests are framed for Codex: the base instructions, the developer
+// messages injected before the conversation, and whether the client's system
+// prompt is kept. They are configured with INSTRUCTION_PROFILES (JSON) or
+// INSTRUCTION_PROFILES_FILE:
+//
+//	{
+//	  "profiles": {
+//	    "zed":  {"developer_message_files": ["prompts/zed.md"], "keep_system_prompt": false},
+//	    "bare": {"developer_messages": []}
+//	  },
+//	  "default": "zed",
+//	  "models":  {"gpt-5-zed": "zed"},
+//	  "keys":    {"sk-team-a": "bare"},
+//	  "clients": {"Zed/": "zed"},
+//	  "routes":  {"/v1/messages": "bare"}
+//	}
+//
+// Omitted profile fields keep the built-in framing. Relative file paths are
+// resolved against the config file's directory; "builtin:<name>" selects a
+// prompt compiled into the proxy (see builtinPrompts). A request uses the
+// profile named by its X-Instruction-Profile header, else the one fixed by its
+// model alias, else the one mapped to its API key, requested model, User-Agent
+// or route, in that order.
+
+const (
+	instructionProfileHeader  = "X-Instruction-Profile"
+	instructionProfileDefault = "default"
+	builtinPromptPrefix       = "builtin:"
+)
+
+// instructionProfile is the framing applied by buildCodexRequestBody.
+type instructionProfile struct {
+	name              string
+	instructions      string
+	developerMessages []string
+	keepSystemPrompt  bool
+}
+
+// builtinPrompts are the prompts selectable as "builtin:<name>".
+func builtinPrompts() map[string]string {
+	return map[string]string{
+		"codex":                codexInstructionsPrefix(),
+		"codex-tool-override":  inversePrompt,
+		"claude-code":          claudeCodeSystemPrompt,
+		"claude-code-identity": claudeCodeIdentityPrompt,
+	}
+}
+
+// defaultInstructionProfile is the Codex CLI instructions plus the tool
+// override developer message, keeping the client's system prompt.
+func defaultInstructionProfile() *instructionProfile {
+	return &instructionProfile{
+		name:              instructionProfileDefault,
+		instructions:      codexInstructionsPrefix(),
+		developerMessages: []string{inversePrompt},
+		keepSystemPrompt:  true,
+	}
+}
+
+// instructionProfileSpec is the JSON form of an instructionProfile.
+type instructionProfileSpec struct {
+	Instructions          *string   `json:"instructions,omitempty"`
+	InstructionsFile      string    `json:"instructions_file,omitempty"`
+	DeveloperMessages     *[]string `json:"developer_messages,omitempty"`
+	DeveloperMessageFiles []string  `json:"developer_message_files,omitempty"`
+	KeepSystemPrompt      *bool     `json:"keep_system_prompt,omitempty"`
+}
+
+// readPrompt loads a prompt file, or a built-in prompt for "builtin:<name>".
+func readPrompt(path, baseDir string) (string, error) {
+	if name, ok := strings.CutPrefix(path, builtinPromptPrefix); ok {
+		text, ok := builtinPrompts()[name]
+		if !ok {
+			return "", fmt.Errorf("unknown built-in prompt %q", name)
+		}
+		return text, nil
+	}
+	if baseDir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (spec instructionProfileSpec) compile(name, baseDir string) (*instructionProfile, error) {
+	p := defaultInstructionProfile()
+	p.name = name
+	switch {
+	case spec.Instructions != nil && spec.InstructionsFile != "":
+		return nil, fmt.Errorf("set either instructions or instructions_file, not both")
+	case spec.Instructions != nil:
+		p.instructions = *spec.Instructions
+	case spec.InstructionsFile != "":
+		text, err := readPrompt(spec.InstructionsFile, baseDir)
+		if err != nil {
+			return nil, err
+		}
+		p.instructions = text
+	}
+	if spec.DeveloperMessages != nil || spec.DeveloperMessageFiles != nil {
+		p.developerMessages = nil
+		if spec.DeveloperMessages != nil {
+			p.developerMessages = append(p.developerMessages, *spec.DeveloperMessages...)
+		}
+		for _, path := range spec.DeveloperMessageFiles {
+			text, err := readPrompt(path, baseDir)
+			if err != nil {
+				return nil, err
+			}
+			p.developerMessages = append(p.developerMessages, text)
+		}
+	}
+	if spec.KeepSystemPrompt != nil {
+		p.keepSystemPrompt = *spec.KeepSystemPrompt
+	}
+	return p, nil
+}
+
+// instructionProfiles holds the configured profiles and how requests select
+// them.
+type instructionProfiles struct {
+	defaults *instructionProfile
+	profiles map[string]*instructionProfile
+	keys     map[string]string
+	models   map[string]string
+	clients  userAgentProfiles
+	routes   map[string]string
+}
+
+func defaultInstructionProfiles() *instructionProfiles {
+	return &instructionProfiles{defaults: defaultInstructionProfile()}
+}
+
+// parseInstructionProfiles parses an INSTRUCTION_PROFILES config. baseDir
+// resolves relative prompt file paths.
+func parseInstructionProfiles(raw, baseDir string) (*instructionProfiles, error) {
+	if strings.TrimSpace(raw) == "" {
+		return defaultInstructionProfiles(), nil
+	}
+	var spec struct {
+		Profiles map[string]instructionProfileSpec `json:"profiles"`
+		Default  string                            `json:"default"`
+		Keys     map[string]string                 `json:"keys"`
+		Models   map[string]string                 `json:"models"`
+		Clients  map[string]string                 `json:"clients"`
+		Routes   map[string]string                 `json:"routes"`
+	}
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return nil, fmt.Errorf("invalid instruction profiles config: %w", err)
+	}
+
+	cfg := defaultInstructionProfiles()
+	cfg.profiles = make(map[string]*instructionProfile, len(spec.Profiles))
+	for name, ps := range spec.Profiles {
+		p, err := ps.compile(name, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("instruction profile %q: %w", name, err)
+		}
+		cfg.profiles[name] = p
+	}
+	if spec.Default != "" {
+		p, ok := cfg.profile(spec.Default)
+		if !ok {
+			return nil, fmt.Errorf("instruction profiles: unknown default profile %q", spec.Default)
+		}
+		cfg.defaults = p
+	}
+	for field, mapping := range map[string]map[string]string{
+		"keys": spec.Keys, "models": spec.Models, "clients": spec.Clients, "routes": spec.Routes,
+	} {
+		for k, name := range mapping {
+			if _, ok := cfg.profile(name); !ok {
+				return nil, fmt.Errorf("instruction profiles %s %q: unknown profile %q", field, k, name)
+			}
+		}
+	}
+	cfg.keys = spec.Keys
+	cfg.models = spec.Models
+	cfg.clients = newUserAgentProfiles(spec.Clients)
+	cfg.routes = spec.Routes
+	return cfg, nil
+}
+
+// newInstructionProfilesFromEnv loads INSTRUCTION_PROFILES, or the file named
+// by INSTRUCTION_PROFILES_FILE.
+func newInstructionProfilesFromEnv() (*instructionProfiles, error) {
+	if raw, ok := env.Get("INSTRUCTION_PROFILES"); ok {
+		return parseInstructionProfiles(raw, "")
+	}
+	path, ok := env.Get("INSTRUCTION_PROFILES_FILE")
+	if !ok {
+		return defaultInstructionProfiles(), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read INSTRUCTION_PROFILES_FILE: %w", err)
+	}
+	return parseInstructionProfiles(string(b), filepath.Dir(path))
+}
+
+func (c *instructionProfiles) profile(name string) (*instructionProfile, bool) {
+	name = strings.TrimSpace(name)
+	if p, ok := c.profiles[name]; ok {
+		return p, true
+	}
+	if name == instructionProfileDefault {
+		return defaultInstructionProfile(), true
+	}
+	return nil, false
+}
+
+// forRequest returns the profile for r; model is the model the client asked
+// for, before normalization.
+func (c *instructionProfiles) forRequest(r *http.Request, model string) *instructionProfile {
+	if c == nil {
+		return defaultInstructionProfile()
+	}
+	if name := r.Header.Get(instructionProfileHeader); name != "" {
+		if p, ok := c.profile(name); ok {
+			return p
+		}
+	}
+	if alias, ok := lookupModelAlias(model); ok && alias.InstructionProfile != "" {
+		if p, ok := c.profile(alias.InstructionProfile); ok {
+			return p
+		}
+	}
+	lookups := []struct {
+		mapping map[string]string
+		key     string
+	}{
+		{c.keys, requestAPIKey(r)},
+		{c.models, strings.TrimSpace(model)},
+	}
+	for _, l := range lookups {
+		if name, ok := l.mapping[l.key]; ok && l.key != "" {
+			p, _ := c.profile(name)
+			return p
+		}
+	}
+	if name, ok := c.clients.match(r.UserAgent()); ok {
+		p, _ := c.profile(name)
+		return p
+	}
+	if name, ok := c.routes[r.URL.Path]; ok {
+		p, _ := c.profile(name)
+		return p
+	}
+	return c.defaults
+}
+
+// withoutSystemMessages returns a shallow copy of a chat request with its
+// system messages removed.
+func withoutSystemMessages(requestData map[string]interface{}) map[string]interface{} {
+	msgs, ok := requestData["messages"].([]interface{})
+	if !ok {
+		return requestData
+	}
+	out := make(map[string]interface{}, len(requestData))
+	for k, v := range requestData {
+		out[k] = v
+	}
+	kept := make([]interface{}, 0, len(msgs))
+	for _, m := range msgs {
+		if mm, ok := m.(map[string]interface{}); ok {
+			if role, _ := mm["role"].(string); role == "system" {
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	out["messages"] = kept
+	return out
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstructionProfilesFromFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zed.md"), []byte("You are pairing inside an editor.\n"), 0o600))
+	config := `{
+		"profiles": {
+			"zed": {
+				"developer_message_files": ["zed.md", "builtin:codex-tool-override"],
+				"keep_system_prompt": false
+			}
+		},
+		"models": {"gpt-5-zed": "zed"}
+	}`
+	path := filepath.Join(dir, "profiles.json")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+	t.Setenv("INSTRUCTION_PROFILES_FILE", path)
+
+	cfg, err := newInstructionProfilesFromEnv()
+	require.NoError(t, err)
+	profile := cfg.forRequest(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), "gpt-5-zed")
+	require.Equal(t, "zed", profile.name)
+
+	body := buildCodexRequestBody(map[string]interface{}{
+		"model": "gpt-5",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "system", "content": "You are a chatbot."},
+			map[string]interface{}{"role": "user", "content": "hi"},
+		},
+	}, nil, profile)
+
+	assert.Equal(t, codexInstructionsPrefix(), body["instructions"])
+	input := body["input"].([]interface{})
+	text := func(i int) string {
+		return input[i].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["text"].(string)
+	}
+	require.Len(t, input, 4)
+	assert.Equal(t, "You are pairing inside an editor.", text(0))
+	assert.Equal(t, inversePrompt, text(1))
+	assert.Empty(t, text(2), "client system prompt should be dropped")
+	assert.Equal(t, "hi", text(3))
+}
+
+func TestInstructionProfilesSelection(t *testing.T) {
+	cfg, err := parseInstructionProfiles(`{
+		"profiles": {
+			"header": {"developer_messages": []},
+			"key": {"developer_messages": []},
+			"model": {"developer_messages": []},
+			"client": {"developer_messages": []},
+			"route": {"instructions": "custom"}
+		},
+		"keys": {"sk-a": "key"},
+		"models": {"gpt-5-x": "model"},
+		"clients": {"Zed/": "client"},
+		"routes": {"/v1/messages": "route"}
+	}`, "")
+	require.NoError(t, err)
+
+	selected := func(path, model string, headers map[string]string) string {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return cfg.forRequest(r, model).name
+	}
+	all := map[string]string{instructionProfileHeader: "header", "X-API-Key": "sk-a", "User-Agent": "Zed/1.0"}
+	assert.Equal(t, "header", selected("/v1/messages", "gpt-5-x", all))
+	delete(all, instructionProfileHeader)
+	assert.Equal(t, "key", selected("/v1/messages", "gpt-5-x", all))
+	delete(all, "X-API-Key")
+	assert.Equal(t, "model", selected("/v1/messages", "gpt-5-x", all))
+	assert.Equal(t, "client", selected("/v1/messages", "gpt-5", all))
+	assert.Equal(t, "route", selected("/v1/messages", "gpt-5", nil))
+	assert.Equal(t, instructionProfileDefault, selected("/v1/chat/completions", "gpt-5", map[string]string{instructionProfileHeader: "missing"}))
+}
+
+func TestParseInstructionProfilesErrors(t *testing.T) {
+	_, err := parseInstructionProfiles(`{"keys": {"sk-a": "missing"}}`, "")
+	assert.Error(t, err)
+	_, err = parseInstructionProfiles(`{"profiles": {"p": {"instructions_file": "builtin:nope"}}}`, "")
+	assert.Error(t, err)
+	_, err = parseInstructionProfiles(`{"default": "missing"}`, "")
+	assert.Error(t, err)
+}
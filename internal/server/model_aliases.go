@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Model aliases publish virtual model names that stand for a backend model
+// with fixed settings. They are configured with MODEL_ALIASES, or
+// MODEL_ALIASES_FILE pointing at a JSON file:
+//
+//	{
+//	  "team-fast":   {"model": "gpt-5.1-codex-mini", "effort": "medium", "verbosity": "low"},
+//	  "review-deep": {"model": "gpt-5.5", "effort": "xhigh", "summary": "detailed",
+//	                  "instruction_profile": "review", "tools": [{"type": "web_search"}]}
+//	}
+//
+// normalizeModel resolves an alias before any suffix rule, the alias effort
+// and summary replace the client's, and "tools" (in Responses format) are
+// used when the client sends none. Aliases are listed by /v1/models.
+
+// modelAlias is one virtual model.
+type modelAlias struct {
+	Model              string        `json:"model"`
+	Name               string        `json:"name"`
+	Effort             string        `json:"effort"`
+	Summary            string        `json:"summary"`
+	Verbosity          string        `json:"verbosity"`
+	InstructionProfile string        `json:"instruction_profile"`
+	Tools              []interface{} `json:"tools"`
+}
+
+// parseModelAliases parses and validates an alias table.
+func parseModelAliases(raw string) (map[string]modelAlias, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var parsed map[string]modelAlias
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_ALIASES: %w", err)
+	}
+	aliases := make(map[string]modelAlias, len(parsed))
+	for name, alias := range parsed {
+		name = strings.ToLower(strings.TrimSpace(name))
+		alias.Model = strings.TrimSpace(alias.Model)
+		if name == "" || alias.Model == "" {
+			return nil, fmt.Errorf("model alias %q needs a name and a model", name)
+		}
+		if alias.Effort != "" {
+			if alias.Effort = normalizeReasoningEffort(alias.Effort); alias.Effort == "" {
+				return nil, fmt.Errorf("model alias %q has an unknown effort", name)
+			}
+		}
+		switch alias.Summary {
+		case "", "auto", "concise", "detailed", "none":
+		default:
+			return nil, fmt.Errorf("model alias %q has an unknown summary %q", name, alias.Summary)
+		}
+		switch alias.Verbosity {
+		case "", "low", "medium", "high":
+		default:
+			return nil, fmt.Errorf("model alias %q has an unknown verbosity %q", name, alias.Verbosity)
+		}
+		aliases[name] = alias
+	}
+	for name, alias := range aliases {
+		if _, ok := aliases[strings.ToLower(alias.Model)]; ok {
+			return nil, fmt.Errorf("model alias %q points at another alias", name)
+		}
+	}
+	return aliases, nil
+}
+
+// modelAliasesFromEnv loads MODEL_ALIASES, or the file named by
+// MODEL_ALIASES_FILE.
+func modelAliasesFromEnv() (map[string]modelAlias, error) {
+	raw := env.GetOrDefault("MODEL_ALIASES", "")
+	if path, ok := env.Get("MODEL_ALIASES_FILE"); ok && raw == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MODEL_ALIASES_FILE: %w", err)
+		}
+		raw = string(b)
+	}
+	return parseModelAliases(raw)
+}
+
+// lookupModelAlias returns the alias named by model, if any.
+func lookupModelAlias(model string) (modelAlias, bool) {
+	aliases := currentModels().aliases
+	if len(aliases) == 0 {
+		return modelAlias{}, false
+	}
+	alias, ok := aliases[strings.ToLower(strings.TrimSpace(model))]
+	return alias, ok
+}
+
+// applyModelAlias applies the fixed settings of the alias named by
+// requestedModel to a Codex request body.
+func applyModelAlias(body map[string]interface{}, requestedModel string) {
+	alias, ok := lookupModelAlias(requestedModel)
+	if !ok {
+		return
+	}
+	if alias.Summary != "" {
+		reasoning, _ := body["reasoning"].(map[string]interface{})
+		if reasoning == nil {
+			reasoning = map[string]interface{}{}
+		}
+		if alias.Summary == "none" {
+			delete(reasoning, "summary")
+		} else {
+			reasoning["summary"] = alias.Summary
+		}
+		body["reasoning"] = reasoning
+	}
+	if alias.Verbosity != "" {
+		text, _ := body["text"].(map[string]interface{})
+		if text == nil {
+			text = map[string]interface{}{}
+		}
+		text["verbosity"] = alias.Verbosity
+		body["text"] = text
+	}
+	if tools, _ := body["tools"].([]interface{}); len(tools) == 0 && len(alias.Tools) > 0 {
+		body["tools"] = append([]interface{}(nil), alias.Tools...)
+	}
+}
+
+// aliasModels returns /v1/models entries for the aliases, described by their
+// backend model.
+func aliasModels(t *modelTable) []modelMetadata {
+	names := make([]string, 0, len(t.aliases))
+	for name := range t.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	models := make([]modelMetadata, 0, len(names))
+	for _, name := range names {
+		alias := t.aliases[name]
+		meta, ok := t.metadata[normalizeModel(alias.Model)]
+		if !ok {
+			meta = newModelMetadata(name, name)
+		}
+		meta.ID = name
+		meta.Name = alias.Name
+		if meta.Name == "" {
+			meta.Name = name
+		}
+		models = append(models, meta)
+	}
+	return models
+}
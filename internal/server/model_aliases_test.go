@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withModelAliases(t *testing.T, raw string) {
+	t.Helper()
+	t.Cleanup(func() { activeModels.Store(nil) })
+	t.Setenv("MODEL_CATALOG", "off")
+	t.Setenv("MODEL_ALIASES", raw)
+	_, err := newModelCatalogFromEnv()
+	require.NoError(t, err)
+}
+
+const testModelAliases = `{
+	"team-fast":   {"model": "gpt-5.1-codex-mini", "name": "Team Fast", "effort": "medium", "verbosity": "low"},
+	"review-high": {"model": "gpt-5.5", "effort": "xhigh", "summary": "detailed",
+	                "instruction_profile": "review", "tools": [{"type": "web_search"}]}
+}`
+
+func TestModelAliasesResolveBeforeSuffixRules(t *testing.T) {
+	withModelAliases(t, testModelAliases)
+
+	assert.Equal(t, modelGPT51CodexMini, normalizeModel("team-fast"))
+	assert.Equal(t, modelGPT55, normalizeModel("Review-High"), "alias names are not treated as effort suffixes")
+	assert.Equal(t, "xhigh", resolveReasoningEffort(map[string]interface{}{"model": "review-high", "reasoning_effort": "low"}))
+	assert.Equal(t, "high", resolveReasoningEffort(map[string]interface{}{"model": "gpt-5-high"}))
+
+	listed := map[string]modelMetadata{}
+	for _, m := range supportedModels() {
+		listed[m.ID] = m
+	}
+	require.Contains(t, listed, "team-fast")
+	assert.Equal(t, "Team Fast", listed["team-fast"].Name)
+	assert.Contains(t, listed, "review-high")
+	assert.NotContains(t, listed, "team-fast-high")
+}
+
+func TestModelAliasesShapeCodexRequests(t *testing.T) {
+	withModelAliases(t, testModelAliases)
+
+	body := buildCodexRequestBody(map[string]interface{}{
+		"model":            "team-fast",
+		"reasoning_effort": "high",
+		"messages":         []interface{}{map[string]interface{}{"role": "user", "content": "hi"}},
+	}, nil, nil)
+	assert.Equal(t, modelGPT51CodexMini, body["model"])
+	assert.Equal(t, "medium", body["reasoning"].(map[string]interface{})["effort"])
+	assert.Equal(t, "low", body["text"].(map[string]interface{})["verbosity"])
+
+	responses := map[string]interface{}{
+		"model": "review-high",
+		"input": []interface{}{map[string]interface{}{"role": "user", "content": []interface{}{map[string]interface{}{"type": "input_text", "text": "hi"}}}},
+	}
+	model, effort := transformResponsesRequestBody(responses, "review-high", resolveReasoningEffort(responses), nil)
+	assert.Equal(t, modelGPT55, model)
+	assert.Equal(t, "xhigh", effort)
+	assert.Equal(t, "detailed", responses["reasoning"].(map[string]interface{})["summary"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "web_search"}}, responses["tools"])
+
+	withTools := map[string]interface{}{
+		"model": "review-high",
+		"tools": []interface{}{map[string]interface{}{"type": "function", "name": "f"}},
+	}
+	transformResponsesRequestBody(withTools, "review-high", "", nil)
+	assert.Len(t, withTools["tools"], 1)
+	assert.Equal(t, "function", withTools["tools"].([]interface{})[0].(map[string]interface{})["type"], "client tools are kept")
+}
+
+func TestModelAliasesSelectInstructionProfile(t *testing.T) {
+	withModelAliases(t, testModelAliases)
+	profiles, err := parseInstructionProfiles(`{"profiles": {"review": {"instructions": "Review carefully."}}}`, "")
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	assert.Equal(t, "review", profiles.forRequest(r, "review-high").name)
+	assert.Equal(t, instructionProfileDefault, profiles.forRequest(r, "team-fast").name)
+}
+
+func TestParseModelAliasesErrors(t *testing.T) {
+	for _, raw := range []string{
+		`{"a": {}}`,
+		`{"a": {"model": "gpt-5", "effort": "turbo"}}`,
+		`{"a": {"model": "gpt-5", "verbosity": "loud"}}`,
+		`{"a": {"model": "b"}, "b": {"model": "gpt-5"}}`,
+		`[`,
+	} {
+		_, err := parseModelAliases(raw)
+		assert.Error(t, err, raw)
+	}
+}
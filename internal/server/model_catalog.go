@@ -0,0 +1,430 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// The tables in models.go describe the models known when the proxy was
+// released. Unless MODEL_CATALOG is "off", the proxy also fetches the model
+// list the Codex CLI uses, caches it for MODEL_CATALOG_TTL (default 1h) and
+// merges it over the built-in tables, so models the backend adds show up in
+// /v1/models and are accepted by normalizeModel and effort clamping without a
+// proxy release. When the fetch fails the last good list, or the built-in
+// tables, stay in use.
+//
+// MODEL_OVERRIDES (or MODEL_OVERRIDES_FILE) is applied last:
+//
+//	{
+//	  "gpt-5.6":     {"name": "GPT-5.6", "efforts": ["low", "high"], "default_effort": "high", "context_window": 400000},
+//	  "gpt-5-codex": {"hidden": true}
+//	}
+
+const (
+	// codexClientVersion is the Codex CLI version the proxy presents upstream.
+	codexClientVersion = "0.125.0"
+
+	defaultModelCatalogTTL = time.Hour
+	// modelCatalogRetryDelay bounds how often a failing fetch is retried.
+	modelCatalogRetryDelay = 5 * time.Minute
+	// modelCatalogFetchTimeout bounds a single fetch of the upstream list.
+	modelCatalogFetchTimeout = 30 * time.Second
+)
+
+// modelTable is a snapshot of the models the proxy knows about.
+type modelTable struct {
+	// ids lists the models advertised by /v1/models, in order.
+	ids            []string
+	metadata       map[string]modelMetadata
+	allowedEfforts map[string][]string
+	defaultEffort  map[string]string
+	// aliases maps virtual model names to backend models; see
+	// model_aliases.go.
+	aliases map[string]modelAlias
+}
+
+var builtinModels = &modelTable{
+	ids:            supportedModelIDs,
+	metadata:       modelMetadataByID,
+	allowedEfforts: modelAllowedEfforts,
+	defaultEffort:  modelDefaultEffort,
+}
+
+// activeModels is the table used by normalization, effort clamping and
+// /v1/models; nil means builtinModels.
+var activeModels atomic.Pointer[modelTable]
+
+func currentModels() *modelTable {
+	if t := activeModels.Load(); t != nil {
+		return t
+	}
+	return builtinModels
+}
+
+func (t *modelTable) clone() *modelTable {
+	c := &modelTable{
+		ids:            append([]string(nil), t.ids...),
+		metadata:       make(map[string]modelMetadata, len(t.metadata)),
+		allowedEfforts: make(map[string][]string, len(t.allowedEfforts)),
+		defaultEffort:  make(map[string]string, len(t.defaultEffort)),
+		aliases:        t.aliases,
+	}
+	for k, v := range t.metadata {
+		c.metadata[k] = v
+	}
+	for k, v := range t.allowedEfforts {
+		c.allowedEfforts[k] = v
+	}
+	for k, v := range t.defaultEffort {
+		c.defaultEffort[k] = v
+	}
+	return c
+}
+
+// modelOverride adjusts or adds one model. Unset fields keep their value.
+type modelOverride struct {
+	Name          string   `json:"name"`
+	Efforts       []string `json:"efforts"`
+	DefaultEffort string   `json:"default_effort"`
+	ContextWindow int      `json:"context_window"`
+	Vision        *bool    `json:"vision"`
+	Hidden        *bool    `json:"hidden"`
+}
+
+// apply merges o into t for model id, adding the model when t lacks it.
+func (o modelOverride) apply(t *modelTable, id string) {
+	meta, ok := t.metadata[id]
+	if !ok {
+		meta = newModelMetadata(id, id)
+		t.ids = append(t.ids, id)
+	}
+	if o.Name != "" {
+		meta.Name = o.Name
+	}
+	if o.ContextWindow > 0 {
+		meta = withLimit(meta, "max_context_window_tokens", o.ContextWindow)
+	}
+	if o.Vision != nil {
+		meta = withSupport(meta, "vision", *o.Vision)
+	}
+	t.metadata[id] = meta
+	if len(o.Efforts) > 0 {
+		t.allowedEfforts[id] = o.Efforts
+	}
+	if o.DefaultEffort != "" {
+		t.defaultEffort[id] = o.DefaultEffort
+	}
+	if o.Hidden != nil {
+		t.ids = removeString(t.ids, id)
+		if !*o.Hidden {
+			t.ids = append(t.ids, id)
+		}
+	}
+}
+
+// newModelMetadata describes a model the built-in table does not know.
+func newModelMetadata(id, name string) modelMetadata {
+	return modelMetadata{
+		Capabilities: map[string]interface{}{
+			"family":    id,
+			"limits":    map[string]interface{}{},
+			"object":    "model_capabilities",
+			"supports":  map[string]interface{}{"parallel_tool_calls": true, "streaming": true, "structured_outputs": true, "tool_calls": true, "vision": true},
+			"tokenizer": "o200k_base",
+			"type":      "chat",
+		},
+		ID:                  id,
+		ModelPickerCategory: "powerful",
+		ModelPickerEnabled:  true,
+		Name:                name,
+		Object:              "model",
+		SupportedEndpoints:  []string{"/responses"},
+		Vendor:              "OpenAI",
+		Version:             id,
+	}
+}
+
+// withLimit returns meta with capabilities.limits[key] set, without mutating
+// the maps meta shares with other tables.
+func withLimit(meta modelMetadata, key string, value int) modelMetadata {
+	meta.Capabilities = copyMap(meta.Capabilities)
+	limits, _ := meta.Capabilities["limits"].(map[string]interface{})
+	limits = copyMap(limits)
+	limits[key] = value
+	meta.Capabilities["limits"] = limits
+	return meta
+}
+
+// withSupport returns meta with capabilities.supports[key] set.
+func withSupport(meta modelMetadata, key string, value bool) modelMetadata {
+	meta.Capabilities = copyMap(meta.Capabilities)
+	supports, _ := meta.Capabilities["supports"].(map[string]interface{})
+	supports = copyMap(supports)
+	supports[key] = value
+	meta.Capabilities["supports"] = supports
+	return meta
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// upstreamModel is one entry of the Codex models endpoint.
+type upstreamModel struct {
+	Slug                     string `json:"slug"`
+	DisplayName              string `json:"display_name"`
+	DefaultReasoningLevel    string `json:"default_reasoning_level"`
+	SupportedReasoningLevels []struct {
+		Effort string `json:"effort"`
+	} `json:"supported_reasoning_levels"`
+	Visibility      string   `json:"visibility"`
+	ContextWindow   int      `json:"context_window"`
+	InputModalities []string `json:"input_modalities"`
+}
+
+// mergeUpstreamModels returns base updated with the fetched models. Models
+// the backend hides stay resolvable but are not advertised.
+func mergeUpstreamModels(base *modelTable, models []upstreamModel) *modelTable {
+	t := base.clone()
+	for _, m := range models {
+		id := strings.ToLower(strings.TrimSpace(m.Slug))
+		if id == "" {
+			continue
+		}
+		meta, known := t.metadata[id]
+		if !known {
+			name := m.DisplayName
+			if name == "" {
+				name = id
+			}
+			meta = newModelMetadata(id, name)
+			if m.Visibility == "" || m.Visibility == "list" {
+				t.ids = append(t.ids, id)
+			}
+		}
+		if m.ContextWindow > 0 {
+			meta = withLimit(meta, "max_context_window_tokens", m.ContextWindow)
+		}
+		if len(m.InputModalities) > 0 {
+			vision := false
+			for _, modality := range m.InputModalities {
+				vision = vision || modality == "image"
+			}
+			meta = withSupport(meta, "vision", vision)
+		}
+		t.metadata[id] = meta
+
+		var efforts []string
+		for _, level := range m.SupportedReasoningLevels {
+			if effort := normalizeReasoningEffort(level.Effort); effort != "" && !containsString(efforts, effort) {
+				efforts = append(efforts, effort)
+			}
+		}
+		if len(efforts) > 0 {
+			t.allowedEfforts[id] = efforts
+		}
+		if effort := normalizeReasoningEffort(m.DefaultReasoningLevel); effort != "" {
+			t.defaultEffort[id] = effort
+		}
+	}
+	return t
+}
+
+// modelCatalog keeps activeModels in sync with the Codex backend. A nil
+// catalog leaves the built-in tables in place.
+type modelCatalog struct {
+	fetch     bool
+	ttl       time.Duration
+	overrides map[string]modelOverride
+	aliases   map[string]modelAlias
+
+	mu        sync.Mutex
+	nextFetch time.Time
+	fetching  bool
+}
+
+// newModelCatalogFromEnv reads MODEL_CATALOG, MODEL_CATALOG_TTL,
+// MODEL_OVERRIDES / MODEL_OVERRIDES_FILE and MODEL_ALIASES /
+// MODEL_ALIASES_FILE, and activates the built-in tables with the overrides
+// and aliases. Invalid overrides or aliases are reported and left out.
+func newModelCatalogFromEnv() (*modelCatalog, error) {
+	c := &modelCatalog{fetch: true, ttl: defaultModelCatalogTTL}
+	switch strings.ToLower(strings.TrimSpace(env.GetOrDefault("MODEL_CATALOG", ""))) {
+	case "off", "none", "false", "0":
+		c.fetch = false
+	}
+	if v, ok := env.Get("MODEL_CATALOG_TTL"); ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && d > 0 {
+			c.ttl = d
+		}
+	}
+
+	overrides, overridesErr := modelOverridesFromEnv()
+	if overridesErr == nil {
+		c.overrides = overrides
+	}
+	aliases, aliasesErr := modelAliasesFromEnv()
+	if aliasesErr == nil {
+		c.aliases = aliases
+	}
+	c.publish(nil)
+	return c, errors.Join(overridesErr, aliasesErr)
+}
+
+func modelOverridesFromEnv() (map[string]modelOverride, error) {
+	raw := env.GetOrDefault("MODEL_OVERRIDES", "")
+	if path, ok := env.Get("MODEL_OVERRIDES_FILE"); ok && raw == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MODEL_OVERRIDES_FILE: %w", err)
+		}
+		raw = string(b)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var overrides map[string]modelOverride
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_OVERRIDES: %w", err)
+	}
+	return overrides, nil
+}
+
+// publish makes base (or the built-in tables) plus the overrides and aliases
+// active.
+func (c *modelCatalog) publish(base *modelTable) {
+	if base == nil {
+		base = builtinModels
+	}
+	if len(c.overrides) == 0 && len(c.aliases) == 0 {
+		if base == builtinModels {
+			activeModels.Store(nil)
+		} else {
+			activeModels.Store(base)
+		}
+		return
+	}
+	t := base.clone()
+	for id, o := range c.overrides {
+		o.apply(t, strings.ToLower(strings.TrimSpace(id)))
+	}
+	t.aliases = c.aliases
+	activeModels.Store(t)
+}
+
+// refreshModelCatalog starts a background fetch of the upstream model list
+// when the cached one has expired. Requests keep using the current tables
+// until the fetch finishes, and only one fetch runs at a time.
+func (s *Server) refreshModelCatalog() {
+	c := s.modelCatalog
+	if c == nil || !c.fetch {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fetching || time.Now().Before(c.nextFetch) {
+		return
+	}
+	c.fetching = true
+	runInBackground(s.updateModelCatalog)
+}
+
+// updateModelCatalog fetches the upstream model list and publishes it. The
+// fetch has its own deadline, so it does not depend on the request that
+// triggered it. Failures are logged and retried after modelCatalogRetryDelay.
+func (s *Server) updateModelCatalog() {
+	c := s.modelCatalog
+	ctx, cancel := context.WithTimeout(context.Background(), modelCatalogFetchTimeout)
+	defer cancel()
+	models, err := s.fetchUpstreamModels(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetching = false
+	if err != nil {
+		delay := modelCatalogRetryDelay
+		if c.ttl < delay {
+			delay = c.ttl
+		}
+		c.nextFetch = time.Now().Add(delay)
+		s.logger.Warn().Err(err).Msg("Failed to fetch Codex model catalog, keeping current models")
+		return
+	}
+	c.nextFetch = time.Now().Add(c.ttl)
+	c.publish(mergeUpstreamModels(builtinModels, models))
+	s.logger.Info().Int("upstream_models", len(models)).Msg("Refreshed Codex model catalog")
+}
+
+// fetchUpstreamModels lists the models available to the current account.
+func (s *Server) fetchUpstreamModels(ctx context.Context) ([]upstreamModel, error) {
+	token, accountID, err := s.credsFetcher.GetCredentials()
+	if err != nil {
+		return nil, &credentialsError{msg: "failed to get credentials", err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.upstream.modelsURL()+"?client_version="+codexClientVersion, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("authorization", "Bearer "+strings.TrimPrefix(strings.TrimSpace(token), "Bearer "))
+	req.Header.Set("chatgpt-account-id", accountID)
+	req.Header.Set("version", codexClientVersion)
+	req.Header.Set("originator", "codex_cli_rs")
+	req.Header.Set("accept", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("models endpoint returned status %d", resp.StatusCode)
+	}
+	var payload struct {
+		Models []upstreamModel `json:"models"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid models response: %w", err)
+	}
+	if len(payload.Models) == 0 {
+		return nil, fmt.Errorf("models endpoint returned no models")
+	}
+	return payload.Models, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const upstreamModelsJSON = `{"models":[
+	{"slug":"gpt-5.5","display_name":"gpt-5.5","default_reasoning_level":"high","supported_reasoning_levels":[{"effort":"medium"},{"effort":"high"}],"visibility":"list","context_window":400000},
+	{"slug":"gpt-5.6","display_name":"GPT-5.6","default_reasoning_level":"medium","supported_reasoning_levels":[{"effort":"low"},{"effort":"medium"},{"effort":"high"}],"visibility":"list","context_window":500000,"input_modalities":["text"]},
+	{"slug":"gpt-5.6-internal","supported_reasoning_levels":[{"effort":"low"}],"visibility":"hide"}
+]}`
+
+func modelIDs() map[string]bool {
+	ids := map[string]bool{}
+	for _, m := range supportedModels() {
+		ids[m.ID] = true
+	}
+	return ids
+}
+
+func TestModelCatalogMergesUpstreamModels(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	var requested string
+	s := newTestServer(&fakeUpstream{respond: func(_ int, req *http.Request) (int, string) {
+		requested = req.Method + " " + req.URL.Path
+		return http.StatusOK, upstreamModelsJSON
+	}})
+	s.modelCatalog = &modelCatalog{fetch: true, ttl: defaultModelCatalogTTL}
+
+	s.updateModelCatalog()
+	assert.Equal(t, "GET /backend-api/codex/models", requested)
+
+	ids := modelIDs()
+	assert.True(t, ids["gpt-5.6"])
+	assert.True(t, ids["gpt-5.6-high"])
+	assert.False(t, ids["gpt-5.6-internal"], "hidden models are not advertised")
+	assert.True(t, ids[modelGPT5Codex], "built-in models stay listed")
+
+	assert.Equal(t, "gpt-5.6", normalizeModel("gpt-5.6-high"))
+	assert.Equal(t, "gpt-5.6-internal", normalizeModel("gpt-5.6-internal"))
+	assert.Equal(t, "medium", clampReasoningEffortForModel("xhigh", "gpt-5.6"))
+	assert.Equal(t, "high", clampReasoningEffortForModel("", modelGPT55))
+	assert.Equal(t, "high", clampReasoningEffortForModel("low", modelGPT55))
+	assert.False(t, modelSupportsVision("gpt-5.6"))
+	assert.Equal(t, 500000, s.contextPolicy.contextLimit("gpt-5.6"))
+	assert.Equal(t, 1050000, modelMetadataByID[modelGPT55].Capabilities["limits"].(map[string]interface{})["max_context_window_tokens"], "built-in table is not mutated")
+
+	// Cached until the TTL expires.
+	requested = ""
+	s.refreshModelCatalog()
+	assert.Empty(t, requested)
+}
+
+func TestModelCatalogFallsBackToBuiltinTables(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusForbidden, `{"detail":"nope"}`
+	}})
+	s.modelCatalog = &modelCatalog{fetch: true, ttl: defaultModelCatalogTTL}
+	builtin := supportedModels()
+
+	s.updateModelCatalog()
+	assert.Equal(t, builtin, supportedModels())
+	assert.Equal(t, modelGPT5, normalizeModel("gpt-5.6"))
+	assert.True(t, s.modelCatalog.nextFetch.After(time.Now()), "failed fetches are retried later, not per request")
+}
+
+func TestModelCatalogRefreshesInBackground(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	t.Setenv("ADMIN_API_KEY", "secret")
+	release := make(chan struct{})
+	upstream := &fakeUpstream{respond: func(_ int, req *http.Request) (int, string) {
+		_, hasDeadline := req.Context().Deadline()
+		assert.True(t, hasDeadline, "background fetches carry their own timeout")
+		<-release
+		return http.StatusOK, upstreamModelsJSON
+	}}
+	s := newTestServer(upstream)
+	s.modelCatalog = &modelCatalog{fetch: true, ttl: defaultModelCatalogTTL}
+	builtin := supportedModels()
+
+	listModels := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		s.modelsHandler(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, listModels("").Code)
+	assert.Equal(t, http.StatusOK, listModels("wrong").Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&upstream.calls), "anonymous model listings do not fetch")
+
+	// The stale table is served while a single fetch is in flight.
+	assert.Equal(t, http.StatusOK, listModels("secret").Code)
+	s.refreshModelCatalog()
+	assert.Equal(t, builtin, supportedModels())
+
+	close(release)
+	assert.Eventually(t, func() bool { return modelIDs()["gpt-5.6"] }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.calls))
+}
+
+func TestModelOverrides(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	t.Setenv("MODEL_CATALOG", "off")
+	t.Setenv("MODEL_OVERRIDES", `{
+		"gpt-5.6": {"name": "GPT-5.6", "efforts": ["low", "high"], "default_effort": "high", "context_window": 400000},
+		"gpt-5-codex": {"hidden": true},
+		"gpt-5.1": {"default_effort": "medium"}
+	}`)
+	_, err := newModelCatalogFromEnv()
+	require.NoError(t, err)
+
+	ids := modelIDs()
+	assert.True(t, ids["gpt-5.6-low"])
+	assert.False(t, ids[modelGPT5Codex])
+	assert.Equal(t, modelGPT5Codex, normalizeModel("gpt-5-codex"), "hidden models still resolve")
+	assert.Equal(t, "high", clampReasoningEffortForModel("medium", "gpt-5.6"))
+	assert.Equal(t, "medium", clampReasoningEffortForModel("", modelGPT51))
+
+	t.Setenv("MODEL_OVERRIDES", `{"gpt-5.6": [`)
+	_, err = newModelCatalogFromEnv()
+	assert.Error(t, err)
+	assert.False(t, modelIDs()["gpt-5.6"], "invalid overrides are dropped")
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid MODEL_OVERRIDES"))
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Model fallback chains retry a request on other models when its model is
+// over its usage limit or out of capacity (HTTP 429 or 503, or a Codex usage
+// or rate limit error, including one that opens the event stream). They are
+// configured with MODEL_FALLBACKS, or MODEL_FALLBACKS_FILE pointing at a JSON
+// file, mapping a model to the models to try next, in order:
+//
+//	{"gpt-5.5": ["gpt-5.3-codex", "gpt-5.1-codex-mini"]}
+//
+// Fallback happens before any response is written to the client. The model
+// that served the request is reported in servedModelHeader and in the
+// response's model field.
+
+const servedModelHeader = "x-codex-proxy-served-model"
+
+// modelFallbacks maps a model, as written in the config, to its fallback
+// chain.
+type modelFallbacks map[string][]string
+
+// newModelFallbacksFromEnv loads MODEL_FALLBACKS, or the file named by
+// MODEL_FALLBACKS_FILE.
+func newModelFallbacksFromEnv() (modelFallbacks, error) {
+	raw := env.GetOrDefault("MODEL_FALLBACKS", "")
+	if path, ok := env.Get("MODEL_FALLBACKS_FILE"); ok && raw == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MODEL_FALLBACKS_FILE: %w", err)
+		}
+		raw = string(b)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var chains map[string][]string
+	if err := json.Unmarshal([]byte(raw), &chains); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_FALLBACKS: %w", err)
+	}
+	return modelFallbacks(chains), nil
+}
+
+// chain returns the models to try for model, starting with model itself.
+// Models are normalized when the chain is looked up rather than at load
+// time, so chains may name models the catalog only learns about later.
+func (f modelFallbacks) chain(model string) []string {
+	models := []string{model}
+	for _, m := range f.lookup(model) {
+		if m = normalizeModel(m); !containsString(models, m) {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// lookup returns the chain configured for model. A key written as model
+// itself wins; otherwise keys that normalize to model are tried in sorted
+// order, so the choice does not depend on map iteration.
+func (f modelFallbacks) lookup(model string) []string {
+	if next, ok := f[model]; ok {
+		return next
+	}
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if normalizeModel(key) == model {
+			return f[key]
+		}
+	}
+	return nil
+}
+
+// unavailableStatus reports whether an upstream status means the model cannot
+// serve the request right now.
+func unavailableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// maxFallbackPeekBytes bounds how much of a successful stream is buffered
+// while looking for a leading failure event.
+const maxFallbackPeekBytes = 64 << 10
+
+// shouldFallBack reports whether resp says its model cannot serve the request
+// right now: a 429 or 503, another error whose Codex code is a usage or rate
+// limit, or a 200 stream that opens with such a response.failed or error
+// event. Nothing has reached the client at that point, so the request can
+// still move to another model. Whatever is read from resp.Body is restored.
+func shouldFallBack(resp *http.Response, status int) bool {
+	if unavailableStatus(status) {
+		return true
+	}
+	if resp == nil || resp.Body == nil {
+		return false
+	}
+	if status != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return translateUpstreamError(status, resp.Header, body).Status == http.StatusTooManyRequests
+	}
+	e, failed := peekStreamFailure(resp)
+	return failed && e.Status == http.StatusTooManyRequests
+}
+
+// peekStreamFailure reads the events at the start of a stream up to the
+// first one that is not response.created or response.in_progress, and
+// returns its error when that event is response.failed or error. The body is
+// restored so the stream can still be read from the start.
+func peekStreamFailure(resp *http.Response) (apiError, bool) {
+	var peeked bytes.Buffer
+	br := bufio.NewReader(resp.Body)
+	defer func() {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peeked.Bytes()), br), resp.Body}
+	}()
+
+	for peeked.Len() < maxFallbackPeekBytes {
+		line, err := br.ReadBytes('\n')
+		peeked.Write(line)
+		if data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok {
+			var event map[string]interface{}
+			if json.Unmarshal(bytes.TrimSpace(data), &event) != nil {
+				return apiError{}, false
+			}
+			switch eventType, _ := event["type"].(string); eventType {
+			case "response.created", "response.in_progress":
+			case "response.failed", "error":
+				return streamError(eventType, event), true
+			default:
+				return apiError{}, false
+			}
+		}
+		if err != nil {
+			return apiError{}, false
+		}
+	}
+	return apiError{}, false
+}
+
+// withFallbackModel rewrites a Codex request body for model, clamping its
+// reasoning effort to what model allows.
+func withFallbackModel(body []byte, model string) ([]byte, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("failed to rewrite request for fallback model: %w", err)
+	}
+	m["model"] = model
+	if reasoning, ok := m["reasoning"].(map[string]interface{}); ok {
+		effort, _ := reasoning["effort"].(string)
+		if clamped := clampReasoningEffortForModel(effort, model); clamped != "" {
+			reasoning["effort"] = clamped
+		} else {
+			delete(reasoning, "effort")
+		}
+	}
+	return json.Marshal(m)
+}
+
+// servedModel returns the model that served resp, or model when resp does
+// not say.
+func servedModel(resp *http.Response, model string) string {
+	if resp != nil {
+		if served := resp.Header.Get(servedModelHeader); served != "" {
+			return served
+		}
+	}
+	return model
+}
+
+// setServedModelHeader copies the served model from an upstream response to
+// the client response headers.
+func setServedModelHeader(dst, src http.Header) {
+	if served := src.Get(servedModelHeader); served != "" {
+		dst.Set(servedModelHeader, served)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const usageLimitBody = `{"error":{"type":"usage_limit_reached","message":"The usage limit has been reached"}}`
+
+func TestChatCompletionsFallBackOnUsageLimit(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": ["gpt-5.3-codex", "gpt-5.1-codex-mini"]}`)
+	var sent []map[string]interface{}
+	s := newTestServer(&fakeUpstream{respond: func(call int, req *http.Request) (int, string) {
+		var body map[string]interface{}
+		b, _ := io.ReadAll(req.Body)
+		require.NoError(t, json.Unmarshal(b, &body))
+		sent = append(sent, body)
+		switch call {
+		case 0:
+			return http.StatusTooManyRequests, usageLimitBody
+		case 1:
+			return http.StatusServiceUnavailable, `{"detail":"overloaded"}`
+		}
+		return http.StatusOK, textSSE("hello", 3, 1)
+	}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5.5","reasoning_effort":"xhigh","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Len(t, sent, 3)
+	assert.Equal(t, modelGPT55, sent[0]["model"])
+	assert.Equal(t, modelGPT53Codex, sent[1]["model"])
+	assert.Equal(t, modelGPT51CodexMini, sent[2]["model"])
+	assert.Equal(t, clampReasoningEffortForModel("xhigh", modelGPT51CodexMini), sent[2]["reasoning"].(map[string]interface{})["effort"])
+
+	assert.Equal(t, modelGPT51CodexMini, rec.Header().Get(servedModelHeader))
+	var resp ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, modelGPT51CodexMini, resp.Model)
+}
+
+func TestModelFallbacksStopAtChainEnd(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": ["gpt-5.3-codex"]}`)
+	upstream := &fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusTooManyRequests, usageLimitBody
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5.5","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, int32(2), upstream.calls)
+	assert.Equal(t, modelGPT53Codex, rec.Header().Get(servedModelHeader))
+}
+
+func TestModelFallbacksIgnoreOtherErrors(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": ["gpt-5.3-codex"]}`)
+	upstream := &fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusBadRequest, `{"detail":"bad request"}`
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5.5","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, int32(1), upstream.calls)
+}
+
+func TestModelFallbacksChain(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"GPT-5.5": ["gpt-5.3-codex", "gpt-5.5", "gpt-5.3-codex"], "gpt-5.5-high": ["gpt-5.1-codex-mini"], "gpt-5.5": ["gpt-5"]}`)
+	f, err := newModelFallbacksFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{modelGPT55, modelGPT5}, f.chain(modelGPT55), "a key written as the model wins")
+	assert.Equal(t, []string{modelGPT5}, f.chain(modelGPT5))
+
+	delete(f, modelGPT55)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{modelGPT55, modelGPT53Codex}, f.chain(modelGPT55), "other keys are tried in sorted order")
+	}
+
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": "gpt-5"}`)
+	_, err = newModelFallbacksFromEnv()
+	assert.Error(t, err)
+}
+
+func TestModelFallbacksForCatalogModels(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.6": ["gpt-5.5"], "gpt-5.7": ["gpt-5.3-codex"]}`)
+	f, err := newModelFallbacksFromEnv()
+	require.NoError(t, err, "models the catalog has not loaded yet are not rejected")
+
+	var payload struct {
+		Models []upstreamModel `json:"models"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(upstreamModelsJSON), &payload))
+	(&modelCatalog{}).publish(mergeUpstreamModels(builtinModels, payload.Models))
+
+	assert.Equal(t, []string{"gpt-5.6", modelGPT55}, f.chain(normalizeModel("gpt-5.6")))
+}
+
+func TestModelFallbacksClassifyErrorBody(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": ["gpt-5.3-codex"]}`)
+	upstream := &fakeUpstream{respond: func(call int, _ *http.Request) (int, string) {
+		if call == 0 {
+			return http.StatusForbidden, `{"error":{"code":"usage_not_included","message":"Your plan does not include this model"}}`
+		}
+		return http.StatusOK, textSSE("hello", 3, 1)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5.5","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, int32(2), upstream.calls)
+	assert.Equal(t, modelGPT53Codex, rec.Header().Get(servedModelHeader))
+}
+
+func TestModelFallbacksOnLeadingStreamFailure(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", `{"gpt-5.5": ["gpt-5.3-codex"]}`)
+	failed := strings.Join([]string{
+		`data: {"type":"response.created","response":{"id":"resp_x"}}`,
+		"",
+		`data: {"type":"response.failed","response":{"error":{"code":"usage_limit_reached","message":"The usage limit has been reached"}}}`,
+		"",
+	}, "\n")
+	upstream := &fakeUpstream{respond: func(call int, _ *http.Request) (int, string) {
+		if call == 0 {
+			return http.StatusOK, failed
+		}
+		return http.StatusOK, textSSE("hello", 3, 1)
+	}}
+	s := newTestServer(upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, int32(2), upstream.calls)
+	assert.Equal(t, modelGPT53Codex, rec.Header().Get(servedModelHeader))
+	assert.Contains(t, rec.Body.String(), "hello")
+}
+
+func TestPeekStreamFailureRestoresBody(t *testing.T) {
+	body := textSSE("hello", 3, 1)
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	assert.False(t, shouldFallBack(resp, http.StatusOK))
+	restored, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(restored))
+}
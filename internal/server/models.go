@@ -245,14 +245,9 @@ var modelMetadataByID = map[string]modelMetadata{
 				"max_context_window_tokens": 200000,
 				"max_output_tokens":         64000,
 				"max_prompt_tokens":         128000,
-				"vision": map[string]interface{}{
-					"max_prompt_image_size": 3145728,
-					"max_prompt_images":     1,
-					"supported_media_types": []string{"image/jpeg", "image/png", "image/webp", "image/gif"},
-				},
 			},
 			"object":    "model_capabilities",
-			"supports":  map[string]interface{}{"parallel_tool_calls": true, "streaming": true, "structured_outputs": true, "tool_calls": true, "vision": true},
+			"supports":  map[string]interface{}{"parallel_tool_calls": true, "streaming": true, "structured_outputs": true, "tool_calls": true, "vision": false},
 			"tokenizer": "o200k_base",
 			"type":      "chat",
 		},
@@ -494,6 +489,19 @@ var modelMetadataByID = map[string]modelMetadata{
 	},
 }
 
+// modelSupportsVision reports whether the given canonical backend model accepts
+// image input, based on the capabilities advertised for it.
+// Unknown models are assumed to accept images and left for upstream to reject.
+func modelSupportsVision(model string) bool {
+	meta, ok := currentModels().metadata[model]
+	if !ok {
+		return true
+	}
+	supports, _ := meta.Capabilities["supports"].(map[string]interface{})
+	vision, ok := supports["vision"].(bool)
+	return !ok || vision
+}
+
 var supportedModelIDs = []string{
 	modelGPT5,
 	modelGPT52,
@@ -511,9 +519,10 @@ var supportedModelIDs = []string{
 }
 
 func supportedModels() []modelMetadata {
-	models := make([]modelMetadata, 0, len(supportedModelIDs))
-	for _, id := range supportedModelIDs {
-		base, ok := modelMetadataByID[id]
+	table := currentModels()
+	models := make([]modelMetadata, 0, len(table.ids))
+	for _, id := range table.ids {
+		base, ok := table.metadata[id]
 		if !ok {
 			continue
 		}
@@ -523,7 +532,7 @@ func supportedModels() []modelMetadata {
 		// Also expose reasoning-effort suffix variants (e.g., gpt-5-high) so
 		// clients that encode effort in the model name can discover them from
 		// /v1/models.
-		if efforts, ok := modelAllowedEfforts[id]; ok {
+		if efforts, ok := table.allowedEfforts[id]; ok {
 			for _, effort := range efforts {
 				variant := base
 				variant.ID = id + "-" + effort
@@ -532,5 +541,5 @@ func supportedModels() []modelMetadata {
 			}
 		}
 	}
-	return models
+	return append(models, aliasModels(table)...)
 }
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Name rules rewrite client and vendor names in prompts (e.g. "Cursor" ->
+// "Codex") before they reach the Codex backend. They are configured with
+// NAME_RULES, which is "off", "default" or a JSON config, or NAME_RULES_FILE
+// pointing at a JSON config file:
+//
+//	{
+//	  "rules":    [{"match": "Cursor", "replace": "Codex", "roles": ["system"]}],
+//	  "profiles": {"strict": [{"regex": "(?i)\\bcopilot\\b"}]},
+//	  "keys":     {"sk-team-a": "strict", "sk-team-b": "off"},
+//	  "clients":  {"Zed/": "off"}
+//	}
+//
+// "rules" replaces the built-in defaults; a bare JSON array is shorthand for
+// it. A request uses the profile named by its X-Name-Rules header, else the
+// one mapped to its API key, else the first "clients" entry whose key is a
+// substring of its User-Agent, else the default rules. The profile names
+// "off" and "default" are always available.
+
+const (
+	nameRoleSystem = "system"
+	nameRoleUser   = "user"
+	nameRoleTool   = "tool"
+
+	nameRulesHeader  = "X-Name-Rules"
+	nameRulesOff     = "off"
+	nameRulesDefault = "default"
+)
+
+// defaultNameRuleRoles are the roles a rule applies to when it lists none.
+var defaultNameRuleRoles = []string{nameRoleSystem, nameRoleUser}
+
+// legacyReplacedNames are the names rewritten to "Codex" by default.
+var legacyReplacedNames = []string{"Zed", "Cline", "Roo", "GitHub Copilot", "Copilot", "Cursor", "Microsoft"}
+
+// nameRule rewrites either a literal matched as a whole word or a regular
+// expression. Whole-word matches skip identifiers, paths and dotted names,
+// so "Microsoft.Extensions" and "Cursor.ts" are left alone.
+type nameRule struct {
+	re      *regexp.Regexp
+	word    bool
+	replace string
+	roles   map[string]bool
+}
+
+func (r nameRule) apply(text string) string {
+	if !r.word {
+		return r.re.ReplaceAllString(text, r.replace)
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range r.re.FindAllStringIndex(text, -1) {
+		if !isStandaloneName(text, loc[0], loc[1]) {
+			continue
+		}
+		b.WriteString(text[last:loc[0]])
+		b.WriteString(r.replace)
+		last = loc[1]
+	}
+	if last == 0 {
+		return text
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// isStandaloneName reports whether text[start:end] is a word on its own
+// rather than part of an identifier, path, package or file name.
+func isStandaloneName(text string, start, end int) bool {
+	if start > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(text[:start])
+		if isNameRune(prev) || strings.ContainsRune(`./\-@`, prev) {
+			return false
+		}
+	}
+	if end < len(text) {
+		next, size := utf8.DecodeRuneInString(text[end:])
+		if isNameRune(next) || strings.ContainsRune(`/\-@`, next) {
+			return false
+		}
+		if next == '.' || next == ':' {
+			after, _ := utf8.DecodeRuneInString(text[end+size:])
+			if isNameRune(after) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nameRuleSet is an ordered list of rules. A nil set rewrites nothing.
+type nameRuleSet struct {
+	rules []nameRule
+}
+
+// apply rewrites text from a message with the given role.
+func (s *nameRuleSet) apply(role, text string) string {
+	if s == nil || text == "" {
+		return text
+	}
+	for _, r := range s.rules {
+		if r.roles[role] {
+			text = r.apply(text)
+		}
+	}
+	return text
+}
+
+// nameRuleSpec is the JSON form of a nameRule.
+type nameRuleSpec struct {
+	Match   string   `json:"match,omitempty"`
+	Regex   string   `json:"regex,omitempty"`
+	Replace *string  `json:"replace,omitempty"` // defaults to "Codex"
+	Roles   []string `json:"roles,omitempty"`   // defaults to system and user
+}
+
+func compileNameRules(specs []nameRuleSpec) (*nameRuleSet, error) {
+	set := &nameRuleSet{}
+	for i, spec := range specs {
+		rule := nameRule{replace: "Codex", roles: map[string]bool{}}
+		if spec.Replace != nil {
+			rule.replace = *spec.Replace
+		}
+		switch {
+		case spec.Match != "" && spec.Regex != "":
+			return nil, fmt.Errorf("rule %d: set either match or regex, not both", i)
+		case spec.Match != "":
+			rule.re = regexp.MustCompile(regexp.QuoteMeta(spec.Match))
+			rule.word = true
+		case spec.Regex != "":
+			re, err := regexp.Compile(spec.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("rule %d: match or regex is required", i)
+		}
+		roles := spec.Roles
+		if len(roles) == 0 {
+			roles = defaultNameRuleRoles
+		}
+		for _, role := range roles {
+			role = strings.ToLower(strings.TrimSpace(role))
+			switch role {
+			case nameRoleSystem, nameRoleUser, nameRoleTool:
+				rule.roles[role] = true
+			case "developer":
+				rule.roles[nameRoleSystem] = true
+			default:
+				return nil, fmt.Errorf("rule %d: unknown role %q", i, role)
+			}
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+func defaultNameRuleSet() *nameRuleSet {
+	specs := make([]nameRuleSpec, 0, len(legacyReplacedNames))
+	for _, name := range legacyReplacedNames {
+		specs = append(specs, nameRuleSpec{Match: name})
+	}
+	set, _ := compileNameRules(specs)
+	return set
+}
+
+// nameRulesConfig holds the default rule set and the per-request overrides.
+type nameRulesConfig struct {
+	defaults *nameRuleSet
+	profiles map[string]*nameRuleSet
+	keys     map[string]string
+	clients  userAgentProfiles
+}
+
+// userAgentProfiles maps User-Agent substrings to profile names, most
+// specific first.
+type userAgentProfiles []userAgentProfile
+
+type userAgentProfile struct {
+	userAgent string
+	profile   string
+}
+
+func newUserAgentProfiles(byUserAgent map[string]string) userAgentProfiles {
+	out := make(userAgentProfiles, 0, len(byUserAgent))
+	for ua, profile := range byUserAgent {
+		out = append(out, userAgentProfile{userAgent: ua, profile: profile})
+	}
+	// JSON objects are unordered; prefer the most specific User-Agent match.
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].userAgent) != len(out[j].userAgent) {
+			return len(out[i].userAgent) > len(out[j].userAgent)
+		}
+		return out[i].userAgent < out[j].userAgent
+	})
+	return out
+}
+
+// match returns the profile of the first entry contained in ua.
+func (p userAgentProfiles) match(ua string) (string, bool) {
+	if ua == "" {
+		return "", false
+	}
+	for _, entry := range p {
+		if strings.Contains(ua, entry.userAgent) {
+			return entry.profile, true
+		}
+	}
+	return "", false
+}
+
+func defaultNameRulesConfig() *nameRulesConfig {
+	return &nameRulesConfig{defaults: defaultNameRuleSet()}
+}
+
+// parseNameRulesConfig parses a NAME_RULES value or file.
+func parseNameRulesConfig(raw string) (*nameRulesConfig, error) {
+	raw = strings.TrimSpace(raw)
+	switch strings.ToLower(raw) {
+	case "", nameRulesDefault:
+		return defaultNameRulesConfig(), nil
+	case nameRulesOff, "none", "false", "0":
+		return &nameRulesConfig{}, nil
+	}
+
+	if strings.HasPrefix(raw, "[") {
+		raw = `{"rules":` + raw + `}`
+	}
+	var spec struct {
+		Rules    *[]nameRuleSpec           `json:"rules"`
+		Profiles map[string][]nameRuleSpec `json:"profiles"`
+		Keys     map[string]string         `json:"keys"`
+		Clients  map[string]string         `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return nil, fmt.Errorf("invalid name rules config: %w", err)
+	}
+
+	cfg := defaultNameRulesConfig()
+	if spec.Rules != nil {
+		set, err := compileNameRules(*spec.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("name rules: %w", err)
+		}
+		cfg.defaults = set
+	}
+	cfg.profiles = make(map[string]*nameRuleSet, len(spec.Profiles))
+	for name, rules := range spec.Profiles {
+		set, err := compileNameRules(rules)
+		if err != nil {
+			return nil, fmt.Errorf("name rules profile %q: %w", name, err)
+		}
+		cfg.profiles[name] = set
+	}
+	for key, profile := range spec.Keys {
+		if !cfg.hasProfile(profile) {
+			return nil, fmt.Errorf("name rules key %q: unknown profile %q", key, profile)
+		}
+	}
+	cfg.keys = spec.Keys
+	for ua, profile := range spec.Clients {
+		if !cfg.hasProfile(profile) {
+			return nil, fmt.Errorf("name rules client %q: unknown profile %q", ua, profile)
+		}
+	}
+	cfg.clients = newUserAgentProfiles(spec.Clients)
+	return cfg, nil
+}
+
+// newNameRulesFromEnv loads NAME_RULES, or the file named by NAME_RULES_FILE.
+func newNameRulesFromEnv() (*nameRulesConfig, error) {
+	raw := env.GetOrDefault("NAME_RULES", "")
+	if path, ok := env.Get("NAME_RULES_FILE"); ok && raw == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NAME_RULES_FILE: %w", err)
+		}
+		raw = string(b)
+	}
+	return parseNameRulesConfig(raw)
+}
+
+func (c *nameRulesConfig) hasProfile(name string) bool {
+	_, ok := c.profile(name)
+	return ok
+}
+
+func (c *nameRulesConfig) profile(name string) (*nameRuleSet, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case nameRulesOff, "none":
+		return nil, true
+	case nameRulesDefault:
+		return c.defaults, true
+	}
+	set, ok := c.profiles[strings.TrimSpace(name)]
+	return set, ok
+}
+
+// forRequest returns the rule set for r; nil means no rewriting.
+func (c *nameRulesConfig) forRequest(r *http.Request) *nameRuleSet {
+	if c == nil {
+		return nil
+	}
+	if name := r.Header.Get(nameRulesHeader); name != "" {
+		if set, ok := c.profile(name); ok {
+			return set
+		}
+	}
+	if key := requestAPIKey(r); key != "" {
+		if name, ok := c.keys[key]; ok {
+			set, _ := c.profile(name)
+			return set
+		}
+	}
+	if name, ok := c.clients.match(r.UserAgent()); ok {
+		set, _ := c.profile(name)
+		return set
+	}
+	return c.defaults
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultNameRules_WholeWordsOnly(t *testing.T) {
+	names := defaultNameRuleSet()
+	tests := map[string]string{
+		"You are running inside Zed.":                "You are running inside Codex.",
+		"Built by GitHub Copilot and Cursor, ok":     "Built by Codex and Codex, ok",
+		"using Microsoft.Extensions.Logging;":        "using Microsoft.Extensions.Logging;",
+		"open src/Cursor.ts and fix it":              "open src/Cursor.ts and fix it",
+		"the CursorPosition type":                    "the CursorPosition type",
+		"see @zed-industries/Zed-editor for details": "see @zed-industries/Zed-editor for details",
+		"Roo: hello": "Codex: hello",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, names.apply(nameRoleUser, in), in)
+	}
+	assert.Equal(t, "Cursor says hi", names.apply(nameRoleTool, "Cursor says hi"))
+	assert.Equal(t, "Cursor", (*nameRuleSet)(nil).apply(nameRoleUser, "Cursor"))
+}
+
+func TestParseNameRulesConfig(t *testing.T) {
+	cfg, err := parseNameRulesConfig(`[{"regex":"(?i)my-ide (v\\d+)","replace":"Codex $1","roles":["tool"]}]`)
+	require.NoError(t, err)
+	assert.Equal(t, "Codex v2 failed", cfg.defaults.apply(nameRoleTool, "My-IDE v2 failed"))
+	assert.Equal(t, "My-IDE v2 failed", cfg.defaults.apply(nameRoleUser, "My-IDE v2 failed"))
+
+	cfg, err = parseNameRulesConfig("off")
+	require.NoError(t, err)
+	assert.Nil(t, cfg.forRequest(httptest.NewRequest(http.MethodPost, "/", nil)))
+
+	_, err = parseNameRulesConfig(`{"keys":{"k":"missing"}}`)
+	assert.Error(t, err)
+	_, err = parseNameRulesConfig(`[{"match":"Zed","roles":["assistant"]}]`)
+	assert.Error(t, err)
+	_, err = parseNameRulesConfig(`[{"regex":"("}]`)
+	assert.Error(t, err)
+}
+
+func TestNameRulesForRequest(t *testing.T) {
+	cfg, err := parseNameRulesConfig(`{
+		"profiles": {"strict": [{"match": "Acme"}]},
+		"keys": {"key-off": "off", "key-strict": "strict"},
+		"clients": {"Zed/": "off"}
+	}`)
+	require.NoError(t, err)
+
+	rewrite := func(configure func(r *http.Request)) string {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		configure(r)
+		return cfg.forRequest(r).apply(nameRoleUser, "Acme in Cursor")
+	}
+	assert.Equal(t, "Acme in Codex", rewrite(func(*http.Request) {}))
+	assert.Equal(t, "Codex in Cursor", rewrite(func(r *http.Request) { r.Header.Set("Authorization", "Bearer key-strict") }))
+	assert.Equal(t, "Acme in Cursor", rewrite(func(r *http.Request) { r.Header.Set("X-API-Key", "key-off") }))
+	assert.Equal(t, "Acme in Cursor", rewrite(func(r *http.Request) { r.Header.Set("User-Agent", "Zed/0.190.0") }))
+	assert.Equal(t, "Codex in Cursor", rewrite(func(r *http.Request) {
+		r.Header.Set("User-Agent", "Zed/0.190.0")
+		r.Header.Set(nameRulesHeader, "strict")
+	}))
+}
+
+func TestBuildCodexInputMessages_NameRulesByRole(t *testing.T) {
+	requestData := map[string]interface{}{
+		"model": "gpt-5",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "system", "content": "You are Cursor."},
+			map[string]interface{}{"role": "user", "content": "Hi Cursor, open Cursor.ts"},
+			map[string]interface{}{"role": "assistant", "content": "Cursor here", "tool_calls": []interface{}{
+				map[string]interface{}{"id": "call_1", "type": "function", "function": map[string]interface{}{"name": "read", "arguments": "{}"}},
+			}},
+			map[string]interface{}{"role": "tool", "tool_call_id": "call_1", "content": "namespace Microsoft; // Cursor"},
+		},
+	}
+	input := buildCodexInputMessages(requestData, defaultNameRuleSet())
+
+	text := func(i int) string {
+		item := input[i].(map[string]interface{})
+		if out, ok := item["output"].(string); ok {
+			return out
+		}
+		return item["content"].([]interface{})[0].(map[string]interface{})["text"].(string)
+	}
+	require.Len(t, input, 5)
+	assert.Equal(t, "You are Codex.", text(0))
+	assert.Equal(t, "Hi Codex, open Cursor.ts", text(1))
+	assert.Equal(t, "Cursor here", text(2))
+	assert.Equal(t, "namespace Microsoft; // Cursor", text(4))
+}
+
+func TestSanitizeResponsesInput_NameRules(t *testing.T) {
+	names, err := compileNameRules([]nameRuleSpec{{Match: "Cursor", Roles: []string{"user", "tool"}}})
+	require.NoError(t, err)
+	body := map[string]interface{}{
+		"input": []interface{}{
+			map[string]interface{}{"role": "system", "content": "dropped"},
+			map[string]interface{}{"role": "user", "content": "Cursor asks"},
+			map[string]interface{}{"role": "assistant", "content": []interface{}{map[string]interface{}{"type": "output_text", "text": "Cursor answers"}}},
+			map[string]interface{}{"type": "function_call_output", "call_id": "c", "output": "Cursor output"},
+		},
+	}
+	sanitizeResponsesInput(body, names)
+
+	input := body["input"].([]interface{})
+	require.Len(t, input, 3)
+	assert.Equal(t, "Codex asks", input[0].(map[string]interface{})["content"])
+	assert.Equal(t, "Cursor answers", input[1].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["text"])
+	assert.Equal(t, "Codex output", input[2].(map[string]interface{})["output"])
+}
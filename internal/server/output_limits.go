@@ -0,0 +1,233 @@
+package server
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dvcrn/codex-proxy/internal/tokenizer"
+)
+
+// approxCharsPerToken is the character-to-token ratio used to enforce token
+// budgets when the o200k tokenizer is not available. It is deliberately conservative for English
+// text and code.
+const approxCharsPerToken = 4
+
+// outputLimits are generation limits the Codex backend does not accept
+// (stop sequences, max output tokens). The proxy enforces them while
+// streaming and cuts the upstream request short once they are hit.
+type outputLimits struct {
+	stop      []string
+	maxTokens int
+	// tokenizer measures maxTokens; nil approximates it by characters.
+	tokenizer *tokenizer.Tokenizer
+	// promptTokens is the prompt size counted by tokenizer, reported in the
+	// usage of a proxy-enforced stop.
+	promptTokens int
+}
+
+// withTokenizer measures the output budget with tok and records the prompt
+// size it counted. A nil tok leaves the limits unchanged.
+func (l outputLimits) withTokenizer(tok *tokenizer.Tokenizer, promptTokens int) outputLimits {
+	if tok != nil {
+		l.tokenizer = tok
+		l.promptTokens = promptTokens
+	}
+	return l
+}
+
+func (l outputLimits) enabled() bool {
+	return len(l.stop) > 0 || l.maxTokens > 0
+}
+
+// chatOutputLimits reads stop, max_completion_tokens and max_tokens from a chat
+// completions request. max_completion_tokens wins when both are set.
+func chatOutputLimits(requestData map[string]interface{}) outputLimits {
+	var limits outputLimits
+	switch stop := requestData["stop"].(type) {
+	case string:
+		if stop != "" {
+			limits.stop = []string{stop}
+		}
+	case []interface{}:
+		for _, s := range stop {
+			if str, ok := s.(string); ok && str != "" {
+				limits.stop = append(limits.stop, str)
+			}
+		}
+	}
+	for _, key := range []string{"max_completion_tokens", "max_tokens"} {
+		if n, ok := requestData[key].(float64); ok && n > 0 {
+			limits.maxTokens = int(n)
+			break
+		}
+	}
+	return limits
+}
+
+// responsesOutputLimits reads max_output_tokens (or the legacy max_tokens)
+// from a Responses request before it is stripped for upstream.
+func responsesOutputLimits(requestData map[string]interface{}) outputLimits {
+	var limits outputLimits
+	for _, key := range []string{"max_output_tokens", "max_tokens"} {
+		if n, ok := requestData[key].(float64); ok && n > 0 {
+			limits.maxTokens = int(n)
+			break
+		}
+	}
+	return limits
+}
+
+// outputLimiter applies outputLimits to a stream of output text deltas. Text
+// that could be the beginning of a stop sequence is held back until the next
+// delta shows whether the sequence completes.
+type outputLimiter struct {
+	stops []string
+	// budget is in tokens with a tokenizer and in characters without one;
+	// 0 means unlimited.
+	budget       int
+	tok          *tokenizer.Tokenizer
+	promptTokens int
+	used         int
+	held         string
+	finished     bool
+	// stopSequence is the stop sequence that ended the output, if any.
+	stopSequence string
+}
+
+func newOutputLimiter(limits outputLimits) *outputLimiter {
+	if !limits.enabled() {
+		return nil
+	}
+	l := &outputLimiter{
+		stops:        limits.stop,
+		budget:       limits.maxTokens * approxCharsPerToken,
+		tok:          limits.tokenizer,
+		promptTokens: limits.promptTokens,
+	}
+	if l.tok != nil {
+		l.budget = limits.maxTokens
+	}
+	return l
+}
+
+// measure returns the size of s in budget units. Deltas are tokenized one at
+// a time, which can only overcount where a token spans two deltas.
+func (l *outputLimiter) measure(s string) int {
+	if l.tok != nil {
+		return l.tok.Count(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// truncate cuts s to at most n budget units.
+func (l *outputLimiter) truncate(s string, n int) string {
+	if l.tok != nil {
+		return l.tok.Truncate(s, n)
+	}
+	return truncateRunes(s, n)
+}
+
+// feed consumes a text delta and returns the text that may be emitted, plus a
+// finish reason ("stop" or "length") once a limit is reached. After a finish
+// reason has been returned all further input is discarded.
+func (l *outputLimiter) feed(delta string) (emit string, finish string) {
+	if l.finished {
+		return "", ""
+	}
+	buf := l.held + delta
+	l.held = ""
+
+	cut, matched := -1, ""
+	for _, stop := range l.stops {
+		if idx := strings.Index(buf, stop); idx >= 0 && (cut < 0 || idx < cut) {
+			cut, matched = idx, stop
+		}
+	}
+	if cut >= 0 {
+		emit, finish = buf[:cut], "stop"
+	} else {
+		hold := l.partialStopSuffix(buf)
+		emit, l.held = buf[:len(buf)-hold], buf[len(buf)-hold:]
+	}
+
+	if l.budget > 0 {
+		remaining := l.budget - l.used
+		if n := l.measure(emit); n > remaining || (n == remaining && finish == "") {
+			emit = l.truncate(emit, remaining)
+			finish = "length"
+		}
+	}
+	l.used += l.measure(emit)
+
+	if finish == "stop" {
+		l.stopSequence = matched
+	}
+	if finish != "" {
+		l.finished = true
+		l.held = ""
+	}
+	return emit, finish
+}
+
+// flush returns text still held back at the end of the stream.
+func (l *outputLimiter) flush() string {
+	held := l.held
+	l.held = ""
+	if l.budget > 0 {
+		held = l.truncate(held, l.budget-l.used)
+	}
+	l.used += l.measure(held)
+	return held
+}
+
+// completionTokens returns the number of tokens emitted so far, estimated
+// from the character count without a tokenizer.
+func (l *outputLimiter) completionTokens() int {
+	if l.tok != nil {
+		return l.used
+	}
+	return (l.used + approxCharsPerToken - 1) / approxCharsPerToken
+}
+
+// stopUsage returns the token counts to report when the limiter stopped the
+// stream. ok is false unless the tokenizer counted the prompt; callers then
+// leave usage out rather than report a guess.
+func (l *outputLimiter) stopUsage() (prompt, completion int, ok bool) {
+	if l.tok == nil || l.promptTokens <= 0 {
+		return 0, 0, false
+	}
+	return l.promptTokens, l.completionTokens(), true
+}
+
+// partialStopSuffix returns the length of the longest suffix of s that is a
+// proper prefix of a stop sequence.
+func (l *outputLimiter) partialStopSuffix(s string) int {
+	longest := 0
+	for _, stop := range l.stops {
+		limit := len(stop) - 1
+		if limit > len(s) {
+			limit = len(s)
+		}
+		for n := limit; n > longest; n-- {
+			if strings.HasSuffix(s, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+func truncateRunes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputLimiter_StopSequenceAcrossDeltas(t *testing.T) {
+	l := newOutputLimiter(outputLimits{stop: []string{"END"}})
+
+	emit, finish := l.feed("hello E")
+	assert.Equal(t, "hello ", emit)
+	assert.Empty(t, finish)
+
+	emit, finish = l.feed("Nope")
+	assert.Equal(t, "ENope", emit)
+	assert.Empty(t, finish)
+
+	emit, finish = l.feed(" then EN")
+	assert.Equal(t, " then ", emit)
+	emit, finish = l.feed("D trailing")
+	assert.Equal(t, "", emit)
+	assert.Equal(t, "stop", finish)
+
+	emit, finish = l.feed("more")
+	assert.Empty(t, emit)
+	assert.Empty(t, finish)
+}
+
+func TestOutputLimiter_MaxTokens(t *testing.T) {
+	l := newOutputLimiter(outputLimits{maxTokens: 2})
+
+	emit, finish := l.feed("abcde")
+	assert.Equal(t, "abcde", emit)
+	assert.Empty(t, finish)
+
+	emit, finish = l.feed("fghij")
+	assert.Equal(t, "fgh", emit)
+	assert.Equal(t, "length", finish)
+	assert.Equal(t, 2, l.completionTokens())
+}
+
+func TestOutputLimiter_MaxTokensWithTokenizer(t *testing.T) {
+	l := newOutputLimiter(outputLimits{maxTokens: 6}.withTokenizer(byteTokenizer(t), 42))
+
+	emit, finish := l.feed("abcd")
+	assert.Equal(t, "abcd", emit)
+	assert.Empty(t, finish)
+
+	emit, finish = l.feed("efgh")
+	assert.Equal(t, "ef", emit)
+	assert.Equal(t, "length", finish)
+
+	prompt, completion, ok := l.stopUsage()
+	require.True(t, ok)
+	assert.Equal(t, 42, prompt)
+	assert.Equal(t, 6, completion)
+}
+
+func TestChatOutputLimits(t *testing.T) {
+	limits := chatOutputLimits(map[string]interface{}{
+		"stop":                  []interface{}{"\n\n", "", "Observation:"},
+		"max_tokens":            float64(100),
+		"max_completion_tokens": float64(50),
+	})
+	assert.Equal(t, []string{"\n\n", "Observation:"}, limits.stop)
+	assert.Equal(t, 50, limits.maxTokens)
+
+	assert.False(t, chatOutputLimits(map[string]interface{}{}).enabled())
+}
+
+// trackingReader records whether the whole upstream body was consumed.
+type trackingReader struct {
+	r   *strings.Reader
+	eof bool
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil {
+		t.eof = true
+	}
+	return n, err
+}
+
+func textDeltaStream(deltas ...string) string {
+	var b strings.Builder
+	b.WriteString(`data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_1"}}` + "\n\n")
+	for i, d := range deltas {
+		fmt.Fprintf(&b, `data: {"type":"response.output_text.delta","sequence_number":%d,"delta":%q}`+"\n\n", i+1, d)
+	}
+	b.WriteString(`data: {"type":"response.completed","sequence_number":99,"response":{"usage":{"input_tokens":1,"output_tokens":1}}}` + "\n\n")
+	return b.String()
+}
+
+func TestRewriteSSEStreamWithOptions_StopsAtStopSequence(t *testing.T) {
+	src := &trackingReader{r: strings.NewReader(textDeltaStream("Thought: ok\nObs", "ervation: nope", " more", " text"))}
+	var dst strings.Builder
+	require.NoError(t, RewriteSSEStreamWithOptions(src, &dst, "gpt-5", chatStreamOptions{limits: outputLimits{stop: []string{"Observation:"}}}, nil))
+
+	out := dst.String()
+	assert.Contains(t, out, `"content":"Thought: ok\n"`)
+	assert.NotContains(t, out, "nope")
+	assert.Contains(t, out, `"finish_reason":"stop"`)
+	assert.True(t, strings.HasSuffix(out, "data: [DONE]\n\n"))
+	assert.False(t, src.eof, "upstream should not be drained after the stop sequence")
+}
+
+func TestRewriteSSEStreamWithOptions_ReleasesHeldTextAtCompletion(t *testing.T) {
+	var dst strings.Builder
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(textDeltaStream("done Obs")), &dst, "gpt-5", chatStreamOptions{limits: outputLimits{stop: []string{"Observation:"}}}, nil))
+
+	out := dst.String()
+	assert.Contains(t, out, `"content":"done "`)
+	assert.Contains(t, out, `"content":"Obs"`)
+	assert.Contains(t, out, `"finish_reason":"stop"`)
+}
+
+func TestBufferChatCompletionFromSSE_MaxTokensLength(t *testing.T) {
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl")), "gpt-5", chatStreamOptions{limits: outputLimits{maxTokens: 2}})
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", resp.Choices[0].Message.Content)
+	assert.Equal(t, "length", resp.Choices[0].FinishReason)
+}
+
+func TestRewriteSSEStreamWithOptions_StopUsage(t *testing.T) {
+	var dst strings.Builder
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl")), &dst, "gpt-5", chatStreamOptions{limits: outputLimits{maxTokens: 2}}, nil))
+	assert.Contains(t, dst.String(), `"finish_reason":"length"`)
+	assert.NotContains(t, dst.String(), "prompt_tokens", "usage is left out when the prompt was not counted")
+
+	dst.Reset()
+	limits := outputLimits{maxTokens: 6}.withTokenizer(byteTokenizer(t), 42)
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl")), &dst, "gpt-5", chatStreamOptions{limits: limits}, nil))
+	assert.Contains(t, dst.String(), `"usage":{"completion_tokens":6,"prompt_tokens":42,"total_tokens":48}`)
+}
+
+func TestPassThroughSSEStreamWithLimits_MaxOutputTokens(t *testing.T) {
+	src := &trackingReader{r: strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl"))}
+	var dst strings.Builder
+	require.NoError(t, PassThroughSSEStreamWithLimits(src, &dst, outputLimits{maxTokens: 1}))
+
+	out := dst.String()
+	assert.Contains(t, out, `"delta":"abcd"`)
+	assert.NotContains(t, out, "efgh")
+	assert.Contains(t, out, `"type":"response.incomplete"`)
+	assert.Contains(t, out, `"reason":"max_output_tokens"`)
+	assert.Contains(t, out, `"id":"resp_1"`)
+	assert.NotContains(t, out, "response.completed")
+	assert.NotContains(t, out, "input_tokens")
+	assert.False(t, src.eof)
+
+	dst.Reset()
+	limits := outputLimits{maxTokens: 4}.withTokenizer(byteTokenizer(t), 42)
+	require.NoError(t, PassThroughSSEStreamWithLimits(strings.NewReader(textDeltaStream("abcd", "efgh")), &dst, limits))
+	assert.Contains(t, dst.String(), `"usage":{"input_tokens":42,"output_tokens":4,"total_tokens":46}`)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Codex backend reports ChatGPT plan usage on every response as
+//
+//	x-codex-{primary,secondary}-used-percent
+//	x-codex-{primary,secondary}-window-minutes
+//	x-codex-{primary,secondary}-reset-at             (unix seconds)
+//	x-codex-{primary,secondary}-reset-after-seconds
+//
+// where primary is the 5-hour window and secondary the weekly one. The
+// proxy re-exposes them as OpenAI x-ratelimit-* headers in percent units:
+// the primary window as the "requests" limit and the secondary window as
+// the "tokens" limit. The raw windows are also sent as
+// x-codex-ratelimit-{primary,secondary}-* headers. x-ratelimit-* headers
+// sent by upstream itself take precedence.
+
+// rateLimitWindow is one usage window of a rateLimitSnapshot.
+type rateLimitWindow struct {
+	UsedPercent   float64    `json:"usedPercent"`
+	WindowMinutes int        `json:"windowMinutes,omitempty"`
+	ResetsAt      *time.Time `json:"resetsAt,omitempty"`
+}
+
+// rateLimitSnapshot is the latest usage reported for an account.
+type rateLimitSnapshot struct {
+	Primary   *rateLimitWindow `json:"primary,omitempty"`
+	Secondary *rateLimitWindow `json:"secondary,omitempty"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+}
+
+// parseRateLimitSnapshot reads the x-codex-* usage headers. It returns nil
+// when the response carries none.
+func parseRateLimitSnapshot(h http.Header, now time.Time) *rateLimitSnapshot {
+	snap := &rateLimitSnapshot{
+		Primary:   parseRateLimitWindow(h, "primary", now),
+		Secondary: parseRateLimitWindow(h, "secondary", now),
+		UpdatedAt: now,
+	}
+	if snap.Primary == nil && snap.Secondary == nil {
+		return nil
+	}
+	return snap
+}
+
+func parseRateLimitWindow(h http.Header, name string, now time.Time) *rateLimitWindow {
+	prefix := "x-codex-" + name + "-"
+	used, err := strconv.ParseFloat(strings.TrimSpace(h.Get(prefix+"used-percent")), 64)
+	if err != nil {
+		return nil
+	}
+	win := &rateLimitWindow{UsedPercent: used}
+	if minutes, err := strconv.Atoi(strings.TrimSpace(h.Get(prefix + "window-minutes"))); err == nil {
+		win.WindowMinutes = minutes
+	}
+	if at, err := strconv.ParseInt(strings.TrimSpace(h.Get(prefix+"reset-at")), 10, 64); err == nil {
+		t := time.Unix(at, 0)
+		win.ResetsAt = &t
+	} else if secs, err := strconv.ParseFloat(strings.TrimSpace(h.Get(prefix+"reset-after-seconds")), 64); err == nil {
+		t := now.Add(time.Duration(secs * float64(time.Second)))
+		win.ResetsAt = &t
+	}
+	return win
+}
+
+// setRateLimitHeaders adds OpenAI x-ratelimit-* headers to dst derived from
+// the Codex usage headers in src, plus the windows as x-codex-ratelimit-*
+// headers.
+func setRateLimitHeaders(dst, src http.Header) {
+	for key, values := range src {
+		if strings.HasPrefix(strings.ToLower(key), "x-ratelimit-") {
+			dst[key] = append([]string(nil), values...)
+		}
+	}
+	setDefault := func(key, value string) {
+		if src.Get(key) == "" {
+			dst.Set(key, value)
+		}
+	}
+
+	now := time.Now()
+	snap := parseRateLimitSnapshot(src, now)
+	if snap == nil {
+		return
+	}
+	for _, w := range []struct {
+		win  *rateLimitWindow
+		name string
+		kind string
+	}{{snap.Primary, "primary", "requests"}, {snap.Secondary, "secondary", "tokens"}} {
+		if w.win == nil {
+			continue
+		}
+		remaining := 100 - w.win.UsedPercent
+		if remaining < 0 {
+			remaining = 0
+		}
+		setDefault("x-ratelimit-limit-"+w.kind, "100")
+		setDefault("x-ratelimit-remaining-"+w.kind, strconv.FormatFloat(remaining, 'f', -1, 64))
+
+		prefix := "x-codex-ratelimit-" + w.name + "-"
+		dst.Set(prefix+"used-percent", strconv.FormatFloat(w.win.UsedPercent, 'f', -1, 64))
+		if w.win.WindowMinutes > 0 {
+			dst.Set(prefix+"window-minutes", strconv.Itoa(w.win.WindowMinutes))
+		}
+		if w.win.ResetsAt != nil {
+			reset := w.win.ResetsAt.Sub(now).Round(time.Second)
+			if reset < 0 {
+				reset = 0
+			}
+			setDefault("x-ratelimit-reset-"+w.kind, reset.String())
+			dst.Set(prefix+"reset-after-seconds", strconv.FormatInt(int64(reset/time.Second), 10))
+		}
+	}
+}
+
+// rateLimitTracker keeps the latest rateLimitSnapshot per ChatGPT account.
+type rateLimitTracker struct {
+	mu        sync.Mutex
+	byAccount map[string]rateLimitSnapshot
+}
+
+func newRateLimitTracker() *rateLimitTracker {
+	return &rateLimitTracker{byAccount: make(map[string]rateLimitSnapshot)}
+}
+
+func (t *rateLimitTracker) observe(accountID string, h http.Header) {
+	snap := parseRateLimitSnapshot(h, time.Now())
+	if snap == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byAccount[accountID] = *snap
+}
+
+// snapshots returns a copy of the latest snapshot for every account seen.
+func (t *rateLimitTracker) snapshots() map[string]rateLimitSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]rateLimitSnapshot, len(t.byAccount))
+	for k, v := range t.byAccount {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func codexUsageHeaders(now time.Time) http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("x-codex-primary-used-percent", "42.5")
+	h.Set("x-codex-primary-window-minutes", "300")
+	h.Set("x-codex-primary-reset-after-seconds", "600")
+	h.Set("x-codex-secondary-used-percent", "80")
+	h.Set("x-codex-secondary-window-minutes", "10080")
+	h.Set("x-codex-secondary-reset-at", strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10))
+	return h
+}
+
+func TestParseRateLimitSnapshot(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	snap := parseRateLimitSnapshot(codexUsageHeaders(now), now)
+	require.NotNil(t, snap)
+	require.NotNil(t, snap.Primary)
+	assert.Equal(t, 42.5, snap.Primary.UsedPercent)
+	assert.Equal(t, 300, snap.Primary.WindowMinutes)
+	assert.Equal(t, now.Add(10*time.Minute), *snap.Primary.ResetsAt)
+	require.NotNil(t, snap.Secondary)
+	assert.Equal(t, 10080, snap.Secondary.WindowMinutes)
+	assert.Equal(t, now.Add(48*time.Hour), *snap.Secondary.ResetsAt)
+
+	assert.Nil(t, parseRateLimitSnapshot(http.Header{}, now))
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	dst := http.Header{}
+	setRateLimitHeaders(dst, codexUsageHeaders(time.Now()))
+	assert.Equal(t, "42.5", dst.Get("x-codex-ratelimit-primary-used-percent"))
+	assert.Equal(t, "300", dst.Get("x-codex-ratelimit-primary-window-minutes"))
+	assert.Equal(t, "600", dst.Get("x-codex-ratelimit-primary-reset-after-seconds"))
+	assert.Equal(t, "80", dst.Get("x-codex-ratelimit-secondary-used-percent"))
+	assert.NotEmpty(t, dst.Get("x-codex-ratelimit-secondary-reset-after-seconds"))
+	assert.Equal(t, "100", dst.Get("x-ratelimit-limit-requests"))
+	assert.Equal(t, "57.5", dst.Get("x-ratelimit-remaining-requests"))
+	assert.Equal(t, "10m0s", dst.Get("x-ratelimit-reset-requests"))
+	assert.Equal(t, "100", dst.Get("x-ratelimit-limit-tokens"))
+	assert.Equal(t, "20", dst.Get("x-ratelimit-remaining-tokens"))
+	assert.NotEmpty(t, dst.Get("x-ratelimit-reset-tokens"))
+
+	src := codexUsageHeaders(time.Now())
+	src.Set("x-ratelimit-remaining-requests", "99")
+	dst = http.Header{}
+	setRateLimitHeaders(dst, src)
+	assert.Equal(t, "99", dst.Get("x-ratelimit-remaining-requests"), "upstream counts take precedence")
+	assert.Equal(t, "100", dst.Get("x-ratelimit-limit-requests"))
+}
+
+type headerUpstream struct{ header http.Header }
+
+func (u headerUpstream) Do(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     u.header,
+		Body:       io.NopCloser(strings.NewReader(textSSE("hi", 1, 1))),
+	}, nil
+}
+
+func TestRateLimitsExposedOnResponseAndStatus(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "secret")
+	s, err := New(zerolog.Nop(), staticCreds{}, UpstreamConfig{})
+	require.NoError(t, err)
+	s.httpClient = headerUpstream{header: codexUsageHeaders(time.Now())}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "42.5", rec.Header().Get("x-codex-ratelimit-primary-used-percent"))
+	assert.Equal(t, "57.5", rec.Header().Get("x-ratelimit-remaining-requests"))
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/credentials/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status struct {
+		RateLimits map[string]rateLimitSnapshot `json:"rateLimits"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Len(t, status.RateLimits, 1)
+	for _, snap := range status.RateLimits {
+		require.NotNil(t, snap.Secondary)
+		assert.Equal(t, float64(80), snap.Secondary.UsedPercent)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Reasoning output modes for chat completions. Clients disagree on where
+// reasoning belongs, so it can be emitted as:
+//
+//	reasoning_content  delta.reasoning_content, first reasoning item only (default)
+//	reasoning          delta.reasoning (OpenRouter style), first reasoning item only
+//	think              inline <think>…</think> at the start of delta.content
+//	merged             delta.reasoning_content with every reasoning item, in order
+//	none               omitted
+const (
+	reasoningOutputContent = "reasoning_content"
+	reasoningOutputField   = "reasoning"
+	reasoningOutputThink   = "think"
+	reasoningOutputMerged  = "merged"
+	reasoningOutputNone    = "none"
+)
+
+// reasoningOutputHeader selects the mode for a single request.
+const reasoningOutputHeader = "X-Reasoning-Output"
+
+func normalizeReasoningOutputMode(mode string) string {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case reasoningOutputContent:
+		return reasoningOutputContent
+	case reasoningOutputField:
+		return reasoningOutputField
+	case reasoningOutputThink, "<think>":
+		return reasoningOutputThink
+	case reasoningOutputMerged:
+		return reasoningOutputMerged
+	case reasoningOutputNone, "omit", "omitted", "off":
+		return reasoningOutputNone
+	default:
+		return ""
+	}
+}
+
+// resolveReasoningOutputMode picks the reasoning output mode for a request.
+// The reasoning_output body field wins, then the X-Reasoning-Output header,
+// then the API key's entry in REASONING_OUTPUT_BY_KEY ("key=mode,key=mode"),
+// then REASONING_OUTPUT, then reasoning_content.
+func resolveReasoningOutputMode(r *http.Request, requestData map[string]interface{}) string {
+	if v, ok := requestData["reasoning_output"].(string); ok {
+		if mode := normalizeReasoningOutputMode(v); mode != "" {
+			return mode
+		}
+	}
+	if mode := normalizeReasoningOutputMode(r.Header.Get(reasoningOutputHeader)); mode != "" {
+		return mode
+	}
+	if key := requestAPIKey(r); key != "" {
+		for _, pair := range strings.Split(env.GetOrDefault("REASONING_OUTPUT_BY_KEY", ""), ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if ok && strings.TrimSpace(k) == key {
+				if mode := normalizeReasoningOutputMode(v); mode != "" {
+					return mode
+				}
+			}
+		}
+	}
+	if mode := normalizeReasoningOutputMode(env.GetOrDefault("REASONING_OUTPUT", "")); mode != "" {
+		return mode
+	}
+	return reasoningOutputContent
+}
+
+// reasoningDelta returns the chunk delta carrying reasoning text for mode.
+func reasoningDelta(mode string, text string) map[string]interface{} {
+	switch mode {
+	case reasoningOutputField:
+		return map[string]interface{}{"reasoning": text}
+	case reasoningOutputThink:
+		return map[string]interface{}{"content": text}
+	default:
+		return map[string]interface{}{"reasoning_content": text}
+	}
+}
+
+// closesThinkBlock reports whether an upstream event ends the reasoning phase,
+// so an open <think> block must be closed before anything else is emitted.
+func closesThinkBlock(eventType string, upstream map[string]interface{}) bool {
+	switch eventType {
+	case "response.output_item.added", "response.output_item.done":
+		item, _ := upstream["item"].(map[string]interface{})
+		typ, _ := item["type"].(string)
+		if eventType == "response.output_item.done" {
+			return typ == "reasoning" || typ == "local_shell_call" || typ == "web_search_call"
+		}
+		return typ != "reasoning"
+	case "response.output_text.delta", "response.custom_tool_call_input.delta",
+		"response.function_call_arguments.delta", "response.refusal.delta",
+		"response.completed", "response.incomplete", "response.failed", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// stripThinkBlock removes a leading <think>…</think> block from content.
+func stripThinkBlock(content string) string {
+	trimmed := strings.TrimLeft(content, " \t\r\n")
+	if !strings.HasPrefix(trimmed, "<think>") {
+		return content
+	}
+	if end := strings.Index(trimmed, "</think>"); end >= 0 {
+		return strings.TrimLeft(trimmed[end+len("</think>"):], " \t\r\n")
+	}
+	return content
+}
+
+// deltaChunk builds a chat.completion.chunk with a single choice delta.
+func (t *SSETransformer) deltaChunk(seq interface{}, delta map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"id":      t.responseID,
+		"object":  "chat.completion.chunk",
+		"created": seq,
+		"model":   t.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": nil,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chunk: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func twoReasoningItemsSSE() string {
+	return strings.Join([]string{
+		`data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_1"}}`,
+		"",
+		`data: {"type":"response.output_item.added","sequence_number":1,"output_index":0,"item":{"type":"reasoning","id":"rs_1"}}`,
+		"",
+		`data: {"type":"response.reasoning_summary_text.delta","sequence_number":2,"output_index":0,"item_id":"rs_1","delta":"First"}`,
+		"",
+		`data: {"type":"response.output_item.done","sequence_number":3,"output_index":0,"item":{"type":"reasoning","id":"rs_1"}}`,
+		"",
+		`data: {"type":"response.reasoning_summary_text.delta","sequence_number":4,"output_index":1,"item_id":"rs_2","delta":"Second"}`,
+		"",
+		`data: {"type":"response.output_text.delta","sequence_number":5,"delta":"Answer"}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":6,"response":{}}`,
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+}
+
+func TestReasoningOutputModes(t *testing.T) {
+	tests := []struct {
+		mode             string
+		content          string
+		reasoningContent string
+		reasoning        string
+	}{
+		{mode: "", content: "Answer", reasoningContent: "First"},
+		{mode: reasoningOutputContent, content: "Answer", reasoningContent: "First"},
+		{mode: reasoningOutputField, content: "Answer", reasoning: "First"},
+		{mode: reasoningOutputThink, content: "<think>\nFirst\n</think>\n\nAnswer"},
+		{mode: reasoningOutputMerged, content: "Answer", reasoningContent: "First\n\nSecond"},
+		{mode: reasoningOutputNone, content: "Answer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			resp, err := bufferChatCompletionFromSSE(strings.NewReader(twoReasoningItemsSSE()), "gpt-5", chatStreamOptions{reasoningMode: tt.mode})
+			require.NoError(t, err)
+			require.Len(t, resp.Choices, 1)
+			msg := resp.Choices[0].Message
+			assert.Equal(t, "assistant", msg.Role)
+			assert.Equal(t, tt.content, msg.Content)
+			assert.Equal(t, tt.reasoningContent, msg.ReasoningContent)
+			assert.Equal(t, tt.reasoning, msg.Reasoning)
+		})
+	}
+}
+
+func TestReasoningOutputThinkClosedBeforeToolCall(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.reasoning_summary_text.delta","sequence_number":1,"output_index":0,"delta":"Plan"}`,
+		"",
+		`data: {"type":"response.output_item.added","sequence_number":2,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"lookup"}}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","sequence_number":3,"item_id":"fc_1","delta":"{}"}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":4,"response":{}}`,
+		"",
+	}, "\n")
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(src), "gpt-5", chatStreamOptions{reasoningMode: reasoningOutputThink})
+	require.NoError(t, err)
+	msg := resp.Choices[0].Message
+	assert.Equal(t, "<think>\nPlan\n</think>\n\n", msg.Content)
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, "tool_calls", resp.Choices[0].FinishReason)
+}
+
+func TestResolveReasoningOutputMode(t *testing.T) {
+	t.Setenv("REASONING_OUTPUT", "none")
+	t.Setenv("REASONING_OUTPUT_BY_KEY", "key-a=think, key-b=merged")
+
+	newReq := func(key, header string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		if header != "" {
+			r.Header.Set(reasoningOutputHeader, header)
+		}
+		return r
+	}
+
+	assert.Equal(t, reasoningOutputNone, resolveReasoningOutputMode(newReq("", ""), map[string]interface{}{}))
+	assert.Equal(t, reasoningOutputThink, resolveReasoningOutputMode(newReq("key-a", ""), map[string]interface{}{}))
+	assert.Equal(t, reasoningOutputMerged, resolveReasoningOutputMode(newReq("key-b", ""), map[string]interface{}{}))
+	assert.Equal(t, reasoningOutputField, resolveReasoningOutputMode(newReq("key-a", "reasoning"), map[string]interface{}{}))
+	assert.Equal(t, reasoningOutputContent, resolveReasoningOutputMode(newReq("key-a", "reasoning"), map[string]interface{}{"reasoning_output": "reasoning_content"}))
+	assert.Equal(t, reasoningOutputNone, resolveReasoningOutputMode(newReq("", "bogus"), map[string]interface{}{}))
+}
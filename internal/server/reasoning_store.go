@@ -0,0 +1,259 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+const (
+	defaultReasoningCacheTTL        = time.Hour
+	defaultReasoningCacheMaxEntries = 10000
+)
+
+// reasoningStore keeps encrypted reasoning items from previous responses so
+// they can be replayed on the next chat completions turn. Chat clients never
+// send reasoning back, so without this every turn would reason from scratch
+// and miss the prompt cache. Entries are keyed by the client's API key plus
+// the tool call_id, or the assistant message text together with the user
+// message it answered, that followed the reasoning. They expire after ttl,
+// and the oldest entries are evicted beyond maxEntries.
+type reasoningStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]reasoningEntry
+	order      []string // insertion order, oldest first
+	now        func() time.Time
+}
+
+type reasoningEntry struct {
+	items   []interface{}
+	expires time.Time
+}
+
+func newReasoningStore(ttl time.Duration, maxEntries int) *reasoningStore {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &reasoningStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]reasoningEntry),
+		now:        time.Now,
+	}
+}
+
+// newReasoningStoreFromEnv configures the store from REASONING_CACHE_TTL (a Go
+// duration, "0" disables it) and REASONING_CACHE_MAX_ENTRIES.
+func newReasoningStoreFromEnv() *reasoningStore {
+	ttl := defaultReasoningCacheTTL
+	if v, ok := env.Get("REASONING_CACHE_TTL"); ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			ttl = d
+		}
+	}
+	maxEntries := defaultReasoningCacheMaxEntries
+	if v, ok := env.Get("REASONING_CACHE_MAX_ENTRIES"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			maxEntries = n
+		}
+	}
+	return newReasoningStore(ttl, maxEntries)
+}
+
+func (s *reasoningStore) put(key string, items []interface{}) {
+	if s == nil || key == "" || len(items) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if _, exists := s.entries[key]; !exists {
+		s.order = append(s.order, key)
+	}
+	s.entries[key] = reasoningEntry{items: items, expires: now.Add(s.ttl)}
+
+	// Drop expired and overflowing entries from the front of the queue.
+	for len(s.order) > 0 {
+		oldest := s.order[0]
+		entry, ok := s.entries[oldest]
+		if ok && len(s.entries) <= s.maxEntries && now.Before(entry.expires) {
+			break
+		}
+		delete(s.entries, oldest)
+		s.order = s.order[1:]
+	}
+}
+
+func (s *reasoningStore) get(key string) []interface{} {
+	if s == nil || key == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Expired entries are left for put to evict so entries and order agree.
+	entry, ok := s.entries[key]
+	if !ok || !s.now().Before(entry.expires) {
+		return nil
+	}
+	return entry.items
+}
+
+// reasoningScope isolates stored reasoning per client and conversation turn,
+// so a common reply such as "Done." never picks up reasoning recorded for
+// another client or another conversation.
+type reasoningScope struct {
+	// tenant identifies the client's API key.
+	tenant string
+	// context identifies the last user message before the recorded items.
+	context string
+}
+
+// newReasoningScope returns the scope for a response to input, a Codex input
+// list sent by the client authenticated on r.
+func newReasoningScope(r *http.Request, input []interface{}) reasoningScope {
+	scope := reasoningScope{tenant: reasoningTenant(r)}
+	for _, it := range input {
+		if m, ok := it.(map[string]interface{}); ok {
+			if ctx := userMessageDigest(m); ctx != "" {
+				scope.context = ctx
+			}
+		}
+	}
+	return scope
+}
+
+// reasoningTenant hashes the client's API key; clients without one share the
+// empty tenant.
+func reasoningTenant(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userMessageDigest hashes a user message input item, or returns "" for any
+// other item.
+func userMessageDigest(item map[string]interface{}) string {
+	if typ, _ := item["type"].(string); typ != "message" && typ != "" {
+		return ""
+	}
+	if role, _ := item["role"].(string); role != "user" {
+		return ""
+	}
+	content, err := json.Marshal(item["content"])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// reinsert returns input with stored reasoning items placed before the tool
+// calls and assistant messages they originally preceded, looking them up in
+// the tenant's scope.
+func (s *reasoningStore) reinsert(tenant string, input []interface{}) []interface{} {
+	if s == nil {
+		return input
+	}
+	scope := reasoningScope{tenant: tenant}
+	out := make([]interface{}, 0, len(input))
+	for _, it := range input {
+		if m, ok := it.(map[string]interface{}); ok {
+			if ctx := userMessageDigest(m); ctx != "" {
+				scope.context = ctx
+			}
+			out = append(out, s.get(reasoningKeyForItem(scope, m))...)
+		}
+		out = append(out, it)
+	}
+	return out
+}
+
+// recorder returns a per-stream recorder that captures reasoning items into s
+// under scope.
+func (s *reasoningStore) recorder(scope reasoningScope) *reasoningRecorder {
+	if s == nil {
+		return nil
+	}
+	return &reasoningRecorder{store: s, scope: scope}
+}
+
+// reasoningRecorder collects reasoning output items of one response and files
+// them under the first tool call or assistant message that follows them.
+type reasoningRecorder struct {
+	store   *reasoningStore
+	scope   reasoningScope
+	pending []interface{}
+}
+
+func (r *reasoningRecorder) observe(item map[string]interface{}) {
+	if typ, _ := item["type"].(string); typ == "reasoning" {
+		enc, _ := item["encrypted_content"].(string)
+		if enc == "" {
+			return
+		}
+		replay := map[string]interface{}{
+			"type":              "reasoning",
+			"summary":           item["summary"],
+			"encrypted_content": enc,
+		}
+		if replay["summary"] == nil {
+			replay["summary"] = []interface{}{}
+		}
+		r.pending = append(r.pending, replay)
+		return
+	}
+	if len(r.pending) == 0 {
+		return
+	}
+	if key := reasoningKeyForItem(r.scope, item); key != "" {
+		r.store.put(key, r.pending)
+		r.pending = nil
+	}
+}
+
+// reasoningKeyForItem returns the store key for a Codex output or input item
+// within scope: the call_id for tool calls, or a hash of the text and the
+// preceding user message for assistant messages.
+func reasoningKeyForItem(scope reasoningScope, item map[string]interface{}) string {
+	switch typ, _ := item["type"].(string); typ {
+	case "function_call", "custom_tool_call", "local_shell_call":
+		if callID, _ := item["call_id"].(string); callID != "" {
+			return scope.tenant + "/call:" + callID
+		}
+	case "message":
+		if role, _ := item["role"].(string); role != "assistant" {
+			return ""
+		}
+		contents, _ := item["content"].([]interface{})
+		var parts []string
+		for _, c := range contents {
+			if cm, ok := c.(map[string]interface{}); ok {
+				if text, _ := cm["text"].(string); text != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+		// Match how buildCodexInputMessages normalizes replayed assistant text;
+		// name rules never apply to assistant messages.
+		text := strings.TrimSpace(strings.Join(parts, ""))
+		if text == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(scope.context + "\x00" + text))
+		return scope.tenant + "/msg:" + hex.EncodeToString(sum[:])
+	}
+	return ""
+}
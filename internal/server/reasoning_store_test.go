@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasoningStore_TTLAndEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := newReasoningStore(time.Minute, 2)
+	store.now = func() time.Time { return now }
+
+	item := []interface{}{map[string]interface{}{"type": "reasoning"}}
+	store.put("a", item)
+	store.put("b", item)
+	store.put("c", item)
+	assert.Nil(t, store.get("a"), "oldest entry should be evicted past maxEntries")
+	assert.NotNil(t, store.get("b"))
+	assert.NotNil(t, store.get("c"))
+
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, store.get("b"), "entries expire after the TTL")
+	store.put("d", item)
+	assert.Len(t, store.entries, 1)
+	assert.Equal(t, []string{"d"}, store.order)
+
+	assert.Nil(t, newReasoningStore(0, 10), "zero TTL disables the store")
+}
+
+func TestChatCompletions_ReplaysEncryptedReasoning(t *testing.T) {
+	var secondBody map[string]interface{}
+	upstream := &fakeUpstream{respond: func(call int, req *http.Request) (int, string) {
+		if call == 1 {
+			raw, _ := io.ReadAll(req.Body)
+			_ = json.Unmarshal(raw, &secondBody)
+			return http.StatusOK, textSSE("It is sunny.", 1, 1)
+		}
+		return http.StatusOK, strings.Join([]string{
+			`data: {"type":"response.output_item.done","sequence_number":1,"item":{"type":"reasoning","id":"rs_1","summary":[],"encrypted_content":"ENC1"}}`,
+			"",
+			`data: {"type":"response.output_item.added","sequence_number":2,"item":{"type":"function_call","id":"fc_1","call_id":"call_w","name":"weather"}}`,
+			"",
+			`data: {"type":"response.output_item.done","sequence_number":3,"item":{"type":"function_call","id":"fc_1","call_id":"call_w","name":"weather","arguments":"{}"}}`,
+			"",
+			`data: {"type":"response.completed","sequence_number":4,"response":{}}`,
+			"",
+		}, "\n")
+	}}
+	s := newTestServer(upstream)
+
+	first := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"weather?"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, first)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	second := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[
+		{"role":"user","content":"weather?"},
+		{"role":"assistant","content":null,"tool_calls":[{"id":"call_w","type":"function","function":{"name":"weather","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_w","content":"sunny"}
+	]}`))
+	rec = httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, second)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.NotNil(t, secondBody)
+	input := secondBody["input"].([]interface{})
+	var types []string
+	for _, item := range input {
+		types = append(types, item.(map[string]interface{})["type"].(string))
+	}
+	require.Contains(t, types, "reasoning")
+	for i, typ := range types {
+		if typ == "reasoning" {
+			require.Less(t, i+1, len(types))
+			assert.Equal(t, "function_call", types[i+1])
+			reasoning := input[i].(map[string]interface{})
+			assert.Equal(t, "ENC1", reasoning["encrypted_content"])
+			assert.NotContains(t, reasoning, "id")
+		}
+	}
+}
+
+func TestReasoningStore_ScopesByTenantAndContext(t *testing.T) {
+	store := newReasoningStore(time.Minute, 10)
+	user := func(text string) map[string]interface{} {
+		return map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{map[string]interface{}{"type": "input_text", "text": text}}}
+	}
+	done := map[string]interface{}{"type": "message", "role": "assistant", "content": []interface{}{map[string]interface{}{"type": "output_text", "text": "Done."}}}
+	call := map[string]interface{}{"type": "function_call", "call_id": "call_1", "name": "f", "arguments": "{}"}
+
+	asKey := func(key string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		return r
+	}
+	rec := store.recorder(newReasoningScope(asKey("tenant-a"), []interface{}{user("rename the file")}))
+	rec.observe(map[string]interface{}{"type": "reasoning", "encrypted_content": "ENC_A"})
+	rec.observe(call)
+	rec.observe(map[string]interface{}{"type": "reasoning", "encrypted_content": "ENC_A2"})
+	rec.observe(done)
+
+	countReasoning := func(items []interface{}) int {
+		n := 0
+		for _, it := range items {
+			if it.(map[string]interface{})["type"] == "reasoning" {
+				n++
+			}
+		}
+		return n
+	}
+	tenantA := reasoningTenant(asKey("tenant-a"))
+	assert.Equal(t, 2, countReasoning(store.reinsert(tenantA, []interface{}{user("rename the file"), call, done})))
+	assert.Equal(t, 0, countReasoning(store.reinsert(reasoningTenant(asKey("tenant-b")), []interface{}{user("rename the file"), call, done})), "other API keys never see the reasoning")
+	assert.Equal(t, 1, countReasoning(store.reinsert(tenantA, []interface{}{user("delete the file"), call, done})), "the same reply to another message is a different turn")
+}
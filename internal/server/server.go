@@ -2,17 +2,21 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dvcrn/codex-proxy/internal/credentials"
+	"github.com/dvcrn/codex-proxy/internal/tokenizer"
 	"github.com/rs/zerolog"
 )
 
@@ -40,23 +44,104 @@ type Server struct {
 	httpClient   HTTPClient
 	mux          *http.ServeMux
 	logger       zerolog.Logger
+	// upstream locates the Codex backend; see upstream.go.
+	upstream UpstreamConfig
+	// refreshMu serializes token refreshes so concurrent upstream requests
+	// (e.g. n>1 fan-out) that all hit 401 only rotate the refresh token once.
+	refreshMu sync.Mutex
+	// reasoningStore replays encrypted reasoning across chat completions
+	// turns; nil when disabled.
+	reasoningStore *reasoningStore
+	// rateLimits holds the latest Codex usage snapshot per account.
+	rateLimits *rateLimitTracker
+	// nameRules rewrites client names in prompts; see name_rules.go.
+	nameRules *nameRulesConfig
+	// instructionProfiles frame chat and messages requests for Codex; see
+	// instruction_profiles.go.
+	instructionProfiles *instructionProfiles
+	// sessions derives upstream session ids and prompt cache keys.
+	sessions sessionConfig
+	// contextPolicy compacts requests that approach the context window.
+	contextPolicy contextPolicy
+	// modelCatalog refreshes the known models from the Codex backend; nil
+	// keeps the built-in tables.
+	modelCatalog *modelCatalog
+	// modelFallbacks lists the models to retry on when a model is over its
+	// usage limit or out of capacity.
+	modelFallbacks modelFallbacks
+	// upstreamTransports picks HTTP or WebSocket per model; see
+	// upstream_selector.go.
+	upstreamTransports upstreamTransports
+	// tokenizer counts prompt tokens; nil when the o200k vocabulary is not
+	// embedded, in which case counts are estimated.
+	tokenizer *tokenizer.Tokenizer
 }
 
-func New(logger zerolog.Logger, credsFetcher credentials.CredentialsFetcher) *Server {
+// New creates a server that sends requests to upstream. An invalid upstream
+// config is an error rather than a fallback to the ChatGPT backend, so a
+// misconfigured proxy never sends credentials somewhere unintended.
+func New(logger zerolog.Logger, credsFetcher credentials.CredentialsFetcher, upstream UpstreamConfig) (*Server, error) {
 	s := &Server{
 		credsFetcher: credsFetcher,
 		httpClient:   NewHTTPClient(),
 		mux:          http.NewServeMux(),
 		logger:       logger,
+
+		reasoningStore: newReasoningStoreFromEnv(),
+		rateLimits:     newRateLimitTracker(),
+		sessions:       newSessionConfigFromEnv(),
+		contextPolicy:  newContextPolicyFromEnv(),
+
+		upstreamTransports: newUpstreamTransportsFromEnv(),
+	}
+
+	nameRules, err := newNameRulesFromEnv()
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid name rules config, using defaults")
+		nameRules = defaultNameRulesConfig()
+	}
+	s.nameRules = nameRules
+
+	if err := s.SetUpstream(upstream); err != nil {
+		return nil, err
+	}
+
+	profiles, err := newInstructionProfilesFromEnv()
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid instruction profiles config, using defaults")
+		profiles = defaultInstructionProfiles()
+	}
+	s.instructionProfiles = profiles
+
+	catalog, err := newModelCatalogFromEnv()
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid model overrides, ignoring them")
+	}
+	s.modelCatalog = catalog
+
+	fallbacks, err := newModelFallbacksFromEnv()
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid model fallbacks, ignoring them")
+	}
+	s.modelFallbacks = fallbacks
+
+	tok, err := tokenizer.O200k()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Tokenizer unavailable, estimating token counts")
 	}
+	s.tokenizer = tok
+	s.contextPolicy.tokenizer = tok
 
 	s.setupRoutes()
-	return s
+	return s, nil
 }
 
 func (s *Server) setupRoutes() {
 	s.mux.HandleFunc("/v1/chat/completions", s.adminMiddleware(s.chatCompletionsHandler))
 	s.mux.HandleFunc("/v1/responses", s.adminMiddleware(s.responsesHandler))
+	s.mux.HandleFunc("/v1/responses/input_tokens", s.adminMiddleware(s.responsesInputTokensHandler))
+	s.mux.HandleFunc("/v1/messages", s.adminMiddleware(s.messagesHandler))
+	s.mux.HandleFunc("/v1/messages/count_tokens", s.adminMiddleware(s.messagesCountTokensHandler))
 	s.mux.HandleFunc("/v1/models", s.modelsHandler)
 	s.mux.HandleFunc("/health", s.healthHandler)
 	s.mux.HandleFunc("/admin/credentials", s.adminMiddleware(s.credentialsHandler))
@@ -103,6 +188,12 @@ func (s *Server) modelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The model list is public, so only authenticated callers may trigger an
+	// upstream fetch; everyone else gets the current tables.
+	if validAdminKey(requestAPIKey(r)) {
+		s.refreshModelCatalog()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	response := modelsResponse{
@@ -133,7 +224,7 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 	requestBodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error reading request body")
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to read request body"))
 		return
 	}
 	defer r.Body.Close()
@@ -142,10 +233,12 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 	var requestData map[string]interface{}
 	if err := json.Unmarshal(requestBodyBytes, &requestData); err != nil {
 		s.logger.Error().Err(err).Msg("Error unmarshalling request body")
-		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		writeAPIError(w, invalidRequestError("Failed to parse request body: "+err.Error()))
 		return
 	}
 
+	s.refreshModelCatalog()
+
 	// Determine whether the client requested streaming.
 	// OpenAI's default is non-streaming when "stream" is omitted, so
 	// we treat absence as false and only stream when explicitly true.
@@ -156,6 +249,21 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	choiceCount, err := requestedChoiceCount(requestData)
+	if err != nil {
+		writeAPIError(w, invalidRequestError(err.Error()))
+		return
+	}
+
+	// Codex ignores stop and max_tokens, so the proxy enforces them and
+	// cancels the upstream request once a limit is hit.
+	streamOpts := chatStreamOptionsFromRequest(requestData)
+	streamOpts.reasoningStore = s.reasoningStore
+	streamOpts.reasoningMode = resolveReasoningOutputMode(r, requestData)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	// Extract request parameters for logging
 	requestedModel := resolveRequestModel(requestData)
 	normalizedModel := normalizeModel(requestedModel)
@@ -170,7 +278,14 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 	logToolCallInteractions(s.logger, requestData)
 
 	// Build target body for ChatGPT Codex Responses
-	target := buildCodexRequestBody(requestData)
+	profile := s.instructionProfiles.forRequest(r, requestedModel)
+	target := buildCodexRequestBody(requestData, s.nameRules.forRequest(r), profile)
+	if input, ok := target["input"].([]interface{}); ok {
+		streamOpts.reasoningScope = newReasoningScope(r, input)
+		target["input"] = s.reasoningStore.reinsert(streamOpts.reasoningScope.tenant, input)
+	}
+	r = s.applySession(r, requestData, target)
+	s.compactContext(r, s.upstream.responsesURL(), target)
 
 	// Debug: log inbound and outbound (sanitized previews)
 	inboundPreview := string(requestBodyBytes)
@@ -206,13 +321,15 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 	modifiedBodyBytes, err := json.Marshal(target)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error marshalling modified request body")
-		http.Error(w, "Failed to prepare modified request", http.StatusInternalServerError)
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to prepare modified request"))
 		return
 	}
 
-	upstreamURL := "https://chatgpt.com/backend-api/codex/responses"
+	upstreamURL := s.upstream.responsesURL()
 
-	transport := upstreamTransportForModel(normalizedModel)
+	transport, _ := s.upstreamTransports.selectUpstreamTransport(r, normalizedModel)
+	inputTokens := countRequestTokens(s.tokenizer, target)
+	streamOpts.limits = streamOpts.limits.withTokenizer(s.tokenizer, inputTokens)
 
 	// Log request details
 	logEvent := s.logger.Info().
@@ -222,6 +339,9 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 		Str("requested_reasoning_effort", reasoningEffort).
 		Str("normalized_reasoning_effort", normalizedReasoningEffort).
 		Int("message_count", messageCount).
+		Int("n", choiceCount).
+		Int("input_tokens", inputTokens).
+		Str("instruction_profile", profile.name).
 		Str("user_agent", r.UserAgent()).
 		Str("endpoint", upstreamURL).
 		Str("prompt_cache_key", func() string {
@@ -233,35 +353,75 @@ func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request)
 
 	logEvent.Msg("Processing chat completion request")
 
+	// n>1: fan out one upstream request per choice and merge the results.
+	if choiceCount > 1 {
+		s.fanOutChatCompletions(w, r, upstreamURL, modifiedBodyBytes, normalizedModel, choiceCount, stream, requestData, streamOpts)
+		return
+	}
+
 	// Make upstream request with automatic retry on 401
 	responseData, statusCode, err := s.makeChatGPTRequestWithRetry(r, upstreamURL, modifiedBodyBytes, normalizedModel)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error making request to ChatGPT backend")
-		http.Error(w, "Failed to communicate with upstream API: "+err.Error(), http.StatusServiceUnavailable)
+		writeAPIError(w, upstreamRequestError(statusCode, err))
 		return
 	}
 
+	// Report the model that actually served the request, which differs from
+	// the requested one after a fallback.
+	servedModel := servedModel(responseData, normalizedModel)
+
 	// If the client requested streaming, reuse the existing SSE rewriting path.
 	if stream {
-		s.writeResponse(w, responseData, statusCode, normalizedModel, true)
+		s.writeResponse(w, responseData, statusCode, servedModel, true, streamOpts)
 		return
 	}
 
 	// Non-streaming path: buffer the upstream SSE stream and synthesize a single
 	// chat completion response for clients that expect the classic JSON shape.
 	if statusCode != http.StatusOK {
-		s.writeResponse(w, responseData, statusCode, normalizedModel, false)
+		s.writeResponse(w, responseData, statusCode, servedModel, false, streamOpts)
 		return
 	}
 
 	defer responseData.Body.Close()
-	respObj, err := bufferChatCompletionFromSSE(responseData.Body, normalizedModel)
+	setRateLimitHeaders(w.Header(), responseData.Header)
+	setServedModelHeader(w.Header(), responseData.Header)
+	respObj, err := bufferChatCompletionFromSSE(responseData.Body, servedModel, streamOpts)
+	var failed *completionError
+	if errors.As(err, &failed) {
+		s.logger.Warn().Err(err).Int("status", failed.Status).Msg("Upstream response failed mid-stream")
+		writeAPIError(w, failed.apiError)
+		return
+	}
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error buffering SSE stream for non-streaming client")
-		http.Error(w, "Failed to process streaming response", http.StatusInternalServerError)
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to process streaming response"))
 		return
 	}
 
+	s.writeBufferedChatCompletion(w, respObj, requestData)
+}
+
+// writeBufferedChatCompletion writes a non-streaming chat completion, applying
+// the optional response_format validation to every choice first. Only choices
+// that finished normally with content are checked: tool calls, refusals and
+// output cut short by max_tokens are returned as they are.
+func (s *Server) writeBufferedChatCompletion(w http.ResponseWriter, respObj *ChatCompletionResponse, requestData map[string]interface{}) {
+	if structuredOutputValidationEnabled() {
+		for _, choice := range respObj.Choices {
+			if len(choice.Message.ToolCalls) > 0 || choice.Message.FunctionCall != nil ||
+				choice.Message.Refusal != "" || choice.FinishReason != "stop" {
+				continue
+			}
+			if err := validateStructuredOutput(requestData, stripThinkBlock(choice.Message.Content)); err != nil {
+				s.logger.Warn().Err(err).Int("choice_index", choice.Index).Msg("Model output failed response_format validation")
+				writeAPIError(w, internalError(http.StatusBadGateway, "Model output does not match the requested response_format: "+err.Error()))
+				return
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(respObj); err != nil {
@@ -278,7 +438,7 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 	requestBodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error reading request body")
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to read request body"))
 		return
 	}
 	defer r.Body.Close()
@@ -286,10 +446,12 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 	var requestData map[string]interface{}
 	if err := json.Unmarshal(requestBodyBytes, &requestData); err != nil {
 		s.logger.Error().Err(err).Msg("Error unmarshalling request body")
-		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		writeAPIError(w, invalidRequestError("Failed to parse request body: "+err.Error()))
 		return
 	}
 
+	s.refreshModelCatalog()
+
 	requestedModel := resolveRequestModel(requestData)
 	requestedEffort := resolveReasoningEffort(requestData)
 	inputCount := 0
@@ -297,14 +459,23 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 		inputCount = len(input)
 	}
 
+	// max_output_tokens is stripped for upstream and enforced by the proxy,
+	// which cancels the upstream request once the budget is spent.
+	limits := responsesOutputLimits(requestData)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	// Transform request body
-	normalizedModel, normalizedEffort := transformResponsesRequestBody(requestData, requestedModel, requestedEffort)
+	normalizedModel, normalizedEffort := transformResponsesRequestBody(requestData, requestedModel, requestedEffort, s.nameRules.forRequest(r))
+	r = s.applySession(r, requestData, requestData)
+	s.compactContext(r, s.upstream.responsesURL(), requestData)
 	cacheKey, _ := requestData["prompt_cache_key"].(string)
 
 	modifiedBodyBytes, err := json.Marshal(requestData)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error marshalling modified request body")
-		http.Error(w, "Failed to prepare modified request", http.StatusInternalServerError)
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to prepare modified request"))
 		return
 	}
 
@@ -334,8 +505,10 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 		Int("input_count", inputCount).
 		Msg("Responses transform debug: body previews")
 
-	upstreamURL := "https://chatgpt.com/backend-api/codex/responses"
-	transport := upstreamTransportForModel(normalizedModel)
+	upstreamURL := s.upstream.responsesURL()
+	transport, _ := s.upstreamTransports.selectUpstreamTransport(r, normalizedModel)
+	inputTokens := countRequestTokens(s.tokenizer, requestData)
+	limits = limits.withTokenizer(s.tokenizer, inputTokens)
 	logEvent := s.logger.Info().
 		Str("requested_model", requestedModel).
 		Str("normalized_model", normalizedModel).
@@ -344,6 +517,7 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 		Str("normalized_reasoning_effort", normalizedEffort).
 		Str("prompt_cache_key", cacheKey).
 		Int("input_count", inputCount).
+		Int("input_tokens", inputTokens).
 		Str("user_agent", r.UserAgent()).
 		Str("endpoint", upstreamURL)
 	logEvent.Msg("Processing responses request")
@@ -351,7 +525,7 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 	responseData, statusCode, err := s.makeChatGPTRequestWithRetry(r, upstreamURL, modifiedBodyBytes, normalizedModel)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error making request to ChatGPT backend")
-		http.Error(w, "Failed to communicate with upstream API: "+err.Error(), http.StatusServiceUnavailable)
+		writeAPIError(w, upstreamRequestError(statusCode, err))
 		return
 	}
 
@@ -378,7 +552,222 @@ func (s *Server) responsesHandler(w http.ResponseWriter, r *http.Request) {
 			Msg("Upstream error encountered for responses request")
 	}
 
-	s.writeResponse(w, responseData, statusCode, normalizedModel, false)
+	s.writeResponse(w, responseData, statusCode, servedModel(responseData, normalizedModel), false, chatStreamOptions{limits: limits})
+}
+
+// messagesHandler serves the Anthropic Messages API (POST /v1/messages) by
+// translating the request into the chat completions shape and reusing the
+// Codex request builder.
+func (s *Server) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error reading request body")
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var requestData map[string]interface{}
+	if err := json.Unmarshal(requestBodyBytes, &requestData); err != nil {
+		s.logger.Error().Err(err).Msg("Error unmarshalling request body")
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Failed to parse request body")
+		return
+	}
+
+	s.refreshModelCatalog()
+
+	target, chatRequest, profile, err := s.anthropicCodexBody(r, requestData)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error translating Anthropic request")
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	requestedModel := resolveRequestModel(chatRequest)
+	normalizedModel := normalizeModel(requestedModel)
+	reasoningEffort := resolveReasoningEffort(chatRequest)
+
+	// max_tokens and stop_sequences are not sent upstream; the proxy enforces
+	// them and cancels the upstream request once one is hit.
+	limits := chatOutputLimits(chatRequest)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	r = s.applySession(r, requestData, target)
+	s.compactContext(r, s.upstream.responsesURL(), target)
+	modifiedBodyBytes, err := json.Marshal(target)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error marshalling modified request body")
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Failed to prepare modified request")
+		return
+	}
+
+	inputCount := 0
+	if in, ok := target["input"].([]interface{}); ok {
+		inputCount = len(in)
+	}
+	inboundPreview := string(requestBodyBytes)
+	if len(inboundPreview) > 1200 {
+		inboundPreview = inboundPreview[:1200] + "…(truncated)"
+	}
+	outboundPreview := string(modifiedBodyBytes)
+	if len(outboundPreview) > 1200 {
+		outboundPreview = outboundPreview[:1200] + "…(truncated)"
+	}
+	s.logger.Debug().
+		Str("inbound_body_preview", inboundPreview).
+		Str("outbound_body_preview", outboundPreview).
+		Int("input_count", inputCount).
+		Msg("Messages transform debug: body previews")
+
+	upstreamURL := s.upstream.responsesURL()
+	transport, _ := s.upstreamTransports.selectUpstreamTransport(r, normalizedModel)
+	inputTokens := countRequestTokens(s.tokenizer, target)
+	limits = limits.withTokenizer(s.tokenizer, inputTokens)
+	s.logger.Info().
+		Str("requested_model", requestedModel).
+		Str("normalized_model", normalizedModel).
+		Str("upstream_transport", transport).
+		Str("requested_reasoning_effort", reasoningEffort).
+		Int("input_count", inputCount).
+		Int("input_tokens", inputTokens).
+		Str("instruction_profile", profile.name).
+		Str("user_agent", r.UserAgent()).
+		Str("endpoint", upstreamURL).
+		Msg("Processing messages request")
+
+	responseData, statusCode, err := s.makeChatGPTRequestWithRetry(r, upstreamURL, modifiedBodyBytes, normalizedModel)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error making request to ChatGPT backend")
+		writeAnthropicAPIError(w, upstreamRequestError(statusCode, err))
+		return
+	}
+	defer responseData.Body.Close()
+	setRateLimitHeaders(w.Header(), responseData.Header)
+	setServedModelHeader(w.Header(), responseData.Header)
+	servedModel := servedModel(responseData, normalizedModel)
+
+	if statusCode != http.StatusOK {
+		preview := previewResponseBody(responseData)
+		s.logger.Warn().
+			Int("status_code", statusCode).
+			Str("response_body_preview", preview).
+			Msg("Upstream error encountered for messages request")
+		responseBody, _ := io.ReadAll(responseData.Body)
+		writeAnthropicAPIError(w, translateUpstreamError(statusCode, responseData.Header, responseBody))
+		return
+	}
+
+	if stream, _ := requestData["stream"].(bool); stream {
+		s.streamAnthropicResponse(w, responseData, servedModel, limits)
+		return
+	}
+
+	msg, err := bufferAnthropicMessageFromSSE(responseData.Body, servedModel, limits)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error buffering SSE stream for messages client")
+		writeAnthropicError(w, http.StatusBadGateway, "api_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		s.logger.Error().Err(err).Msg("Error encoding messages response")
+	}
+}
+
+// anthropicCodexBody builds the Codex request body for an Anthropic Messages
+// request, returning it with the intermediate chat request and the
+// instruction profile used.
+func (s *Server) anthropicCodexBody(r *http.Request, requestData map[string]interface{}) (map[string]interface{}, map[string]interface{}, *instructionProfile, error) {
+	chatRequest, err := anthropicToChatRequest(requestData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	profile := s.instructionProfiles.forRequest(r, resolveRequestModel(chatRequest))
+	return buildCodexRequestBody(chatRequest, s.nameRules.forRequest(r), profile), chatRequest, profile, nil
+}
+
+// streamAnthropicResponse rewrites a successful upstream Codex stream into
+// Anthropic Messages streaming events, enforcing limits.
+func (s *Server) streamAnthropicResponse(w http.ResponseWriter, resp *http.Response, model string, limits outputLimits) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	var out io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+		out = sseFlushWriter{w: w, f: flusher}
+	} else {
+		s.logger.Warn().Msg("ResponseWriter does not support flushing - streaming may be buffered")
+	}
+
+	chunkCount := 0
+	streamStart := time.Now()
+	debugFn := func(raw []byte, transformed []byte, done bool) {
+		logReasoningEvent(s.logger, raw)
+		if done {
+			s.logger.Debug().
+				Int("chunks", chunkCount).
+				Dur("elapsed", time.Since(streamStart)).
+				Msg("Streaming messages response completed")
+			return
+		}
+		chunkCount++
+	}
+
+	if err := RewriteAnthropicSSEStreamWithLimits(resp.Body, out, model, limits, debugFn); err != nil {
+		s.logger.Error().Err(err).Msg("Error rewriting SSE stream to Anthropic events")
+	}
+}
+
+// writeAnthropicAPIError writes a translated error in the Anthropic shape.
+func writeAnthropicAPIError(w http.ResponseWriter, e apiError) {
+	setRetryAfter(w, e.RetryAfter)
+	writeAnthropicError(w, e.Status, anthropicErrorType(e.Status), e.Message)
+}
+
+// writeAnthropicError writes an error body in the Anthropic Messages API shape.
+func writeAnthropicError(w http.ResponseWriter, statusCode int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+func anthropicErrorType(statusCode int) string {
+	switch {
+	case statusCode == http.StatusBadRequest:
+		return "invalid_request_error"
+	case statusCode == http.StatusUnauthorized:
+		return "authentication_error"
+	case statusCode == http.StatusForbidden:
+		return "permission_error"
+	case statusCode == http.StatusNotFound:
+		return "not_found_error"
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case statusCode == http.StatusServiceUnavailable || statusCode == 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
 }
 
 func previewResponseBody(resp *http.Response) string {
@@ -450,17 +839,17 @@ func (s *Server) makeChatGPTRequest(r *http.Request, url string, body []byte, to
 
 	// Set headers for ChatGPT backend
 	proxyReq.Header.Set("authorization", "Bearer "+bareToken)
-	proxyReq.Header.Set("version", "0.125.0")
+	proxyReq.Header.Set("version", codexClientVersion)
 	proxyReq.Header.Set("openai-beta", "responses=experimental")
-	proxyReq.Header.Set("session_id", newUUIDv4())
+	session := upstreamSessionFromContext(r.Context())
+	proxyReq.Header.Set("session_id", session.id)
 	proxyReq.Header.Set("accept", "text/event-stream")
 	proxyReq.Header.Set("content-type", "application/json")
 	proxyReq.Header.Set("chatgpt-account-id", accountID)
 	proxyReq.Header.Set("originator", "codex_cli_rs")
-	proxyReq.Header.Set("user-agent", "codex_cli_rs/0.125.0 (Mac OS 26.3.0; arm64) Apple_Terminal/466")
+	proxyReq.Header.Set("user-agent", "codex_cli_rs/"+codexClientVersion+" (Mac OS 26.3.0; arm64) Apple_Terminal/466")
 	proxyReq.Header.Set("x-codex-beta-features", "multi_agent,apps,prevent_idle_sleep")
-	// The CLI uses turn_id, so let's mock one
-	proxyReq.Header.Set("x-codex-turn-metadata", `{"turn_id":"`+newUUIDv4()+`","sandbox":"none"}`)
+	proxyReq.Header.Set("x-codex-turn-metadata", `{"turn_id":"`+session.turnID+`","sandbox":"none"}`)
 
 	// Log outbound header summary (sanitized)
 	s.logger.Info().
@@ -484,16 +873,50 @@ func (s *Server) makeChatGPTRequest(r *http.Request, url string, body []byte, to
 }
 
 // makeChatGPTRequestWithRetry makes an upstream request with automatic retry on 401 errors.
+// When the model is over its usage limit or out of capacity, the request is
+// retried on the next model of its fallback chain; the returned response names
+// the model that served it in servedModelHeader.
 func (s *Server) makeChatGPTRequestWithRetry(r *http.Request, url string, body []byte, normalizedModel string) (*http.Response, int, error) {
+	models := s.modelFallbacks.chain(normalizedModel)
+	for i, model := range models {
+		attemptBody := body
+		if i > 0 {
+			var err error
+			if attemptBody, err = withFallbackModel(body, model); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		resp, statusCode, err := s.makeChatGPTRequestWithRefresh(r, url, attemptBody, model)
+		if err != nil || i == len(models)-1 || !shouldFallBack(resp, statusCode) {
+			if resp != nil {
+				resp.Header.Set(servedModelHeader, model)
+			}
+			return resp, statusCode, err
+		}
+
+		s.logger.Warn().
+			Int("status_code", statusCode).
+			Str("model", model).
+			Str("fallback_model", models[i+1]).
+			Msg("Model unavailable upstream, falling back")
+		resp.Body.Close()
+	}
+	return nil, 0, errors.New("no upstream model to try")
+}
+
+// makeChatGPTRequestWithRefresh makes an upstream request for one model,
+// refreshing the credentials and retrying once on 401.
+func (s *Server) makeChatGPTRequestWithRefresh(r *http.Request, url string, body []byte, normalizedModel string) (*http.Response, int, error) {
 	makeRequest := s.makeChatGPTRequest
-	if shouldUseWebSocketUpstream(normalizedModel) {
-		makeRequest = s.makeChatGPTWebSocketRequest
+	if s.upstreamTransportForModel(r, normalizedModel) == upstreamTransportWebSocket {
+		makeRequest = s.makeChatGPTRequestOverWebSocket
 	}
 
 	// Get initial credentials
 	token, accountID, err := s.credsFetcher.GetCredentials()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get credentials: %w", err)
+		return nil, 0, &credentialsError{msg: "failed to get credentials", err: err}
 	}
 
 	// Make the first request
@@ -501,6 +924,7 @@ func (s *Server) makeChatGPTRequestWithRetry(r *http.Request, url string, body [
 	if err != nil {
 		return nil, 0, err
 	}
+	s.rateLimits.observe(accountID, resp.Header)
 
 	// If not a 401 error, return the response as-is
 	if statusCode != http.StatusUnauthorized {
@@ -513,20 +937,25 @@ func (s *Server) makeChatGPTRequestWithRetry(r *http.Request, url string, body [
 	// Close the first response body since we're going to retry
 	resp.Body.Close()
 
-	// Attempt to refresh credentials
-	err = s.credsFetcher.RefreshCredentials()
-	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to refresh credentials after 401 error")
-		// Return a 401 response since we couldn't refresh
-		return nil, http.StatusUnauthorized, fmt.Errorf("token expired and refresh failed: %w", err)
-	}
-
-	s.logger.Info().Msg("Successfully refreshed credentials, retrying request...")
-
-	// Get the new credentials
+	// Attempt to refresh credentials, unless a concurrent request already did.
+	staleToken := token
+	s.refreshMu.Lock()
 	token, accountID, err = s.credsFetcher.GetCredentials()
+	if err == nil && token == staleToken {
+		if err = s.credsFetcher.RefreshCredentials(); err != nil {
+			s.refreshMu.Unlock()
+			s.logger.Error().Err(err).Msg("Failed to refresh credentials after 401 error")
+			// Return a 401 response since we couldn't refresh
+			return nil, http.StatusUnauthorized, fmt.Errorf("token expired and refresh failed: %w", err)
+		}
+		s.logger.Info().Msg("Successfully refreshed credentials, retrying request...")
+
+		// Get the new credentials
+		token, accountID, err = s.credsFetcher.GetCredentials()
+	}
+	s.refreshMu.Unlock()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get refreshed credentials: %w", err)
+		return nil, 0, &credentialsError{msg: "failed to get refreshed credentials", err: err}
 	}
 
 	// Retry the request with new credentials
@@ -534,6 +963,7 @@ func (s *Server) makeChatGPTRequestWithRetry(r *http.Request, url string, body [
 	if err != nil {
 		return nil, 0, fmt.Errorf("retry request failed: %w", err)
 	}
+	s.rateLimits.observe(accountID, resp.Header)
 
 	if statusCode == http.StatusUnauthorized {
 		s.logger.Error().Msg("Still received 401 after token refresh, giving up")
@@ -544,7 +974,19 @@ func (s *Server) makeChatGPTRequestWithRetry(r *http.Request, url string, body [
 	return resp, statusCode, nil
 }
 
-func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, statusCode int, model string, convertSSE bool) {
+// makeChatGPTRequestOverWebSocket makes an upstream request over the
+// WebSocket transport, retrying over HTTP when the handshake fails.
+func (s *Server) makeChatGPTRequestOverWebSocket(r *http.Request, url string, body []byte, token, accountID string) (*http.Response, int, error) {
+	resp, statusCode, err := s.makeChatGPTWebSocketRequest(r, url, body, token, accountID)
+	var handshakeErr *websocketHandshakeError
+	if errors.As(err, &handshakeErr) {
+		s.logger.Warn().Err(err).Msg("Websocket upstream unavailable, falling back to HTTP")
+		return s.makeChatGPTRequest(r, url, body, token, accountID)
+	}
+	return resp, statusCode, err
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, statusCode int, model string, convertSSE bool, opts chatStreamOptions) {
 	defer resp.Body.Close()
 
 	// Log the response from upstream
@@ -561,21 +1003,11 @@ func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, statu
 				Msg("Received error response from upstream API")
 		}
 
-		// Copy headers from Anthropic's response to our response
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
-
-		// Set the status code from Anthropic's response
-		w.WriteHeader(statusCode)
-
-		// Write the error response body
-		_, err = w.Write(responseBody)
-		if err != nil {
-			s.logger.Error().Err(err).Msg("Error writing error response body to client")
-		}
+		// Translate the Codex error into the OpenAI error schema so SDKs can
+		// parse it and honor Retry-After.
+		setRateLimitHeaders(w.Header(), resp.Header)
+		setServedModelHeader(w.Header(), resp.Header)
+		writeAPIError(w, translateUpstreamError(statusCode, resp.Header, responseBody))
 	} else {
 		// For successful responses, just log basic info
 		rawContentType := resp.Header.Get("Content-Type")
@@ -596,6 +1028,8 @@ func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, statu
 			}
 		}
 
+		setRateLimitHeaders(w.Header(), resp.Header)
+
 		// Detect streaming responses (handle charset variations)
 		isStreaming := mediaType == "text/event-stream"
 		if isStreaming {
@@ -643,12 +1077,12 @@ func (s *Server) writeResponse(w http.ResponseWriter, resp *http.Response, statu
 		}
 
 		if convertSSE {
-			if err := RewriteSSEStreamWithCallback(resp.Body, out, model, debugFn); err != nil {
+			if err := RewriteSSEStreamWithOptions(resp.Body, out, model, opts, debugFn); err != nil {
 				s.logger.Error().Err(err).Msg(fmt.Sprintf("Error rewriting SSE stream: %v", err))
 				return
 			}
 		} else {
-			if err := PassThroughSSEStream(resp.Body, out); err != nil {
+			if err := PassThroughSSEStreamWithLimits(resp.Body, out, opts.limits); err != nil {
 				s.logger.Error().Err(err).Msg(fmt.Sprintf("Error streaming SSE response: %v", err))
 				return
 			}
@@ -955,6 +1389,7 @@ func (s *Server) credentialsStatusHandler(w http.ResponseWriter, r *http.Request
 		} else {
 			response["error"] = err.Error()
 		}
+		response["rateLimits"] = s.rateLimits.snapshots()
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
@@ -969,6 +1404,7 @@ func (s *Server) credentialsStatusHandler(w http.ResponseWriter, r *http.Request
 			"type":           "oauth",
 			"hasCredentials": false,
 			"error":          err.Error(),
+			"rateLimits":     s.rateLimits.snapshots(),
 		})
 		return
 	}
@@ -985,6 +1421,7 @@ func (s *Server) credentialsStatusHandler(w http.ResponseWriter, r *http.Request
 		"minutesUntilExpiry": minutesUntilExpiry,
 		"isExpired":          minutesUntilExpiry <= 0,
 		"needsRefreshSoon":   minutesUntilExpiry <= 60, // Within 60 minute buffer
+		"rateLimits":         s.rateLimits.snapshots(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Each upstream request carries a session: its id is sent as the session_id
+// header and as prompt_cache_key, so Codex routes requests of one
+// conversation to the same prompt cache. The id comes from the first
+// SESSION_STRATEGY that yields one:
+//
+//	client  an id supplied by the client: prompt_cache_key, the X-Session-Id
+//	        header, metadata.conversation_id or user
+//	prefix  a hash of the model, instructions and conversation up to the
+//	        first user message
+//	random  a fresh id per request (disables prompt caching)
+//
+// The default is "client,prefix". Unless SESSION_SALT is "none", ids are
+// salted with the proxy API key so tenants never share a cache entry.
+
+const (
+	sessionStrategyClient = "client"
+	sessionStrategyPrefix = "prefix"
+	sessionStrategyRandom = "random"
+
+	sessionIDHeader = "X-Session-Id"
+)
+
+// upstreamSession identifies the conversation and turn of an upstream request.
+type upstreamSession struct {
+	id     string
+	turnID string
+}
+
+// newUpstreamSession returns a random session for a request that belongs to
+// no client conversation.
+func newUpstreamSession() upstreamSession {
+	return upstreamSession{id: newUUIDv4(), turnID: newUUIDv4()}
+}
+
+type sessionContextKey struct{}
+
+func withUpstreamSession(ctx context.Context, session upstreamSession) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+// upstreamSessionFromContext returns the request's session, or a random one
+// for requests that did not resolve a session.
+func upstreamSessionFromContext(ctx context.Context) upstreamSession {
+	if session, ok := ctx.Value(sessionContextKey{}).(upstreamSession); ok {
+		return session
+	}
+	return newUpstreamSession()
+}
+
+// sessionConfig is the SESSION_STRATEGY / SESSION_SALT configuration.
+type sessionConfig struct {
+	strategies []string
+	saltByKey  bool
+}
+
+func newSessionConfigFromEnv() sessionConfig {
+	cfg := sessionConfig{saltByKey: true}
+	for _, s := range strings.Split(env.GetOrDefault("SESSION_STRATEGY", "client,prefix"), ",") {
+		switch s = strings.ToLower(strings.TrimSpace(s)); s {
+		case sessionStrategyClient, sessionStrategyPrefix, sessionStrategyRandom:
+			cfg.strategies = append(cfg.strategies, s)
+		}
+	}
+	if len(cfg.strategies) == 0 {
+		cfg.strategies = []string{sessionStrategyClient, sessionStrategyPrefix}
+	}
+	if v := strings.ToLower(strings.TrimSpace(env.GetOrDefault("SESSION_SALT", ""))); v == "none" || v == "off" || v == "false" {
+		cfg.saltByKey = false
+	}
+	return cfg
+}
+
+// resolve picks the session for a request. requestData is the client's body
+// and body the Codex request built from it.
+func (c sessionConfig) resolve(r *http.Request, requestData, body map[string]interface{}) upstreamSession {
+	salt := ""
+	if c.saltByKey {
+		salt = requestAPIKey(r)
+	}
+	for _, strategy := range c.strategies {
+		var seed string
+		switch strategy {
+		case sessionStrategyClient:
+			if id := clientSessionID(r, requestData); id != "" {
+				seed = "client\n" + id
+			}
+		case sessionStrategyPrefix:
+			if prefix := conversationPrefix(body); prefix != "" {
+				model, _ := body["model"].(string)
+				seed = "prefix\n" + model + "\n" + prefix
+			}
+		case sessionStrategyRandom:
+			return upstreamSession{id: newUUIDv4(), turnID: newUUIDv4()}
+		}
+		if seed == "" {
+			continue
+		}
+		id := hashUUID(salt + "\n" + seed)
+		// A turn is identified by how many user messages precede it, so a
+		// retried turn keeps its turn_id.
+		turn := hashUUID(id + "\n" + strconv.Itoa(countUserMessages(body)))
+		return upstreamSession{id: id, turnID: turn}
+	}
+	return upstreamSession{id: newUUIDv4(), turnID: newUUIDv4()}
+}
+
+// clientSessionID returns a conversation id supplied by the client.
+func clientSessionID(r *http.Request, requestData map[string]interface{}) string {
+	if key, ok := requestData["prompt_cache_key"].(string); ok && strings.TrimSpace(key) != "" {
+		return strings.TrimSpace(key)
+	}
+	if id := strings.TrimSpace(r.Header.Get(sessionIDHeader)); id != "" {
+		return id
+	}
+	if metadata, ok := requestData["metadata"].(map[string]interface{}); ok {
+		if id, ok := metadata["conversation_id"].(string); ok && strings.TrimSpace(id) != "" {
+			return strings.TrimSpace(id)
+		}
+	}
+	if user, ok := requestData["user"].(string); ok && strings.TrimSpace(user) != "" {
+		return strings.TrimSpace(user)
+	}
+	return ""
+}
+
+// conversationPrefix returns the instructions and the text of every input
+// message up to and including the first user message.
+func conversationPrefix(body map[string]interface{}) string {
+	var parts []string
+	if instructions, _ := body["instructions"].(string); strings.TrimSpace(instructions) != "" {
+		parts = append(parts, strings.TrimSpace(instructions))
+	}
+	input, _ := body["input"].([]interface{})
+	sawUser := false
+	for _, item := range input {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := m["role"].(string)
+		if role == "" {
+			continue
+		}
+		if text := messageText(m["content"]); text != "" {
+			parts = append(parts, role+": "+text)
+		}
+		if role == "user" {
+			sawUser = true
+			break
+		}
+	}
+	if !sawUser {
+		return ""
+	}
+	return strings.Join(parts, "\n")
+}
+
+// messageText joins the text parts of a Responses message content value.
+func messageText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case []interface{}:
+		var texts []string
+		for _, part := range v {
+			if pm, ok := part.(map[string]interface{}); ok {
+				if text, _ := pm["text"].(string); strings.TrimSpace(text) != "" {
+					texts = append(texts, strings.TrimSpace(text))
+				}
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
+
+func countUserMessages(body map[string]interface{}) int {
+	input, _ := body["input"].([]interface{})
+	n := 0
+	for _, item := range input {
+		if m, ok := item.(map[string]interface{}); ok {
+			if role, _ := m["role"].(string); role == "user" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// hashUUID derives a stable UUID-shaped id from seed.
+func hashUUID(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	b := make([]byte, 16)
+	copy(b, sum[:16])
+	b[6] = (b[6] & 0x0f) | 0x50 // set version 5
+	b[8] = (b[8] & 0x3f) | 0x80 // set variant 10
+	return formatUUID(b)
+}
+
+// applySession resolves the upstream session for r, uses it as the body's
+// prompt_cache_key and attaches it to the returned request's context.
+func (s *Server) applySession(r *http.Request, requestData, body map[string]interface{}) *http.Request {
+	session := s.sessions.resolve(r, requestData, body)
+	body["prompt_cache_key"] = session.id
+	return r.WithContext(withUpstreamSession(r.Context(), session))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chatBody(system string, turns ...string) map[string]interface{} {
+	msgs := []interface{}{map[string]interface{}{"role": "system", "content": system}}
+	for i, text := range turns {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		msgs = append(msgs, map[string]interface{}{"role": role, "content": text})
+	}
+	return map[string]interface{}{"model": "gpt-5", "messages": msgs}
+}
+
+func resolveSession(cfg sessionConfig, apiKey string, headers map[string]string, requestData map[string]interface{}) upstreamSession {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if apiKey != "" {
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return cfg.resolve(r, requestData, buildCodexRequestBody(requestData, nil, nil))
+}
+
+func TestSessionPrefixStrategy(t *testing.T) {
+	cfg := sessionConfig{strategies: []string{sessionStrategyPrefix}, saltByKey: true}
+
+	first := resolveSession(cfg, "key-a", nil, chatBody("You review Go.", "hi"))
+	next := resolveSession(cfg, "key-a", nil, chatBody("You review Go.", "hi", "hello", "thanks"))
+	assert.Equal(t, first.id, next.id, "a conversation keeps its session")
+	assert.NotEqual(t, first.turnID, next.turnID, "each turn gets its own turn_id")
+	assert.Equal(t, first, resolveSession(cfg, "key-a", nil, chatBody("You review Go.", "hi")), "retries keep the turn_id")
+
+	assert.NotEqual(t, first.id, resolveSession(cfg, "key-a", nil, chatBody("You write SQL.", "hi")).id)
+	assert.NotEqual(t, first.id, resolveSession(cfg, "key-b", nil, chatBody("You review Go.", "hi")).id, "tenants are isolated")
+
+	cfg.saltByKey = false
+	assert.Equal(t,
+		resolveSession(cfg, "key-a", nil, chatBody("You review Go.", "hi")).id,
+		resolveSession(cfg, "key-b", nil, chatBody("You review Go.", "hi")).id)
+}
+
+func TestSessionClientStrategy(t *testing.T) {
+	cfg := sessionConfig{strategies: []string{sessionStrategyClient, sessionStrategyPrefix}, saltByKey: true}
+
+	a := resolveSession(cfg, "", map[string]string{sessionIDHeader: "conv-1"}, chatBody("sys", "hi"))
+	b := resolveSession(cfg, "", map[string]string{sessionIDHeader: "conv-2"}, chatBody("sys", "hi"))
+	assert.NotEqual(t, a.id, b.id, "conversations with the same opening stay apart")
+
+	withMetadata := chatBody("sys", "other opening")
+	withMetadata["metadata"] = map[string]interface{}{"conversation_id": "conv-1"}
+	assert.Equal(t, a.id, resolveSession(cfg, "", nil, withMetadata).id)
+
+	withUser := chatBody("sys", "hi")
+	withUser["user"] = "conv-1"
+	assert.Equal(t, a.id, resolveSession(cfg, "", nil, withUser).id)
+
+	fallback := resolveSession(cfg, "", nil, chatBody("sys", "hi"))
+	assert.NotEqual(t, a.id, fallback.id)
+	assert.Equal(t, fallback.id, resolveSession(cfg, "", nil, chatBody("sys", "hi")).id)
+}
+
+func TestSessionDrivesUpstreamHeadersAndCacheKey(t *testing.T) {
+	var sessionHeader, turnMetadata, cacheKey string
+	s := newTestServer(&fakeUpstream{respond: func(_ int, req *http.Request) (int, string) {
+		sessionHeader = req.Header.Get("session_id")
+		turnMetadata = req.Header.Get("x-codex-turn-metadata")
+		var body map[string]interface{}
+		b, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(b, &body)
+		cacheKey, _ = body["prompt_cache_key"].(string)
+		return http.StatusOK, textSSE("ok", 1, 1)
+	}})
+
+	send := func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set(sessionIDHeader, "conv-42")
+		rec := httptest.NewRecorder()
+		s.chatCompletionsHandler(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	send()
+	require.NotEmpty(t, sessionHeader)
+	assert.Equal(t, sessionHeader, cacheKey)
+	assert.Contains(t, turnMetadata, `"turn_id":"`)
+
+	firstSession := sessionHeader
+	send()
+	assert.Equal(t, firstSession, sessionHeader)
+}
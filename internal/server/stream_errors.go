@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// completionError is an upstream failure reported inside the event stream
+// (response.failed or an error event) after the HTTP response already
+// started with 200. Buffered chat completions surface it as a non-200
+// response carrying the OpenAI error object.
+type completionError struct {
+	apiError
+}
+
+func (e *completionError) Error() string {
+	return fmt.Sprintf("upstream response failed: %s", e.Message)
+}
+
+// streamError extracts the error from a response.failed or error event.
+func streamError(eventType string, upstream map[string]interface{}) apiError {
+	src := upstream
+	if eventType == "response.failed" {
+		resp, _ := upstream["response"].(map[string]interface{})
+		src, _ = resp["error"].(map[string]interface{})
+	} else if nested, ok := upstream["error"].(map[string]interface{}); ok {
+		src = nested
+	}
+	message, _ := src["message"].(string)
+	code, _ := src["code"].(string)
+	return streamErrorFromFields(message, code, src["param"])
+}
+
+// streamErrorFromObject rebuilds an apiError from an in-stream error object.
+func streamErrorFromObject(obj map[string]interface{}) apiError {
+	message, _ := obj["message"].(string)
+	code, _ := obj["code"].(string)
+	return streamErrorFromFields(message, code, obj["param"])
+}
+
+func streamErrorFromFields(message, code string, param interface{}) apiError {
+	if message == "" {
+		message = "The upstream response failed"
+	}
+	e := apiError{
+		Status:  http.StatusBadGateway,
+		Message: message,
+		Type:    "server_error",
+		Code:    code,
+		Param:   param,
+	}
+	if status, typ, ok := codexErrorClass(code); ok {
+		e.Status, e.Type = status, typ
+	}
+	return e
+}
+
+// incompleteFinishReason maps response.incomplete_details.reason onto a chat
+// completions finish_reason.
+func incompleteFinishReason(upstream map[string]interface{}) string {
+	resp, _ := upstream["response"].(map[string]interface{})
+	details, _ := resp["incomplete_details"].(map[string]interface{})
+	if reason, _ := details["reason"].(string); reason == "content_filter" {
+		return "content_filter"
+	}
+	return "length"
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const failedSSE = `data: {"type":"response.output_text.delta","sequence_number":1,"delta":"Partial"}
+
+data: {"type":"response.failed","sequence_number":2,"response":{"status":"failed","error":{"code":"rate_limit_exceeded","message":"Slow down"}}}
+
+`
+
+func TestRewriteSSEStream_FailedResponseEmitsError(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(failedSSE), &out, "gpt-5", chatStreamOptions{}, nil))
+
+	body := out.String()
+	assert.Contains(t, body, `"content":"Partial"`)
+	assert.Contains(t, body, `data: {"error":{"code":"rate_limit_exceeded","message":"Slow down","param":null,"type":"rate_limit_error"}}`)
+	assert.NotContains(t, body, `"finish_reason":"stop"`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
+
+func TestRewriteSSEStream_ErrorEvent(t *testing.T) {
+	src := `data: {"type":"error","sequence_number":1,"code":"invalid_prompt","message":"Bad prompt","param":"input"}` + "\n\n"
+	var out bytes.Buffer
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(src), &out, "gpt-5", chatStreamOptions{}, nil))
+	assert.Contains(t, out.String(), `{"error":{"code":"invalid_prompt","message":"Bad prompt","param":"input","type":"invalid_request_error"}}`)
+}
+
+func TestBufferChatCompletion_IncompleteAndRefusal(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  string
+		finish  string
+		content string
+		refusal string
+	}{
+		{
+			name:    "max output tokens",
+			events:  `data: {"type":"response.output_text.delta","sequence_number":1,"delta":"Cut"}` + "\n\n" + `data: {"type":"response.incomplete","sequence_number":2,"response":{"incomplete_details":{"reason":"max_output_tokens"}}}`,
+			finish:  "length",
+			content: "Cut",
+		},
+		{
+			name:   "content filter",
+			events: `data: {"type":"response.incomplete","sequence_number":1,"response":{"incomplete_details":{"reason":"content_filter"}}}`,
+			finish: "content_filter",
+		},
+		{
+			name:    "refusal",
+			events:  `data: {"type":"response.refusal.delta","sequence_number":1,"delta":"I can't help"}` + "\n\n" + `data: {"type":"response.refusal.delta","sequence_number":2,"delta":" with that."}` + "\n\n" + `data: {"type":"response.completed","sequence_number":3,"response":{}}`,
+			finish:  "stop",
+			refusal: "I can't help with that.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := bufferChatCompletionFromSSE(strings.NewReader(tt.events+"\n\n"), "gpt-5", chatStreamOptions{})
+			require.NoError(t, err)
+			require.Len(t, resp.Choices, 1)
+			assert.Equal(t, tt.finish, resp.Choices[0].FinishReason)
+			assert.Equal(t, tt.content, resp.Choices[0].Message.Content)
+			assert.Equal(t, tt.refusal, resp.Choices[0].Message.Refusal)
+		})
+	}
+}
+
+func TestChatCompletions_BufferedFailureReturnsError(t *testing.T) {
+	tests := []struct {
+		name   string
+		events string
+		status int
+		typ    string
+	}{
+		{name: "rate limited", events: failedSSE, status: http.StatusTooManyRequests, typ: "rate_limit_error"},
+		{
+			name:   "server error",
+			events: `data: {"type":"response.failed","sequence_number":1,"response":{"error":{"code":"server_error","message":"boom"}}}` + "\n\n",
+			status: http.StatusBadGateway,
+			typ:    "server_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+				return http.StatusOK, tt.events
+			}})
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`))
+			rec := httptest.NewRecorder()
+			s.chatCompletionsHandler(rec, req)
+
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+			var body struct {
+				Error map[string]interface{} `json:"error"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			assert.Equal(t, tt.typ, body.Error["type"])
+		})
+	}
+}
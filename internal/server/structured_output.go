@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// buildTextFormat maps an OpenAI chat completions response_format onto the
+// Responses API text.format object:
+//
+//	{"type":"json_schema","json_schema":{"name","schema","strict"}} -> {"type":"json_schema","name","schema","strict"}
+//	{"type":"json_object"}                                          -> {"type":"json_object"}
+//	{"type":"text"}                                                 -> {"type":"text"}
+//
+// It returns nil when no response_format was requested.
+func buildTextFormat(requestData map[string]interface{}) map[string]interface{} {
+	rf, ok := requestData["response_format"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	typ, _ := rf["type"].(string)
+	switch typ {
+	case "json_schema":
+		js, _ := rf["json_schema"].(map[string]interface{})
+		if js == nil {
+			return nil
+		}
+		name, _ := js["name"].(string)
+		if strings.TrimSpace(name) == "" {
+			name = "response"
+		}
+		format := map[string]interface{}{
+			"type":   "json_schema",
+			"name":   name,
+			"schema": js["schema"],
+		}
+		if strict, ok := js["strict"].(bool); ok {
+			format["strict"] = strict
+		}
+		if desc, ok := js["description"].(string); ok && desc != "" {
+			format["description"] = desc
+		}
+		return format
+	case "json_object", "text":
+		return map[string]interface{}{"type": typ}
+	default:
+		return nil
+	}
+}
+
+// structuredOutputValidationEnabled reports whether buffered chat completions
+// should be checked against the requested response_format before returning
+// them to the client (VALIDATE_STRUCTURED_OUTPUTS=true).
+func structuredOutputValidationEnabled() bool {
+	v, _ := env.Get("VALIDATE_STRUCTURED_OUTPUTS")
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// validateStructuredOutput checks model output text against the request's
+// response_format. json_object only requires a JSON object; json_schema also
+// validates against the supplied schema.
+func validateStructuredOutput(requestData map[string]interface{}, output string) error {
+	format := buildTextFormat(requestData)
+	if format == nil {
+		return nil
+	}
+	typ, _ := format["type"].(string)
+	if typ == "text" {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return fmt.Errorf("output is not valid JSON: %w", err)
+	}
+	if typ == "json_object" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("output is not a JSON object")
+		}
+		return nil
+	}
+
+	schema, _ := format["schema"].(map[string]interface{})
+	if schema == nil {
+		return nil
+	}
+	v := schemaValidator{root: schema}
+	return v.validate(value, schema, "$")
+}
+
+// schemaValidator implements the subset of JSON Schema used by structured
+// outputs: type, enum, const, properties, required, additionalProperties,
+// items, anyOf/oneOf/allOf, string/array length bounds, numeric bounds and
+// local $ref pointers into $defs/definitions.
+type schemaValidator struct {
+	root  map[string]interface{}
+	depth int
+}
+
+func (v *schemaValidator) validate(value interface{}, schema map[string]interface{}, path string) error {
+	v.depth++
+	defer func() { v.depth-- }()
+	if v.depth > 64 {
+		return fmt.Errorf("%s: schema nesting too deep", path)
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return v.validate(value, resolved, path)
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if jsonValueHasType(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonValuesEqual(value, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonValuesEqual(value, c) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if variants, ok := schema[key].([]interface{}); ok && len(variants) > 0 {
+			matches := 0
+			for _, variant := range variants {
+				if vs, ok := variant.(map[string]interface{}); ok && v.validate(value, vs, path) == nil {
+					matches++
+				}
+			}
+			if matches == 0 || (key == "oneOf" && matches > 1) {
+				return fmt.Errorf("%s: value does not match %s", path, key)
+			}
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if ss, ok := sub.(map[string]interface{}); ok {
+				if err := v.validate(value, ss, path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, present := val[name]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path + "." + k
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				if err := v.validate(val[k], ps, childPath); err != nil {
+					return err
+				}
+				continue
+			}
+			switch ap := schema["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					return fmt.Errorf("%s: additional property %q is not allowed", path, k)
+				}
+			case map[string]interface{}:
+				if err := v.validate(val[k], ap, childPath); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s: expected at least %d items", path, int(n))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s: expected at most %d items", path, int(n))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				if err := v.validate(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && float64(len([]rune(val))) < n {
+			return fmt.Errorf("%s: string shorter than %d characters", path, int(n))
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len([]rune(val))) > n {
+			return fmt.Errorf("%s: string longer than %d characters", path, int(n))
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && val < n {
+			return fmt.Errorf("%s: value %v is below minimum %v", path, val, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && val > n {
+			return fmt.Errorf("%s: value %v is above maximum %v", path, val, n)
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) resolveRef(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = m[part]
+	}
+	resolved, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return resolved, nil
+}
+
+func schemaTypes(raw interface{}) []string {
+	switch t := raw.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		out := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func jsonValueHasType(value interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	default:
+		return true
+	}
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func jsonValuesEqual(a, b interface{}) bool {
+	ab, errA := json.Marshal(a)
+	bb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ab) == string(bb)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/dvcrn/codex-proxy/internal/tokenizer"
+)
+
+// Token counts cover the Codex request body exactly as it is sent upstream:
+// the injected instructions and developer messages, the rewritten input and
+// the tool definitions. Without the embedded o200k vocabulary the same walk
+// estimates each string at four bytes per token. Images count as
+// tokensPerImage whatever their encoding, and encrypted reasoning is not
+// counted, since neither is read by the model as text.
+
+const (
+	// tokensPerInputItem approximates the framing the model adds around
+	// every input item.
+	tokensPerInputItem = 3
+	// tokensPerImage approximates a high-detail image.
+	tokensPerImage = 765
+)
+
+// tokenCounter counts the tokens of a string.
+type tokenCounter func(string) int
+
+// newTokenCounter counts with tok, or estimates when tok is nil.
+func newTokenCounter(tok *tokenizer.Tokenizer) tokenCounter {
+	if tok == nil {
+		return estimateTokens
+	}
+	return tok.Count
+}
+
+// estimateTokens approximates the token count of s at roughly four bytes per
+// token.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// countRequestTokens counts the prompt tokens of a Codex request body.
+func countRequestTokens(tok *tokenizer.Tokenizer, body map[string]interface{}) int {
+	return newTokenCounter(tok).request(body)
+}
+
+func (count tokenCounter) request(body map[string]interface{}) int {
+	n := 0
+	if instructions, _ := body["instructions"].(string); instructions != "" {
+		n += count(instructions)
+	}
+	switch input := body["input"].(type) {
+	case string:
+		n += tokensPerInputItem + count(input)
+	case []interface{}:
+		for _, item := range input {
+			n += count.inputItem(item)
+		}
+	}
+	if tools, ok := body["tools"].([]interface{}); ok && len(tools) > 0 {
+		n += count.json(tools)
+	}
+	if text, ok := body["text"].(map[string]interface{}); ok {
+		if format, ok := text["format"]; ok {
+			n += count.json(format)
+		}
+	}
+	return n
+}
+
+func (count tokenCounter) inputItem(item interface{}) int {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	n := tokensPerInputItem
+	typ, _ := m["type"].(string)
+	switch {
+	case isToolOutputItem(m):
+		n += count.content(m["output"])
+	case typ == "function_call" || typ == "custom_tool_call":
+		name, _ := m["name"].(string)
+		args, _ := m["arguments"].(string)
+		if args == "" {
+			args, _ = m["input"].(string)
+		}
+		n += count(name) + count(args)
+	case typ == "reasoning":
+		if summary, ok := m["summary"].([]interface{}); ok {
+			n += count.content(summary)
+		}
+	case typ == "message" || m["role"] != nil:
+		role, _ := m["role"].(string)
+		n += count(role) + count.content(m["content"])
+	default:
+		if _, ok := m["encrypted_content"]; ok {
+			m = copyMap(m)
+			delete(m, "encrypted_content")
+		}
+		n += count.json(m)
+	}
+	return n
+}
+
+// content counts a string or an array of content parts.
+func (count tokenCounter) content(content interface{}) int {
+	switch v := content.(type) {
+	case string:
+		return count(v)
+	case []interface{}:
+		n := 0
+		for _, part := range v {
+			pm, ok := part.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if text, ok := pm["text"].(string); ok {
+				n += count(text)
+				continue
+			}
+			if typ, _ := pm["type"].(string); typ == "input_image" {
+				n += tokensPerImage
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+func (count tokenCounter) json(v interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return count(string(b))
+}
+
+// responsesInputTokensHandler serves POST /v1/responses/input_tokens, counting
+// the prompt tokens a /v1/responses request would send upstream.
+func (s *Server) responsesInputTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error reading request body")
+		writeAPIError(w, internalError(http.StatusInternalServerError, "Failed to read request body"))
+		return
+	}
+	defer r.Body.Close()
+
+	var requestData map[string]interface{}
+	if err := json.Unmarshal(requestBodyBytes, &requestData); err != nil {
+		writeAPIError(w, invalidRequestError("Failed to parse request body: "+err.Error()))
+		return
+	}
+
+	transformResponsesRequestBody(requestData, resolveRequestModel(requestData), resolveReasoningEffort(requestData), s.nameRules.forRequest(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"object":       "response.input_tokens",
+		"input_tokens": countRequestTokens(s.tokenizer, requestData),
+	}); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to encode input tokens response")
+	}
+}
+
+// messagesCountTokensHandler serves the Anthropic POST /v1/messages/count_tokens,
+// counting the prompt tokens a /v1/messages request would send upstream.
+func (s *Server) messagesCountTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestBodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error reading request body")
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var requestData map[string]interface{}
+	if err := json.Unmarshal(requestBodyBytes, &requestData); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Failed to parse request body")
+		return
+	}
+
+	target, _, _, err := s.anthropicCodexBody(r, requestData)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"input_tokens": countRequestTokens(s.tokenizer, target),
+	}); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to encode token count response")
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvcrn/codex-proxy/internal/tokenizer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// byteTokenizer has no merges, so every byte is one token.
+func byteTokenizer(t *testing.T) *tokenizer.Tokenizer {
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	tok, err := tokenizer.New(strings.NewReader(b.String()), tokenizer.O200kPattern)
+	require.NoError(t, err)
+	return tok
+}
+
+func TestCountRequestTokens(t *testing.T) {
+	tok := byteTokenizer(t)
+	body := map[string]interface{}{
+		"instructions": "abc",
+		"input": []interface{}{
+			map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "input_text", "text": "hi"},
+				map[string]interface{}{"type": "input_image", "image_url": "data:image/png;base64,AAAA"},
+			}},
+			map[string]interface{}{"type": "function_call", "call_id": "c1", "name": "f", "arguments": "{}"},
+			map[string]interface{}{"type": "function_call_output", "call_id": "c1", "output": "ok"},
+		},
+	}
+	want := 3 +
+		tokensPerInputItem + len("user") + len("hi") + tokensPerImage +
+		tokensPerInputItem + len("f") + len("{}") +
+		tokensPerInputItem + len("ok")
+	assert.Equal(t, want, countRequestTokens(tok, body))
+
+	tools := []interface{}{map[string]interface{}{"type": "function", "name": "f"}}
+	body["tools"] = tools
+	toolsJSON, _ := json.Marshal(tools)
+	assert.Equal(t, want+len(toolsJSON), countRequestTokens(tok, body))
+
+}
+
+func TestEstimateRequestTokensSkipsOpaqueData(t *testing.T) {
+	image := "data:image/png;base64," + strings.Repeat("A", 40000)
+	encrypted := strings.Repeat("x", 40000)
+	body := map[string]interface{}{
+		"input": []interface{}{
+			map[string]interface{}{"type": "message", "role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "input_text", "text": "describe this"},
+				map[string]interface{}{"type": "input_image", "image_url": image},
+			}},
+			map[string]interface{}{"type": "reasoning", "summary": []interface{}{}, "encrypted_content": encrypted},
+			map[string]interface{}{"type": "compaction", "encrypted_content": encrypted},
+		},
+	}
+	n := countRequestTokens(nil, body)
+	assert.Greater(t, n, tokensPerImage)
+	assert.Less(t, n, tokensPerImage+100, "image data and encrypted content are not estimated as text")
+}
+
+func TestTokenCountEndpoints(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "secret")
+	s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		t.Fatal("token counting must not call upstream")
+		return 0, ""
+	}})
+	s.tokenizer = byteTokenizer(t)
+
+	post := func(path, body string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", "secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+
+	messages := `{"model":"gpt-5","system":"Be brief.","messages":[{"role":"user","content":"hello"}]}`
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(messages), &requestData))
+	target, _, _, err := s.anthropicCodexBody(httptest.NewRequest(http.MethodPost, "/v1/messages", nil), requestData)
+	require.NoError(t, err)
+	out := post("/v1/messages/count_tokens", messages)
+	assert.EqualValues(t, countRequestTokens(s.tokenizer, target), out["input_tokens"])
+	assert.Greater(t, out["input_tokens"], float64(len(codexInstructionsPrefix())), "injected instructions are counted")
+
+	out = post("/v1/responses/input_tokens", `{"model":"gpt-5","instructions":"Be brief.","input":[{"role":"user","content":[{"type":"input_text","text":"hello"}]}]}`)
+	assert.Equal(t, "response.input_tokens", out["object"])
+	assert.EqualValues(t, len("Be brief.")+tokensPerInputItem+len("user")+len("hello"), out["input_tokens"])
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Codex-native tools declared through /v1/chat/completions:
+//
+//	{"type":"web_search"}                  -> {"type":"web_search"} (extra settings passed through)
+//	{"type":"local_shell"}                 -> {"type":"local_shell"}
+//	{"type":"custom","custom":{name,...}}  -> {"type":"custom","name",...,"format":{...}}
+//
+// Their output items are surfaced to chat clients as tool calls:
+// custom_tool_call as a "custom" tool call, local_shell_call as a function
+// call named local_shell whose arguments are the exec action, and
+// web_search_call as a function call named web_search. Web searches run
+// upstream, so they do not turn finish_reason into tool_calls and are dropped
+// again when the conversation is replayed.
+
+const (
+	localShellToolName = "local_shell"
+	webSearchToolName  = "web_search"
+	webSearchCallIDTag = "ws_"
+)
+
+// mapBuiltinToolToCodex converts a non-function chat tool definition to its
+// Responses API shape. Unknown tool types report false.
+func mapBuiltinToolToCodex(tm map[string]interface{}) (map[string]interface{}, bool) {
+	typ, _ := tm["type"].(string)
+	switch typ {
+	case "web_search", "web_search_preview", "local_shell":
+		out := map[string]interface{}{"type": typ}
+		// Accept settings either flat or nested under the type key.
+		nested, _ := tm[typ].(map[string]interface{})
+		for _, src := range []map[string]interface{}{tm, nested} {
+			for k, v := range src {
+				if k != "type" && k != typ {
+					out[k] = v
+				}
+			}
+		}
+		return out, true
+	case "custom":
+		def := tm
+		if nested, ok := tm["custom"].(map[string]interface{}); ok {
+			def = nested
+		}
+		name, _ := def["name"].(string)
+		if name == "" {
+			return nil, false
+		}
+		out := map[string]interface{}{"type": "custom", "name": name}
+		if desc, ok := def["description"].(string); ok && desc != "" {
+			out["description"] = desc
+		}
+		if format := mapCustomToolFormat(def["format"]); format != nil {
+			out["format"] = format
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// mapCustomToolFormat flattens the chat completions grammar format
+// {"type":"grammar","grammar":{"definition","syntax"}} into the Responses
+// shape {"type":"grammar","syntax","definition"}.
+func mapCustomToolFormat(raw interface{}) map[string]interface{} {
+	format, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	typ, _ := format["type"].(string)
+	if typ != "grammar" {
+		return map[string]interface{}{"type": "text"}
+	}
+	src := format
+	if grammar, ok := format["grammar"].(map[string]interface{}); ok {
+		src = grammar
+	}
+	out := map[string]interface{}{"type": "grammar"}
+	if syntax, ok := src["syntax"].(string); ok && syntax != "" {
+		out["syntax"] = syntax
+	} else {
+		out["syntax"] = "lark"
+	}
+	out["definition"] = src["definition"]
+	return out
+}
+
+func declaresLocalShell(requestData map[string]interface{}) bool {
+	tools, _ := requestData["tools"].([]interface{})
+	for _, t := range tools {
+		if tm, ok := t.(map[string]interface{}); ok && tm["type"] == "local_shell" {
+			return true
+		}
+	}
+	return false
+}
+
+// builtinToolCallInputItem converts an assistant tool call that originated
+// from a Codex-native tool back into its Responses input item. skip is true
+// for upstream-executed web searches, which are not replayed.
+func builtinToolCallInputItem(tcm map[string]interface{}, localShell bool) (item map[string]interface{}, skip bool) {
+	callID, _ := tcm["id"].(string)
+	if tcm["type"] == "custom" {
+		custom, _ := tcm["custom"].(map[string]interface{})
+		name, _ := custom["name"].(string)
+		input, _ := custom["input"].(string)
+		return map[string]interface{}{
+			"type":    "custom_tool_call",
+			"call_id": callID,
+			"name":    name,
+			"input":   input,
+		}, false
+	}
+
+	fn, _ := tcm["function"].(map[string]interface{})
+	name, _ := fn["name"].(string)
+	switch {
+	case name == webSearchToolName && strings.HasPrefix(callID, webSearchCallIDTag):
+		return nil, true
+	case name == localShellToolName && localShell:
+		var action interface{}
+		if err := json.Unmarshal([]byte(extractArgumentsString(fn["arguments"])), &action); err != nil {
+			return nil, false
+		}
+		return map[string]interface{}{
+			"type":    "local_shell_call",
+			"call_id": callID,
+			"status":  "completed",
+			"action":  action,
+		}, false
+	}
+	return nil, false
+}
+
+// transformBuiltinToolEvent handles Codex-native tool output events for the
+// SSETransformer. handled is false for events it does not own.
+func (t *SSETransformer) transformBuiltinToolEvent(eventType string, upstream map[string]interface{}, sendRole func(interface{}) ([]byte, error)) (out []byte, handled bool, err error) {
+	if t.legacyFunctions {
+		return nil, false, nil
+	}
+	seq := upstream["sequence_number"]
+
+	switch eventType {
+	case "response.output_item.added":
+		item, _ := upstream["item"].(map[string]interface{})
+		if typ, _ := item["type"].(string); typ != "custom_tool_call" {
+			return nil, false, nil
+		}
+		itemID, _ := item["id"].(string)
+		callID, _ := item["call_id"].(string)
+		name, _ := item["name"].(string)
+		idx := t.registerToolCall(itemID, callID, name)
+		t.sawToolCalls = true
+		out, err = t.toolCallChunk(seq, sendRole, map[string]interface{}{
+			"index":  idx,
+			"id":     t.toolIDByItemID[itemID],
+			"type":   "custom",
+			"custom": map[string]interface{}{"name": name, "input": ""},
+		})
+		return out, true, err
+
+	case "response.custom_tool_call_input.delta":
+		itemID, _ := upstream["item_id"].(string)
+		idx, ok := t.toolIndexByItemID[itemID]
+		if !ok {
+			return nil, true, nil
+		}
+		delta, _ := upstream["delta"].(string)
+		t.markToolInputStreamed(itemID)
+		out, err = t.toolCallChunk(seq, sendRole, map[string]interface{}{
+			"index":  idx,
+			"custom": map[string]interface{}{"input": delta},
+		})
+		return out, true, err
+
+	case "response.output_item.done":
+		item, _ := upstream["item"].(map[string]interface{})
+		itemID, _ := item["id"].(string)
+		switch typ, _ := item["type"].(string); typ {
+		case "custom_tool_call":
+			// Some streams only carry the input on the completed item.
+			idx, ok := t.toolIndexByItemID[itemID]
+			input, _ := item["input"].(string)
+			if !ok || t.toolInputStreamed[itemID] || input == "" {
+				return nil, true, nil
+			}
+			out, err = t.toolCallChunk(seq, sendRole, map[string]interface{}{
+				"index":  idx,
+				"custom": map[string]interface{}{"input": input},
+			})
+			return out, true, err
+
+		case "local_shell_call", "web_search_call":
+			callID, _ := item["call_id"].(string)
+			name := localShellToolName
+			if typ == "web_search_call" {
+				name = webSearchToolName
+				callID = itemID
+			} else {
+				t.sawToolCalls = true
+			}
+			args, err := json.Marshal(item["action"])
+			if err != nil {
+				return nil, true, fmt.Errorf("failed to marshal %s action: %w", typ, err)
+			}
+			idx := t.registerToolCall(itemID, callID, name)
+			out, err = t.toolCallChunk(seq, sendRole, map[string]interface{}{
+				"index": idx,
+				"id":    t.toolIDByItemID[itemID],
+				"type":  "function",
+				"function": map[string]interface{}{
+					"name":      name,
+					"arguments": string(args),
+				},
+			})
+			return out, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// registerToolCall assigns the next tool_calls index to an output item.
+func (t *SSETransformer) registerToolCall(itemID, callID, name string) int {
+	idx, ok := t.toolIndexByItemID[itemID]
+	if !ok {
+		idx = t.nextToolIndex
+		t.nextToolIndex++
+		t.toolIndexByItemID[itemID] = idx
+	}
+	if callID == "" {
+		callID = "call_" + itemID
+	}
+	t.toolIDByItemID[itemID] = callID
+	t.toolNameByItemID[itemID] = name
+	return idx
+}
+
+func (t *SSETransformer) markToolInputStreamed(itemID string) {
+	if t.toolInputStreamed == nil {
+		t.toolInputStreamed = map[string]bool{}
+	}
+	t.toolInputStreamed[itemID] = true
+}
+
+// toolCallChunk builds a chat.completion.chunk carrying a single tool_calls
+// delta, preceded by the assistant role chunk if it has not been sent yet.
+func (t *SSETransformer) toolCallChunk(seq interface{}, sendRole func(interface{}) ([]byte, error), toolCall map[string]interface{}) ([]byte, error) {
+	var chunks [][]byte
+	if rb, err := sendRole(seq); err != nil {
+		return nil, err
+	} else if len(rb) > 0 {
+		chunks = append(chunks, rb)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"id":      t.responseID,
+		"object":  "chat.completion.chunk",
+		"created": seq,
+		"model":   t.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         map[string]interface{}{"tool_calls": []interface{}{toolCall}},
+				"finish_reason": nil,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tool call chunk: %w", err)
+	}
+	chunks = append(chunks, b)
+	return bytes.Join(chunks, []byte("\n")), nil
+}
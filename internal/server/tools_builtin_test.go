@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapToolsToCodex_BuiltinAndCustomTools(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"tools": [
+			{"type":"function","function":{"name":"lookup","parameters":{"type":"object"},"strict":true}},
+			{"type":"web_search","web_search":{"search_context_size":"low"}},
+			{"type":"local_shell"},
+			{"type":"custom","custom":{"name":"apply_patch","description":"Apply a patch","format":{"type":"grammar","grammar":{"syntax":"lark","definition":"start: /.+/"}}}},
+			{"type":"custom","custom":{"name":"notes"}},
+			{"type":"mystery"}
+		]
+	}`), &requestData))
+
+	tools := mapToolsToCodex(requestData)
+	require.Len(t, tools, 5)
+	assert.Equal(t, true, tools[0].(map[string]interface{})["strict"])
+	assert.Equal(t, map[string]interface{}{"type": "web_search", "search_context_size": "low"}, tools[1])
+	assert.Equal(t, map[string]interface{}{"type": "local_shell"}, tools[2])
+	assert.Equal(t, map[string]interface{}{
+		"type":        "custom",
+		"name":        "apply_patch",
+		"description": "Apply a patch",
+		"format":      map[string]interface{}{"type": "grammar", "syntax": "lark", "definition": "start: /.+/"},
+	}, tools[3])
+	assert.Equal(t, map[string]interface{}{"type": "custom", "name": "notes"}, tools[4])
+}
+
+func TestSSETransformer_CustomAndBuiltinToolCalls(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.output_item.done","sequence_number":1,"item":{"type":"web_search_call","id":"ws_1","status":"completed","action":{"type":"search","query":"go 1.25"}}}`,
+		"",
+		`data: {"type":"response.output_item.added","sequence_number":2,"item":{"type":"custom_tool_call","id":"ctc_1","call_id":"call_patch","name":"apply_patch","input":""}}`,
+		"",
+		`data: {"type":"response.custom_tool_call_input.delta","sequence_number":3,"item_id":"ctc_1","delta":"*** Begin Patch\n"}`,
+		"",
+		`data: {"type":"response.custom_tool_call_input.delta","sequence_number":4,"item_id":"ctc_1","delta":"*** End Patch"}`,
+		"",
+		`data: {"type":"response.output_item.done","sequence_number":5,"item":{"type":"custom_tool_call","id":"ctc_1","call_id":"call_patch","name":"apply_patch","input":"*** Begin Patch\n*** End Patch"}}`,
+		"",
+		`data: {"type":"response.output_item.done","sequence_number":6,"item":{"type":"local_shell_call","id":"lsh_1","call_id":"call_sh","status":"completed","action":{"type":"exec","command":["ls","-la"]}}}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":7,"response":{}}`,
+		"",
+	}, "\n")
+
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(src), "gpt-5", chatStreamOptions{})
+	require.NoError(t, err)
+	choice := resp.Choices[0]
+	assert.Equal(t, "tool_calls", choice.FinishReason)
+	require.Len(t, choice.Message.ToolCalls, 3)
+
+	search := choice.Message.ToolCalls[0]
+	assert.Equal(t, "ws_1", search.ID)
+	assert.Equal(t, "web_search", search.Function.Name)
+	assert.JSONEq(t, `{"type":"search","query":"go 1.25"}`, search.Function.Arguments)
+
+	patch := choice.Message.ToolCalls[1]
+	assert.Equal(t, "custom", patch.Type)
+	assert.Equal(t, "call_patch", patch.ID)
+	require.NotNil(t, patch.Custom)
+	assert.Equal(t, "apply_patch", patch.Custom.Name)
+	assert.Equal(t, "*** Begin Patch\n*** End Patch", patch.Custom.Input)
+	assert.Nil(t, patch.Function)
+
+	shell := choice.Message.ToolCalls[2]
+	assert.Equal(t, "call_sh", shell.ID)
+	assert.Equal(t, "local_shell", shell.Function.Name)
+	assert.JSONEq(t, `{"type":"exec","command":["ls","-la"]}`, shell.Function.Arguments)
+}
+
+func TestSSETransformer_WebSearchOnlyFinishesWithStop(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.output_item.done","sequence_number":1,"item":{"type":"web_search_call","id":"ws_1","status":"completed","action":{"type":"search","query":"q"}}}`,
+		"",
+		`data: {"type":"response.output_text.delta","sequence_number":2,"delta":"Answer"}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":3,"response":{}}`,
+		"",
+	}, "\n")
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(src), "gpt-5", chatStreamOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Equal(t, "Answer", resp.Choices[0].Message.Content)
+	require.Len(t, resp.Choices[0].Message.ToolCalls, 1, "completed web searches still reach the client")
+	assert.Equal(t, "ws_1", resp.Choices[0].Message.ToolCalls[0].ID, "the ws_ id lets replay skip the call")
+}
+
+func TestBuildCodexInputMessages_BuiltinToolHistory(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gpt-5",
+		"tools": [{"type":"local_shell"},{"type":"custom","custom":{"name":"apply_patch"}},{"type":"web_search"}],
+		"messages": [
+			{"role":"user","content":"fix it"},
+			{"role":"assistant","content":null,"tool_calls":[
+				{"id":"ws_1","type":"function","function":{"name":"web_search","arguments":"{\"type\":\"search\"}"}},
+				{"id":"call_patch","type":"custom","custom":{"name":"apply_patch","input":"*** Begin Patch"}},
+				{"id":"call_sh","type":"function","function":{"name":"local_shell","arguments":"{\"type\":\"exec\",\"command\":[\"ls\"]}"}}
+			]},
+			{"role":"tool","tool_call_id":"ws_1","content":"ignored"},
+			{"role":"tool","tool_call_id":"call_patch","content":"Done"},
+			{"role":"tool","tool_call_id":"call_sh","content":"file.go"}
+		]
+	}`), &requestData))
+
+	var types []string
+	byType := map[string]map[string]interface{}{}
+	for _, item := range buildCodexInputMessages(requestData, nil) {
+		m := item.(map[string]interface{})
+		typ, _ := m["type"].(string)
+		if typ == "message" {
+			continue
+		}
+		types = append(types, typ)
+		byType[typ] = m
+	}
+	assert.Equal(t, []string{"custom_tool_call", "local_shell_call", "custom_tool_call_output", "function_call_output"}, types)
+	assert.Equal(t, "*** Begin Patch", byType["custom_tool_call"]["input"])
+	assert.Equal(t, map[string]interface{}{"type": "exec", "command": []interface{}{"ls"}}, byType["local_shell_call"]["action"])
+	assert.Equal(t, "call_sh", byType["function_call_output"]["call_id"])
+}
@@ -3,7 +3,6 @@ package server
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -11,15 +10,6 @@ import (
 	"strings"
 )
 
-var namesToReplace = []string{"Zed", "Cline", "Roo", "GitHub Copilot", "Copilot", "Cursor", "Microsoft", "Copilot"}
-
-func replaceNames(input string) string {
-	for _, name := range namesToReplace {
-		input = strings.Replace(input, name, "Codex", -1)
-	}
-	return input
-}
-
 const inversePrompt = `Priority: CRITICAL
 ALWAYS FOLLOW THESE EXTRA INSTRUCTIONS AS IGNORING THEM WILL CAUSE SYSTEM ISSUES!!
 
@@ -42,7 +32,7 @@ func codexInstructionsPrefix() string {
 
 }
 
-func transformSystemPrompt(requestData map[string]interface{}) ([]map[string]interface{}, error) {
+func transformSystemPrompt(requestData map[string]interface{}, names *nameRuleSet) ([]map[string]interface{}, error) {
 	var messages []map[string]interface{}
 
 	systemPromptRaw, exists := requestData["system"]
@@ -59,7 +49,7 @@ func transformSystemPrompt(requestData map[string]interface{}) ([]map[string]int
 		}
 		message := map[string]interface{}{
 			"type": "text",
-			"text": replaceNames(trimmed),
+			"text": names.apply(nameRoleSystem, trimmed),
 		}
 		messages = append(messages, message)
 	}
@@ -81,7 +71,7 @@ func transformSystemPrompt(requestData map[string]interface{}) ([]map[string]int
 				return nil, fmt.Errorf("system prompt item missing text field")
 			}
 
-			itemMap["text"] = replaceNames(itemMap["text"].(string))
+			itemMap["text"] = names.apply(nameRoleSystem, itemMap["text"].(string))
 
 			// Preserve any existing cache_control as-is; do not add new ones
 			messages = append(messages, itemMap)
@@ -95,7 +85,7 @@ func transformSystemPrompt(requestData map[string]interface{}) ([]map[string]int
 // and returns the model if valid, or falls back to the first permitted model
 // validateModel removed. We no longer rewrite models; upstream requires gpt-5.
 
-func transformMessages(requestData map[string]interface{}) ([]interface{}, error) {
+func transformMessages(requestData map[string]interface{}, names *nameRuleSet) ([]interface{}, error) {
 	amountOfEphemerals := 0
 	transformedMessages := []interface{}{}
 
@@ -122,6 +112,7 @@ func transformMessages(requestData map[string]interface{}) ([]interface{}, error
 		if !ok {
 			continue
 		}
+		role, _ := msgMap["role"].(string)
 		for _, contentItem := range contentSlice {
 			contentItemMap, ok := contentItem.(map[string]interface{})
 			if !ok {
@@ -130,7 +121,7 @@ func transformMessages(requestData map[string]interface{}) ([]interface{}, error
 			// Replace names in text
 			text, ok := contentItemMap["text"].(string)
 			if ok {
-				contentItemMap["text"] = replaceNames(text)
+				contentItemMap["text"] = names.apply(role, text)
 			}
 			// Check for ephemeral cache_control
 			if cacheControlRaw, hasCacheControl := contentItemMap["cache_control"]; hasCacheControl {
@@ -155,8 +146,11 @@ func transformMessages(requestData map[string]interface{}) ([]interface{}, error
 // buildCodexRequestBody transforms an OpenAI Chat Completions style request
 // into the ChatGPT Codex backend body. This should be kept aligned with
 // recorded requests under Raw_*/[11] Request - chatgpt.com_backend-api_codex_responses.txt
-func buildCodexRequestBody(requestData map[string]interface{}) map[string]interface{} {
-	prefix := codexInstructionsPrefix()
+func buildCodexRequestBody(requestData map[string]interface{}, names *nameRuleSet, profile *instructionProfile) map[string]interface{} {
+	if profile == nil {
+		profile = defaultInstructionProfile()
+	}
+	prefix := profile.instructions
 
 	resolvedModel := resolveRequestModel(requestData)
 	normalizedModel := normalizeModel(resolvedModel)
@@ -166,17 +160,25 @@ func buildCodexRequestBody(requestData map[string]interface{}) map[string]interf
 	body["store"] = false
 	body["stream"] = true
 
-	// Prepend initial greeting message to input messages
-	initialGreeting := map[string]interface{}{
-		"type":    "message",
-		"id":      nil,
-		"role":    "developer",
-		"content": []interface{}{map[string]interface{}{"type": "input_text", "text": inversePrompt}},
+	// Prepend the profile's developer messages to input messages
+	var developerMessages []interface{}
+	for _, text := range profile.developerMessages {
+		developerMessages = append(developerMessages, map[string]interface{}{
+			"type":    "message",
+			"id":      nil,
+			"role":    "developer",
+			"content": []interface{}{map[string]interface{}{"type": "input_text", "text": text}},
+		})
+	}
+
+	messagesSource := requestData
+	if !profile.keepSystemPrompt {
+		messagesSource = withoutSystemMessages(requestData)
 	}
 
 	// Build input messages array in codex format
-	if inputMsgs := buildCodexInputMessages(requestData); len(inputMsgs) > 0 {
-		inputMsgs = append([]interface{}{initialGreeting}, inputMsgs...)
+	if inputMsgs := buildCodexInputMessages(messagesSource, names); len(inputMsgs) > 0 {
+		inputMsgs = append(developerMessages, inputMsgs...)
 		body["input"] = inputMsgs
 	}
 
@@ -184,30 +186,27 @@ func buildCodexRequestBody(requestData map[string]interface{}) map[string]interf
 	body["tools"] = mapToolsToCodex(requestData)
 
 	// Tool choice
-	if tc, ok := requestData["tool_choice"].(string); ok && tc != "" {
-		body["tool_choice"] = tc
-	} else {
-		body["tool_choice"] = "auto"
-	}
+	body["tool_choice"] = mapToolChoiceToCodex(requestData)
 
-	// Parallel tool calls
-	if ptc, ok := requestData["parallel_tool_calls"].(bool); ok {
+	// Parallel tool calls (legacy function calling returns a single call)
+	if ptc, ok := requestData["parallel_tool_calls"].(bool); ok && !usesLegacyFunctions(requestData) {
 		body["parallel_tool_calls"] = ptc
 	} else {
 		body["parallel_tool_calls"] = false
 	}
 
+	// Structured outputs: response_format -> text.format
+	if format := buildTextFormat(requestData); format != nil {
+		body["text"] = map[string]interface{}{"format": format}
+	}
+
 	// Reasoning settings (default effort none -> medium equivalent)
 	body["reasoning"] = buildReasoningSettings(requestData)
 
 	// Include fields requested in capture
 	body["include"] = []interface{}{"reasoning.encrypted_content"}
 
-	if _, ok := body["prompt_cache_key"].(string); !ok {
-		if key := derivePromptCacheKey(normalizedModel, prefix, extractFirstUserText(body)); key != "" {
-			body["prompt_cache_key"] = key
-		}
-	}
+	applyModelAlias(body, resolvedModel)
 
 	return body
 }
@@ -244,7 +243,7 @@ func extractUserText(requestData map[string]interface{}) string {
 	return strings.TrimSpace(strings.Join(parts, "\n\n"))
 }
 
-func extractInstructions(requestData map[string]interface{}) string {
+func extractInstructions(requestData map[string]interface{}, names *nameRuleSet) string {
 	msgs, _ := requestData["messages"].([]interface{})
 	var parts []string
 	for _, m := range msgs {
@@ -260,14 +259,14 @@ func extractInstructions(requestData map[string]interface{}) string {
 		switch v := content.(type) {
 		case string:
 			if v != "" {
-				parts = append(parts, replaceNames(v))
+				parts = append(parts, names.apply(nameRoleSystem, v))
 			}
 		case []interface{}:
 			var segs []string
 			for _, ci := range v {
 				if cm, ok := ci.(map[string]interface{}); ok {
 					if t, _ := cm["text"].(string); t != "" {
-						segs = append(segs, replaceNames(t))
+						segs = append(segs, names.apply(nameRoleSystem, t))
 					}
 				}
 			}
@@ -292,6 +291,9 @@ func resolveRequestModel(requestData map[string]interface{}) string {
 }
 
 func normalizeModel(model string) string {
+	if alias, ok := lookupModelAlias(model); ok {
+		return normalizeModel(alias.Model)
+	}
 	lower := strings.ToLower(strings.TrimSpace(model))
 	for _, effort := range []string{"-xhigh", "-high", "-medium", "-low", "-minimal"} {
 		if strings.HasSuffix(lower, effort) {
@@ -303,9 +305,10 @@ func normalizeModel(model string) string {
 		return modelGPT5
 	}
 
-	// Prefer explicit new model IDs first to keep mapping predictable.
-	if lower == modelGPT55 {
-		return modelGPT55
+	// Models known to the catalog map to themselves, so models the backend
+	// adds work without new rules below.
+	if _, ok := currentModels().metadata[lower]; ok {
+		return lower
 	}
 	if strings.Contains(lower, "gpt-5.2-codex") {
 		return modelGPT52Codex
@@ -373,6 +376,11 @@ func normalizeReasoningEffort(effort string) string {
 }
 
 func resolveReasoningEffort(requestData map[string]interface{}) string {
+	model, _ := requestData["model"].(string)
+	alias, isAlias := lookupModelAlias(model)
+	if isAlias && alias.Effort != "" {
+		return alias.Effort
+	}
 	if effort, ok := requestData["reasoning_effort"].(string); ok {
 		effort = strings.TrimSpace(effort)
 		if effort != "" {
@@ -388,7 +396,7 @@ func resolveReasoningEffort(requestData map[string]interface{}) string {
 		}
 	}
 
-	if model, ok := requestData["model"].(string); ok {
+	if !isAlias {
 		lowerModel := strings.ToLower(strings.TrimSpace(model))
 		for _, effort := range []string{"xhigh", "high", "medium", "low", "minimal"} {
 			if strings.HasSuffix(lowerModel, "-"+effort) {
@@ -430,16 +438,17 @@ func buildReasoningSettings(requestData map[string]interface{}) map[string]inter
 func clampReasoningEffortForModel(effort, backendModel string) string {
 	effort = strings.TrimSpace(effort)
 	backendModel = strings.TrimSpace(backendModel)
+	models := currentModels()
 
 	// If nothing specified, fall back to a model default (if any).
 	if effort == "" {
-		if def, ok := modelDefaultEffort[backendModel]; ok {
+		if def, ok := models.defaultEffort[backendModel]; ok {
 			return def
 		}
 		return ""
 	}
 
-	allowed, ok := modelAllowedEfforts[backendModel]
+	allowed, ok := models.allowedEfforts[backendModel]
 	if !ok || len(allowed) == 0 {
 		return effort
 	}
@@ -449,28 +458,12 @@ func clampReasoningEffortForModel(effort, backendModel string) string {
 		}
 	}
 
-	if def, ok := modelDefaultEffort[backendModel]; ok && def != "" {
+	if def, ok := models.defaultEffort[backendModel]; ok && def != "" {
 		return def
 	}
 	return effort
 }
 
-func derivePromptCacheKey(model, instructions, firstUserText string) string {
-	model = strings.TrimSpace(model)
-	instructions = strings.TrimSpace(instructions)
-	firstUserText = strings.TrimSpace(firstUserText)
-	if model == "" && instructions == "" && firstUserText == "" {
-		return ""
-	}
-	payload := model + "\n" + instructions + "\n" + firstUserText
-	sum := sha256.Sum256([]byte(payload))
-	uuidBytes := make([]byte, 16)
-	copy(uuidBytes, sum[:16])
-	uuidBytes[6] = (uuidBytes[6] & 0x0f) | 0x50 // set version 5
-	uuidBytes[8] = (uuidBytes[8] & 0x3f) | 0x80 // set variant 10
-	return formatUUID(uuidBytes)
-}
-
 func formatUUID(b []byte) string {
 	buf := make([]byte, 36)
 	hex.Encode(buf[0:8], b[0:4])
@@ -485,86 +478,20 @@ func formatUUID(b []byte) string {
 	return string(buf)
 }
 
-func extractFirstUserText(body map[string]interface{}) string {
-	inputVal, ok := body["input"]
-	if !ok {
-		return ""
-	}
-	switch input := inputVal.(type) {
-	case []interface{}:
-		for _, entry := range input {
-			entryMap, ok := entry.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			role, _ := entryMap["role"].(string)
-			if role != "user" {
-				continue
-			}
-			if contentSlice, ok := entryMap["content"].([]interface{}); ok {
-				for _, item := range contentSlice {
-					if itemMap, ok := item.(map[string]interface{}); ok {
-						if text, _ := itemMap["text"].(string); strings.TrimSpace(text) != "" {
-							return replaceNames(text)
-						}
-					}
-				}
-			}
-		}
-	case []map[string]interface{}:
-		for _, entryMap := range input {
-			role, _ := entryMap["role"].(string)
-			if role != "user" {
-				continue
-			}
-			if contentSlice, ok := entryMap["content"].([]interface{}); ok {
-				for _, item := range contentSlice {
-					if itemMap, ok := item.(map[string]interface{}); ok {
-						if text, _ := itemMap["text"].(string); strings.TrimSpace(text) != "" {
-							return replaceNames(text)
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Fallback for chat/completions style messages
-	if msgs, ok := body["messages"].([]interface{}); ok {
-		for _, msg := range msgs {
-			mm, ok := msg.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			role, _ := mm["role"].(string)
-			if role != "user" {
-				continue
-			}
-			switch v := mm["content"].(type) {
-			case string:
-				if strings.TrimSpace(v) != "" {
-					return replaceNames(v)
-				}
-			case []interface{}:
-				for _, ci := range v {
-					if cm, ok := ci.(map[string]interface{}); ok {
-						if text, _ := cm["text"].(string); strings.TrimSpace(text) != "" {
-							return replaceNames(text)
-						}
-					}
-				}
-			}
-		}
-	}
-
-	return ""
-}
-
 // buildCodexInputMessages converts OpenAI messages to Codex "input" messages
-func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
-	systemPrompt := extractInstructions(requestData)
+func buildCodexInputMessages(requestData map[string]interface{}, names *nameRuleSet) []interface{} {
+	systemPrompt := extractInstructions(requestData, names)
 
 	msgs, _ := requestData["messages"].([]interface{})
+	vision := modelSupportsVision(normalizeModel(resolveRequestModel(requestData)))
+	// Legacy function_call messages carry no ids; synthesize one per call and
+	// hand it to the next "function" result with the same name.
+	legacyCalls := 0
+	pendingLegacyCalls := map[string][]string{}
+	// Results of Codex-native tool calls need their matching output item type.
+	localShell := declaresLocalShell(requestData)
+	customCallIDs := map[string]bool{}
+	skippedCallIDs := map[string]bool{}
 	var input []interface{}
 	input = append(input, map[string]interface{}{
 		"type": "message",
@@ -587,17 +514,10 @@ func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
 
 		switch role {
 		case "user":
-			texts := collectTextSegments(mm["content"], true)
-			if len(texts) == 0 {
+			contents := collectInputContent(mm["content"], names, nameRoleUser, vision)
+			if len(contents) == 0 {
 				continue
 			}
-			contents := make([]interface{}, 0, len(texts))
-			for _, t := range texts {
-				contents = append(contents, map[string]interface{}{
-					"type": "input_text",
-					"text": t,
-				})
-			}
 			input = append(input, map[string]interface{}{
 				"type":    "message",
 				"id":      mm["id"],
@@ -605,7 +525,7 @@ func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
 				"content": contents,
 			})
 		case "assistant":
-			texts := collectTextSegments(mm["content"], true)
+			texts := collectTextSegments(mm["content"], nil, "")
 			if len(texts) > 0 {
 				contents := make([]interface{}, 0, len(texts))
 				for _, t := range texts {
@@ -628,6 +548,16 @@ func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
 						continue
 					}
 					callID, _ := tcm["id"].(string)
+					if item, skip := builtinToolCallInputItem(tcm, localShell); skip {
+						skippedCallIDs[callID] = true
+						continue
+					} else if item != nil {
+						if item["type"] == "custom_tool_call" {
+							customCallIDs[callID] = true
+						}
+						input = append(input, item)
+						continue
+					}
 					funcMap, _ := tcm["function"].(map[string]interface{})
 					name, _ := funcMap["name"].(string)
 					arguments := extractArgumentsString(funcMap["arguments"])
@@ -639,14 +569,45 @@ func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
 					})
 				}
 			}
+			if fc, ok := mm["function_call"].(map[string]interface{}); ok {
+				name, _ := fc["name"].(string)
+				legacyCalls++
+				callID := fmt.Sprintf("call_legacy_%d", legacyCalls)
+				pendingLegacyCalls[name] = append(pendingLegacyCalls[name], callID)
+				input = append(input, map[string]interface{}{
+					"type":      "function_call",
+					"name":      name,
+					"call_id":   callID,
+					"arguments": extractArgumentsString(fc["arguments"]),
+				})
+			}
+		case "function":
+			name, _ := mm["name"].(string)
+			pending := pendingLegacyCalls[name]
+			if len(pending) == 0 {
+				continue
+			}
+			pendingLegacyCalls[name] = pending[1:]
+			input = append(input, map[string]interface{}{
+				"type":    "function_call_output",
+				"call_id": pending[0],
+				"output":  names.apply(nameRoleTool, collectToolOutput(mm["content"])),
+			})
 		case "tool":
 			callID, _ := mm["tool_call_id"].(string)
-			if callID == "" {
+			if callID == "" || skippedCallIDs[callID] {
 				continue
 			}
-			output := collectToolOutput(mm["content"])
+			var output interface{} = names.apply(nameRoleTool, collectToolOutput(mm["content"]))
+			if containsImageParts(mm["content"]) {
+				output = collectInputContent(mm["content"], names, nameRoleTool, vision)
+			}
+			outputType := "function_call_output"
+			if customCallIDs[callID] {
+				outputType = "custom_tool_call_output"
+			}
 			input = append(input, map[string]interface{}{
-				"type":    "function_call_output",
+				"type":    outputType,
 				"call_id": callID,
 				"output":  output,
 			})
@@ -655,17 +616,16 @@ func buildCodexInputMessages(requestData map[string]interface{}) []interface{} {
 	return input
 }
 
-func collectTextSegments(content interface{}, applyReplace bool) []string {
+// collectTextSegments returns the trimmed text parts of message content,
+// rewritten with names for the message's role.
+func collectTextSegments(content interface{}, names *nameRuleSet, role string) []string {
 	switch v := content.(type) {
 	case string:
 		text := strings.TrimSpace(v)
 		if text == "" {
 			return nil
 		}
-		if applyReplace {
-			text = replaceNames(text)
-		}
-		return []string{text}
+		return []string{names.apply(role, text)}
 	case []interface{}:
 		var texts []string
 		for _, item := range v {
@@ -677,10 +637,7 @@ func collectTextSegments(content interface{}, applyReplace bool) []string {
 			if text == "" {
 				continue
 			}
-			if applyReplace {
-				text = replaceNames(text)
-			}
-			texts = append(texts, text)
+			texts = append(texts, names.apply(role, text))
 		}
 		return texts
 	default:
@@ -688,6 +645,95 @@ func collectTextSegments(content interface{}, applyReplace bool) []string {
 	}
 }
 
+// imageOmittedPlaceholder replaces image parts for models without vision
+// support so the model knows an image was sent instead of silently losing it.
+const imageOmittedPlaceholder = "[image omitted: the selected model does not accept image input]"
+
+// collectInputContent converts OpenAI message content (a string or an array of
+// text / image_url parts) into Codex input_text and input_image items,
+// preserving the original part order.
+func collectInputContent(content interface{}, names *nameRuleSet, role string, vision bool) []interface{} {
+	parts, ok := content.([]interface{})
+	if !ok {
+		texts := collectTextSegments(content, names, role)
+		out := make([]interface{}, 0, len(texts))
+		for _, t := range texts {
+			out = append(out, map[string]interface{}{"type": "input_text", "text": t})
+		}
+		return out
+	}
+
+	var out []interface{}
+	for _, item := range parts {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		typ, _ := m["type"].(string)
+		switch typ {
+		case "image_url", "input_image":
+			if !vision {
+				out = append(out, map[string]interface{}{"type": "input_text", "text": imageOmittedPlaceholder})
+				continue
+			}
+			if img := imagePartToInputImage(m); img != nil {
+				out = append(out, img)
+			}
+		default:
+			text, _ := m["text"].(string)
+			if text == "" {
+				continue
+			}
+			out = append(out, map[string]interface{}{"type": "input_text", "text": names.apply(role, text)})
+		}
+	}
+	return out
+}
+
+// imagePartToInputImage maps an OpenAI image_url part onto a Codex
+// input_image item. Both https URLs and data: base64 URIs are passed through
+// as-is; the optional detail hint is preserved.
+func imagePartToInputImage(part map[string]interface{}) map[string]interface{} {
+	var url, detail string
+	switch v := part["image_url"].(type) {
+	case string:
+		url = v
+	case map[string]interface{}:
+		url, _ = v["url"].(string)
+		detail, _ = v["detail"].(string)
+	}
+	if d, ok := part["detail"].(string); ok && detail == "" {
+		detail = d
+	}
+	url = strings.TrimSpace(url)
+	if url == "" {
+		return nil
+	}
+	img := map[string]interface{}{
+		"type":      "input_image",
+		"image_url": url,
+	}
+	if detail != "" {
+		img["detail"] = detail
+	}
+	return img
+}
+
+func containsImageParts(content interface{}) bool {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range parts {
+		if m, ok := item.(map[string]interface{}); ok {
+			if typ, _ := m["type"].(string); typ == "image_url" || typ == "input_image" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func extractArgumentsString(arg interface{}) string {
 	switch v := arg.(type) {
 	case string:
@@ -733,7 +779,7 @@ func collectToolOutput(content interface{}) string {
 func mapToolsToCodex(requestData map[string]interface{}) []interface{} {
 	toolsRaw, ok := requestData["tools"].([]interface{})
 	if !ok {
-		return nil
+		return mapLegacyFunctionsToCodex(requestData)
 	}
 	out := make([]interface{}, 0, len(toolsRaw))
 	for _, t := range toolsRaw {
@@ -742,6 +788,9 @@ func mapToolsToCodex(requestData map[string]interface{}) []interface{} {
 			continue
 		}
 		if tm["type"] != "function" {
+			if builtin, ok := mapBuiltinToolToCodex(tm); ok {
+				out = append(out, builtin)
+			}
 			continue
 		}
 		fn, _ := tm["function"].(map[string]interface{})
@@ -751,17 +800,94 @@ func mapToolsToCodex(requestData map[string]interface{}) []interface{} {
 		name, _ := fn["name"].(string)
 		desc, _ := fn["description"].(string)
 		params := fn["parameters"]
+		strict, _ := fn["strict"].(bool)
 		out = append(out, map[string]interface{}{
 			"type":        "function",
 			"name":        name,
 			"description": desc,
-			"strict":      false,
+			"strict":      strict,
 			"parameters":  params,
 		})
 	}
 	return out
 }
 
+// mapLegacyFunctionsToCodex maps the deprecated functions array (bare
+// {name, description, parameters} objects) to Codex function tools.
+func mapLegacyFunctionsToCodex(requestData map[string]interface{}) []interface{} {
+	fnsRaw, ok := requestData["functions"].([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]interface{}, 0, len(fnsRaw))
+	for _, f := range fnsRaw {
+		fn, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := fn["name"].(string)
+		desc, _ := fn["description"].(string)
+		out = append(out, map[string]interface{}{
+			"type":        "function",
+			"name":        name,
+			"description": desc,
+			"strict":      false,
+			"parameters":  fn["parameters"],
+		})
+	}
+	return out
+}
+
+// usesLegacyFunctions reports whether the request uses the deprecated
+// functions/function_call form instead of tools/tool_choice.
+func usesLegacyFunctions(requestData map[string]interface{}) bool {
+	if _, ok := requestData["tools"]; ok {
+		return false
+	}
+	_, ok := requestData["functions"].([]interface{})
+	return ok
+}
+
+// mapToolChoiceToCodex maps tool_choice (or the legacy function_call) to the
+// Responses API shape:
+//
+//	"auto" | "none" | "required"                      -> unchanged
+//	{"type":"function","function":{"name":"x"}}       -> {"type":"function","name":"x"}
+//	{"type":"custom","custom":{"name":"x"}}           -> {"type":"custom","name":"x"}
+//	function_call: "auto" | "none" | {"name":"x"}     -> "auto" | "none" | {"type":"function","name":"x"}
+func mapToolChoiceToCodex(requestData map[string]interface{}) interface{} {
+	choice, ok := requestData["tool_choice"]
+	if !ok || choice == nil {
+		choice = requestData["function_call"]
+	}
+	switch tc := choice.(type) {
+	case string:
+		switch tc {
+		case "auto", "none", "required":
+			return tc
+		}
+	case map[string]interface{}:
+		switch typ, _ := tc["type"].(string); typ {
+		case "custom":
+			custom, _ := tc["custom"].(map[string]interface{})
+			if name, _ := custom["name"].(string); name != "" {
+				return map[string]interface{}{"type": "custom", "name": name}
+			}
+		case "web_search", "web_search_preview":
+			return map[string]interface{}{"type": typ}
+		default:
+			name, _ := tc["name"].(string)
+			if fn, ok := tc["function"].(map[string]interface{}); ok {
+				name, _ = fn["name"].(string)
+			}
+			if name != "" {
+				return map[string]interface{}{"type": "function", "name": name}
+			}
+		}
+	}
+	return "auto"
+}
+
 // ===== SSE Response Transformation =====
 
 type SSETransformer struct {
@@ -773,9 +899,53 @@ type SSETransformer struct {
 	toolIndexByItemID map[string]int    // fc_* -> index in tool_calls
 	toolIDByItemID    map[string]string // fc_* -> call_id (OpenAI id)
 	toolNameByItemID  map[string]string // fc_* -> function name
+	toolInputStreamed map[string]bool   // ctc_* -> custom tool input arrived as deltas
 	nextToolIndex     int
 	// whether we saw any tool calls in this response (affects finish_reason)
 	sawToolCalls bool
+	// limiter enforces stop sequences and max tokens; stopped is set once it
+	// has cut the stream, after which upstream events are ignored.
+	limiter *outputLimiter
+	stopped bool
+	// legacyFunctions emits a single function_call delta instead of tool_calls
+	legacyFunctions bool
+	// reasoning captures encrypted reasoning items for replay on later turns
+	reasoning *reasoningRecorder
+	// reasoningMode selects how reasoning text is emitted (see reasoning_output.go)
+	reasoningMode string
+	// includeUsage moves usage into a trailing usage-only chunk
+	includeUsage bool
+	// think block and merged-item state for the think and merged modes
+	thinkOpen, thinkDone bool
+	lastReasoningItem    string
+	// prefix is emitted ahead of the next transformed event's output
+	prefix []byte
+}
+
+// chatStreamOptions are per-request settings for translating a Codex stream
+// into chat completion chunks.
+type chatStreamOptions struct {
+	limits outputLimits
+	// legacyFunctions is set when the client used the deprecated
+	// functions/function_call request form and expects function_call output.
+	legacyFunctions bool
+	// reasoningStore receives the response's encrypted reasoning items.
+	reasoningStore *reasoningStore
+	// reasoningScope files those items under the client and turn.
+	reasoningScope reasoningScope
+	// reasoningMode is one of the reasoningOutput* modes; empty means the
+	// default reasoning_content output.
+	reasoningMode string
+	// includeUsage mirrors stream_options.include_usage.
+	includeUsage bool
+}
+
+func chatStreamOptionsFromRequest(requestData map[string]interface{}) chatStreamOptions {
+	return chatStreamOptions{
+		limits:          chatOutputLimits(requestData),
+		legacyFunctions: usesLegacyFunctions(requestData),
+		includeUsage:    includeUsageRequested(requestData),
+	}
 }
 
 func NewSSETransformer(model string) *SSETransformer {
@@ -791,7 +961,37 @@ func NewSSETransformer(model string) *SSETransformer {
 	}
 }
 
+// WithOptions applies per-request settings: stop sequences and a max token
+// budget on the output text, and the legacy function_call output shape.
+func (t *SSETransformer) WithOptions(opts chatStreamOptions) *SSETransformer {
+	t.limiter = newOutputLimiter(opts.limits)
+	t.legacyFunctions = opts.legacyFunctions
+	t.reasoning = opts.reasoningStore.recorder(opts.reasoningScope)
+	t.reasoningMode = opts.reasoningMode
+	t.includeUsage = opts.includeUsage
+	return t
+}
+
+// Stopped reports whether the output limits cut the stream short. Callers
+// should stop reading upstream once this is true.
+func (t *SSETransformer) Stopped() bool {
+	return t.stopped
+}
+
 func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err error) {
+	out, done, err = t.transform(dataLine)
+	if len(t.prefix) > 0 && err == nil {
+		if len(out) > 0 {
+			out = bytes.Join([][]byte{t.prefix, out}, []byte("\n"))
+		} else {
+			out = t.prefix
+		}
+		t.prefix = nil
+	}
+	return out, done, err
+}
+
+func (t *SSETransformer) transform(dataLine []byte) (out []byte, done bool, err error) {
 	trimmed := bytes.TrimSpace(dataLine)
 	if len(trimmed) == 0 {
 		return nil, false, nil
@@ -799,6 +999,9 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 	if bytes.Equal(trimmed, []byte("[DONE]")) {
 		return nil, true, nil
 	}
+	if t.stopped {
+		return nil, false, nil
+	}
 
 	// fmt.Println left here commented to avoid overwhelming logs with raw Codex events.
 	// fmt.Println(string(dataLine))
@@ -810,6 +1013,12 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 
 	eventType, _ := upstream["type"].(string)
 
+	if eventType == "response.output_item.done" && t.reasoning != nil {
+		if item, ok := upstream["item"].(map[string]interface{}); ok {
+			t.reasoning.observe(item)
+		}
+	}
+
 	sendRole := func(seq interface{}) ([]byte, error) {
 		if t.roleSent {
 			return nil, nil
@@ -837,14 +1046,26 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		return b, nil
 	}
 
+	if t.thinkOpen && closesThinkBlock(eventType, upstream) {
+		t.thinkOpen = false
+		if t.prefix, err = t.deltaChunk(upstream["sequence_number"], map[string]interface{}{"content": "\n</think>\n\n"}); err != nil {
+			return nil, false, err
+		}
+	}
+
 	if strings.HasPrefix(eventType, "response.reasoning") {
+		if t.reasoningMode == reasoningOutputNone {
+			return nil, false, nil
+		}
 		// The upstream API can send multiple reasoning items (with incrementing
 		// output_index) in a single response stream. This can result in multiple
 		// "Thinking" bubbles appearing in the client UI for a single turn, which
 		// can be confusing. To simplify the UI, we only process the first
 		// reasoning item (output_index: 0) and explicitly ignore any subsequent
-		// reasoning items in the same stream.
-		if outputIndex, ok := upstream["output_index"].(float64); ok && outputIndex > 0 {
+		// reasoning items in the same stream, unless the client asked for all
+		// of them to be merged.
+		outputIndex, _ := upstream["output_index"].(float64)
+		if outputIndex > 0 && t.reasoningMode != reasoningOutputMerged {
 			return nil, false, nil
 		}
 
@@ -855,6 +1076,25 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		if reasoningText == "" {
 			return nil, false, nil
 		}
+		switch t.reasoningMode {
+		case reasoningOutputMerged:
+			itemKey, _ := upstream["item_id"].(string)
+			if itemKey == "" {
+				itemKey = fmt.Sprint(outputIndex)
+			}
+			if t.lastReasoningItem != "" && itemKey != t.lastReasoningItem {
+				reasoningText = "\n\n" + reasoningText
+			}
+			t.lastReasoningItem = itemKey
+		case reasoningOutputThink:
+			if t.thinkDone && !t.thinkOpen {
+				return nil, false, nil
+			}
+			if !t.thinkOpen {
+				t.thinkOpen, t.thinkDone = true, true
+				reasoningText = "<think>\n" + reasoningText
+			}
+		}
 		var chunks [][]byte
 		if rb, err := sendRole(upstream["sequence_number"]); err != nil {
 			return nil, false, err
@@ -868,10 +1108,8 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 			"model":   t.model,
 			"choices": []interface{}{
 				map[string]interface{}{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"reasoning_content": reasoningText,
-					},
+					"index":         0,
+					"delta":         reasoningDelta(t.reasoningMode, reasoningText),
 					"finish_reason": nil,
 				},
 			},
@@ -884,6 +1122,10 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		return bytes.Join(chunks, []byte("\n")), false, nil
 	}
 
+	if out, handled, err := t.transformBuiltinToolEvent(eventType, upstream, sendRole); handled {
+		return out, false, err
+	}
+
 	switch eventType {
 	case "response.created":
 		if resp, ok := upstream["response"].(map[string]interface{}); ok {
@@ -919,6 +1161,10 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		t.toolIDByItemID[fcID] = callID
 		t.toolNameByItemID[fcID] = name
 		t.sawToolCalls = true
+		// The legacy function_call shape holds a single call.
+		if t.legacyFunctions && idx > 0 {
+			return nil, false, nil
+		}
 
 		var chunks [][]byte
 		// Emit role if not yet sent
@@ -928,6 +1174,24 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 			chunks = append(chunks, rb)
 		}
 		// Emit initial tool_call delta with id, type and function name
+		startDelta := map[string]interface{}{
+			"tool_calls": []interface{}{
+				map[string]interface{}{
+					"index": idx,
+					"id":    callID,
+					"type":  "function",
+					"function": map[string]interface{}{
+						"name":      name,
+						"arguments": "",
+					},
+				},
+			},
+		}
+		if t.legacyFunctions {
+			startDelta = map[string]interface{}{
+				"function_call": map[string]interface{}{"name": name, "arguments": ""},
+			}
+		}
 		toolStart := map[string]interface{}{
 			"id":      t.responseID,
 			"object":  "chat.completion.chunk",
@@ -935,20 +1199,8 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 			"model":   t.model,
 			"choices": []interface{}{
 				map[string]interface{}{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"tool_calls": []interface{}{
-							map[string]interface{}{
-								"index": idx,
-								"id":    callID,
-								"type":  "function",
-								"function": map[string]interface{}{
-									"name":      name,
-									"arguments": "",
-								},
-							},
-						},
-					},
+					"index":         0,
+					"delta":         startDelta,
 					"finish_reason": nil,
 				},
 			},
@@ -964,10 +1216,25 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		// Stream arguments for a given function call
 		itemID, _ := upstream["item_id"].(string) // fc_*
 		idx, ok := t.toolIndexByItemID[itemID]
-		if !ok {
+		if !ok || (t.legacyFunctions && idx > 0) {
 			return nil, false, nil
 		}
 		argDelta, _ := upstream["delta"].(string)
+		argsDelta := map[string]interface{}{
+			"tool_calls": []interface{}{
+				map[string]interface{}{
+					"index": idx,
+					"function": map[string]interface{}{
+						"arguments": argDelta,
+					},
+				},
+			},
+		}
+		if t.legacyFunctions {
+			argsDelta = map[string]interface{}{
+				"function_call": map[string]interface{}{"arguments": argDelta},
+			}
+		}
 		var chunks [][]byte
 		// Ensure role
 		if rb, err := sendRole(upstream["sequence_number"]); err != nil {
@@ -982,17 +1249,8 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 			"model":   t.model,
 			"choices": []interface{}{
 				map[string]interface{}{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"tool_calls": []interface{}{
-							map[string]interface{}{
-								"index": idx,
-								"function": map[string]interface{}{
-									"arguments": argDelta,
-								},
-							},
-						},
-					},
+					"index":         0,
+					"delta":         argsDelta,
 					"finish_reason": nil,
 				},
 			},
@@ -1013,6 +1271,16 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		return nil, false, nil
 
 	case "response.output_text.delta":
+		// Send content delta
+		delta, _ := upstream["delta"].(string)
+		finish := ""
+		if t.limiter != nil {
+			delta, finish = t.limiter.feed(delta)
+			if delta == "" && finish == "" {
+				return nil, false, nil
+			}
+		}
+
 		var chunks [][]byte
 		// Emit role if not yet sent
 		if rb, err := sendRole(upstream["sequence_number"]); err != nil {
@@ -1020,8 +1288,6 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 		} else if len(rb) > 0 {
 			chunks = append(chunks, rb)
 		}
-		// Send content delta
-		delta, _ := upstream["delta"].(string)
 
 		// Debug logging for whitespace content (disabled by default)
 		// Uncomment for debugging whitespace issues:
@@ -1044,17 +1310,99 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 				},
 			},
 		}
-		contentBytes, err := json.Marshal(contentChunk)
-		if err != nil {
-			return nil, false, fmt.Errorf("failed to marshal content chunk: %w", err)
+		if delta != "" || finish == "" {
+			contentBytes, err := json.Marshal(contentChunk)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to marshal content chunk: %w", err)
+			}
+			chunks = append(chunks, contentBytes)
+		}
+		if finish != "" {
+			// A proxy-enforced limit was hit: close the choice ourselves. The
+			// caller stops reading and cancels the upstream request.
+			t.stopped = true
+			var usage map[string]interface{}
+			if prompt, completion, ok := t.limiter.stopUsage(); ok {
+				usage = map[string]interface{}{
+					"prompt_tokens":     prompt,
+					"completion_tokens": completion,
+					"total_tokens":      prompt + completion,
+				}
+			}
+			finalChunks, err := t.finishChunks(upstream["sequence_number"], finish, usage)
+			if err != nil {
+				return nil, false, err
+			}
+			chunks = append(chunks, finalChunks...)
 		}
-		chunks = append(chunks, contentBytes)
 		return bytes.Join(chunks, []byte("\n")), false, nil
 
-	case "response.completed":
+	case "response.refusal.delta":
+		delta, _ := upstream["delta"].(string)
+		if delta == "" {
+			return nil, false, nil
+		}
+		var chunks [][]byte
+		if rb, err := sendRole(upstream["sequence_number"]); err != nil {
+			return nil, false, err
+		} else if len(rb) > 0 {
+			chunks = append(chunks, rb)
+		}
+		b, err := t.deltaChunk(upstream["sequence_number"], map[string]interface{}{"refusal": delta})
+		if err != nil {
+			return nil, false, err
+		}
+		return bytes.Join(append(chunks, b), []byte("\n")), false, nil
+
+	case "response.failed", "error":
+		// The upstream gave up mid-stream. Report it in-stream the way OpenAI
+		// does instead of ending with a clean but truncated completion.
+		t.stopped = true
+		b, err := json.Marshal(map[string]interface{}{"error": streamError(eventType, upstream).object()})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal error chunk: %w", err)
+		}
+		return b, false, nil
+
+	case "response.completed", "response.incomplete":
 		finish := "stop"
 		if t.sawToolCalls {
 			finish = "tool_calls"
+			if t.legacyFunctions {
+				finish = "function_call"
+			}
+		}
+		if eventType == "response.incomplete" {
+			finish = incompleteFinishReason(upstream)
+		}
+
+		// Release text held back while checking for a stop sequence.
+		var heldChunks [][]byte
+		if t.limiter != nil {
+			if held := t.limiter.flush(); held != "" {
+				if rb, err := sendRole(upstream["sequence_number"]); err != nil {
+					return nil, false, err
+				} else if len(rb) > 0 {
+					heldChunks = append(heldChunks, rb)
+				}
+				heldChunk, err := json.Marshal(map[string]interface{}{
+					"id":      t.responseID,
+					"object":  "chat.completion.chunk",
+					"created": upstream["sequence_number"],
+					"model":   t.model,
+					"choices": []interface{}{
+						map[string]interface{}{
+							"index":         0,
+							"delta":         map[string]interface{}{"content": held},
+							"finish_reason": nil,
+						},
+					},
+				})
+				if err != nil {
+					return nil, false, fmt.Errorf("failed to marshal content chunk: %w", err)
+				}
+				heldChunks = append(heldChunks, heldChunk)
+			}
 		}
 
 		// Map upstream usage (if present) into an OpenAI-style usage object.
@@ -1086,6 +1434,7 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 						}
 					}
 				}
+				addUsageDetails(u, outUsage)
 				if len(outUsage) > 0 {
 					usage = outUsage
 				}
@@ -1099,25 +1448,11 @@ func (t *SSETransformer) Transform(dataLine []byte) (out []byte, done bool, err
 			}
 		}
 
-		finalChunk := map[string]interface{}{
-			"id":      t.responseID,
-			"object":  "chat.completion.chunk",
-			"created": upstream["sequence_number"],
-			"model":   t.model,
-			"choices": []interface{}{
-				map[string]interface{}{
-					"index":         0,
-					"delta":         map[string]interface{}{},
-					"finish_reason": finish,
-				},
-			},
-			"usage": usage,
-		}
-		finalBytes, err := json.Marshal(finalChunk)
+		finalChunks, err := t.finishChunks(upstream["sequence_number"], finish, usage)
 		if err != nil {
-			return nil, false, fmt.Errorf("failed to marshal final chunk: %w", err)
+			return nil, false, err
 		}
-		return finalBytes, false, nil
+		return bytes.Join(append(heldChunks, finalChunks...), []byte("\n")), false, nil
 
 	default:
 		// Ignore other event types
@@ -1223,9 +1558,17 @@ func RewriteSSEStream(r io.Reader, w io.Writer, model string) error {
 // RewriteSSEStreamWithCallback aggregates multi-line data: blocks per SSE event,
 // transforms each event, writes it out, and invokes onEvent for debug if set.
 func RewriteSSEStreamWithCallback(r io.Reader, w io.Writer, model string, onEvent func(raw []byte, out []byte, done bool)) error {
+	return RewriteSSEStreamWithOptions(r, w, model, chatStreamOptions{}, onEvent)
+}
+
+// RewriteSSEStreamWithOptions is RewriteSSEStreamWithCallback with per-request
+// stream options. When a proxy-side stop sequence or max tokens limit is hit
+// the stream is finished with the matching finish_reason and the rest of r is
+// left unread.
+func RewriteSSEStreamWithOptions(r io.Reader, w io.Writer, model string, opts chatStreamOptions, onEvent func(raw []byte, out []byte, done bool)) error {
 	scanner := bufio.NewScanner(r)
 	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
-	transformer := NewSSETransformer(model)
+	transformer := NewSSETransformer(model).WithOptions(opts)
 
 	var dataLines [][]byte
 	doneSeen := false
@@ -1293,6 +1636,9 @@ func RewriteSSEStreamWithCallback(r io.Reader, w io.Writer, model string, onEven
 			if err := flushEvent(); err != nil {
 				return err
 			}
+			if transformer.Stopped() {
+				break
+			}
 			continue
 		}
 		// Handle comment lines or fields
@@ -1334,9 +1680,22 @@ func RewriteSSEStreamWithCallback(r io.Reader, w io.Writer, model string, onEven
 // PassThroughSSEStream copies upstream SSE events directly to the downstream writer
 // without any transformation.
 func PassThroughSSEStream(r io.Reader, w io.Writer) error {
+	return PassThroughSSEStreamWithLimits(r, w, outputLimits{})
+}
+
+// PassThroughSSEStreamWithLimits copies a Responses API stream while enforcing
+// max_output_tokens: once the budget is spent the last text delta is
+// truncated, a response.incomplete event is synthesized and the rest of r is
+// left unread.
+func PassThroughSSEStreamWithLimits(r io.Reader, w io.Writer, limits outputLimits) error {
 	scanner := bufio.NewScanner(r)
 	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
-	var dataLines [][]byte
+	limiter := newOutputLimiter(limits)
+	var (
+		dataLines [][]byte
+		response  map[string]interface{}
+		stopped   bool
+	)
 	flushEvent := func() error {
 		if len(dataLines) == 0 {
 			return nil
@@ -1351,6 +1710,33 @@ func PassThroughSSEStream(r io.Reader, w io.Writer) error {
 			return nil
 		}
 
+		if limiter != nil {
+			var evt map[string]interface{}
+			if err := json.Unmarshal(raw, &evt); err == nil {
+				switch evt["type"] {
+				case "response.created", "response.in_progress":
+					response, _ = evt["response"].(map[string]interface{})
+				case "response.output_text.delta":
+					delta, _ := evt["delta"].(string)
+					emit, finish := limiter.feed(delta)
+					if finish != "" {
+						stopped = true
+						evt["delta"] = emit
+						truncated, err := json.Marshal(evt)
+						if err != nil {
+							return err
+						}
+						incomplete, err := incompleteResponseEvent(response, evt["sequence_number"], limiter)
+						if err != nil {
+							return err
+						}
+						_, err = fmt.Fprintf(w, "data: %s\n\ndata: %s\n\n", truncated, incomplete)
+						return err
+					}
+				}
+			}
+		}
+
 		if len(raw) > 0 {
 			if _, err := w.Write([]byte("data: ")); err != nil {
 				return err
@@ -1371,6 +1757,9 @@ func PassThroughSSEStream(r io.Reader, w io.Writer) error {
 			if err := flushEvent(); err != nil {
 				return err
 			}
+			if stopped {
+				return nil
+			}
 			continue
 		}
 		if bytes.HasPrefix(line, []byte(":")) {
@@ -1392,3 +1781,30 @@ func PassThroughSSEStream(r io.Reader, w io.Writer) error {
 	}
 	return flushEvent()
 }
+
+// incompleteResponseEvent builds the response.incomplete event sent when the
+// proxy stops a Responses stream at max_output_tokens. Usage is included only
+// when the limiter counted it.
+func incompleteResponseEvent(response map[string]interface{}, sequence interface{}, limiter *outputLimiter) ([]byte, error) {
+	resp := map[string]interface{}{}
+	for k, v := range response {
+		resp[k] = v
+	}
+	resp["status"] = "incomplete"
+	resp["incomplete_details"] = map[string]interface{}{"reason": "max_output_tokens"}
+	if prompt, completion, ok := limiter.stopUsage(); ok {
+		resp["usage"] = map[string]interface{}{
+			"input_tokens":  prompt,
+			"output_tokens": completion,
+			"total_tokens":  prompt + completion,
+		}
+	}
+	evt := map[string]interface{}{
+		"type":     "response.incomplete",
+		"response": resp,
+	}
+	if seq, ok := sequence.(float64); ok {
+		evt["sequence_number"] = seq + 1
+	}
+	return json.Marshal(evt)
+}
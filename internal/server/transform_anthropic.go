@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// anthropicToChatRequest converts an Anthropic Messages API request into the
+// OpenAI Chat Completions shape understood by buildCodexRequestBody. Anthropic
+// content blocks are mapped as follows:
+//   - system (string or text blocks) -> a leading system message
+//   - text blocks                    -> text content parts
+//   - image blocks                   -> image_url content parts
+//   - tool_use blocks                -> assistant tool_calls
+//   - tool_result blocks             -> tool messages keyed by tool_use_id
+//
+// thinking / redacted_thinking blocks are dropped since they cannot be
+// replayed against the Codex backend.
+func anthropicToChatRequest(requestData map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	if model, ok := requestData["model"]; ok {
+		out["model"] = model
+	}
+
+	var messages []interface{}
+
+	// Names are rewritten once, by buildCodexRequestBody, on the system
+	// message built here.
+	systemBlocks, err := transformSystemPrompt(requestData, nil)
+	if err != nil {
+		return nil, err
+	}
+	var systemParts []string
+	for _, block := range systemBlocks {
+		if text, _ := block["text"].(string); strings.TrimSpace(text) != "" {
+			systemParts = append(systemParts, text)
+		}
+	}
+	if len(systemParts) > 0 {
+		messages = append(messages, map[string]interface{}{
+			"role":    "system",
+			"content": strings.Join(systemParts, "\n\n"),
+		})
+	}
+
+	msgs, ok := requestData["messages"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("messages field is not an array")
+	}
+	for _, m := range msgs {
+		mm, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := mm["role"].(string)
+		switch role {
+		case "user":
+			messages = append(messages, anthropicUserToChatMessages(mm["content"])...)
+		case "assistant":
+			if msg := anthropicAssistantToChatMessage(mm["content"]); msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	out["messages"] = messages
+
+	if tools := anthropicToolsToChat(requestData["tools"]); len(tools) > 0 {
+		out["tools"] = tools
+	}
+
+	parallel := true
+	if tc, ok := requestData["tool_choice"].(map[string]interface{}); ok {
+		typ, _ := tc["type"].(string)
+		switch typ {
+		case "auto":
+			out["tool_choice"] = "auto"
+		case "any":
+			out["tool_choice"] = "required"
+		case "none":
+			out["tool_choice"] = "none"
+		case "tool":
+			name, _ := tc["name"].(string)
+			out["tool_choice"] = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": name},
+			}
+		}
+		if disable, ok := tc["disable_parallel_tool_use"].(bool); ok && disable {
+			parallel = false
+		}
+	}
+	out["parallel_tool_calls"] = parallel
+
+	if effort := anthropicThinkingToEffort(requestData["thinking"]); effort != "" {
+		out["reasoning_effort"] = effort
+	}
+
+	for _, key := range []string{"stream", "max_tokens", "temperature", "top_p"} {
+		if v, ok := requestData[key]; ok {
+			out[key] = v
+		}
+	}
+	if stops, ok := requestData["stop_sequences"].([]interface{}); ok && len(stops) > 0 {
+		out["stop"] = stops
+	}
+
+	return out, nil
+}
+
+// anthropicUserToChatMessages splits an Anthropic user turn into tool messages
+// (one per tool_result block) followed by a user message holding the remaining
+// text and image blocks. Tool results come first since Anthropic requires them
+// to lead the turn that answers the preceding tool_use blocks.
+func anthropicUserToChatMessages(content interface{}) []interface{} {
+	if text, ok := content.(string); ok {
+		return []interface{}{map[string]interface{}{"role": "user", "content": text}}
+	}
+	blocks, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var out []interface{}
+	var parts []interface{}
+	for _, b := range blocks {
+		bm, ok := b.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch typ, _ := bm["type"].(string); typ {
+		case "text":
+			if text, _ := bm["text"].(string); text != "" {
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+			}
+		case "image":
+			if part := anthropicImageToChatPart(bm); part != nil {
+				parts = append(parts, part)
+			}
+		case "tool_result":
+			callID, _ := bm["tool_use_id"].(string)
+			if callID == "" {
+				continue
+			}
+			out = append(out, map[string]interface{}{
+				"role":         "tool",
+				"tool_call_id": callID,
+				"content":      anthropicToolResultContent(bm["content"]),
+			})
+		}
+	}
+	if len(parts) > 0 {
+		out = append(out, map[string]interface{}{"role": "user", "content": parts})
+	}
+	return out
+}
+
+// anthropicAssistantToChatMessage merges an Anthropic assistant turn into a
+// single chat message with text content and tool_calls.
+func anthropicAssistantToChatMessage(content interface{}) map[string]interface{} {
+	if text, ok := content.(string); ok {
+		return map[string]interface{}{"role": "assistant", "content": text}
+	}
+	blocks, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var texts []string
+	var toolCalls []interface{}
+	for _, b := range blocks {
+		bm, ok := b.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch typ, _ := bm["type"].(string); typ {
+		case "text":
+			if text, _ := bm["text"].(string); text != "" {
+				texts = append(texts, text)
+			}
+		case "tool_use":
+			id, _ := bm["id"].(string)
+			name, _ := bm["name"].(string)
+			input := bm["input"]
+			if input == nil {
+				input = map[string]interface{}{}
+			}
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":   id,
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      name,
+					"arguments": extractArgumentsString(input),
+				},
+			})
+		}
+	}
+	if len(texts) == 0 && len(toolCalls) == 0 {
+		return nil
+	}
+	msg := map[string]interface{}{
+		"role":    "assistant",
+		"content": strings.Join(texts, "\n\n"),
+	}
+	if len(toolCalls) > 0 {
+		msg["tool_calls"] = toolCalls
+	}
+	return msg
+}
+
+// anthropicToolResultContent maps tool_result content (a string or an array of
+// text/image blocks) onto chat tool message content.
+func anthropicToolResultContent(content interface{}) interface{} {
+	blocks, ok := content.([]interface{})
+	if !ok {
+		return content
+	}
+	parts := make([]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		bm, ok := b.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch typ, _ := bm["type"].(string); typ {
+		case "text":
+			if text, _ := bm["text"].(string); text != "" {
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+			}
+		case "image":
+			if part := anthropicImageToChatPart(bm); part != nil {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// anthropicImageToChatPart converts an Anthropic image block (base64 or url
+// source) into an OpenAI image_url content part.
+func anthropicImageToChatPart(block map[string]interface{}) map[string]interface{} {
+	source, _ := block["source"].(map[string]interface{})
+	if source == nil {
+		return nil
+	}
+	var url string
+	switch typ, _ := source["type"].(string); typ {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		if data == "" {
+			return nil
+		}
+		url = "data:" + mediaType + ";base64," + data
+	case "url":
+		url, _ = source["url"].(string)
+	}
+	if url == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]interface{}{"url": url},
+	}
+}
+
+// anthropicToolsToChat maps Anthropic custom tools (name/description/input_schema)
+// onto OpenAI function tools. Anthropic server tools (web_search_*, bash_*, …)
+// have no Codex equivalent on this path and are skipped.
+func anthropicToolsToChat(raw interface{}) []interface{} {
+	tools, ok := raw.([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]interface{}, 0, len(tools))
+	for _, t := range tools {
+		tm, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if typ, _ := tm["type"].(string); typ != "" && typ != "custom" {
+			continue
+		}
+		name, _ := tm["name"].(string)
+		if name == "" {
+			continue
+		}
+		desc, _ := tm["description"].(string)
+		params := tm["input_schema"]
+		if params == nil {
+			params = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		out = append(out, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        name,
+				"description": desc,
+				"parameters":  params,
+			},
+		})
+	}
+	return out
+}
+
+// anthropicThinkingToEffort maps an extended thinking budget onto a Codex
+// reasoning effort. Requests without thinking keep the model default.
+func anthropicThinkingToEffort(raw interface{}) string {
+	thinking, ok := raw.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if typ, _ := thinking["type"].(string); typ != "enabled" {
+		return ""
+	}
+	budget, _ := thinking["budget_tokens"].(float64)
+	switch {
+	case budget <= 0:
+		return "medium"
+	case budget < 4096:
+		return "low"
+	case budget < 16384:
+		return "medium"
+	case budget < 32768:
+		return "high"
+	default:
+		return "xhigh"
+	}
+}
+
+// anthropicToolInput decodes accumulated function call arguments into the
+// object Anthropic clients expect in tool_use.input.
+func anthropicToolInput(arguments string) map[string]interface{} {
+	input := map[string]interface{}{}
+	if strings.TrimSpace(arguments) == "" {
+		return input
+	}
+	if err := json.Unmarshal([]byte(arguments), &input); err != nil || input == nil {
+		return map[string]interface{}{}
+	}
+	return input
+}
+
+// anthropicMessageID derives an Anthropic-style message id from a Codex
+// response id.
+func anthropicMessageID(responseID string) string {
+	if responseID == "" {
+		return "msg_" + strings.ReplaceAll(newUUIDv4(), "-", "")
+	}
+	return "msg_" + strings.TrimPrefix(responseID, "resp_")
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AnthropicSSETransformer converts Codex response.* events into Anthropic
+// Messages API streaming events (message_start, content_block_*, message_delta,
+// message_stop). Unlike SSETransformer it returns fully framed SSE events,
+// including the "event:" line Anthropic clients dispatch on.
+type AnthropicSSETransformer struct {
+	model     string
+	messageID string
+	started   bool
+	stopped   bool
+	// content block tracking: Anthropic blocks are strictly sequential, so only
+	// one block is open at a time.
+	nextBlockIndex   int
+	openBlockIndex   int
+	openBlockKey     string
+	blockOpen        bool
+	lastSummaryIndex float64
+	sawToolUse       bool
+	// limiter enforces max_tokens and stop_sequences; limited is set once it
+	// ended the message.
+	limiter *outputLimiter
+	limited bool
+}
+
+func NewAnthropicSSETransformer(model string) *AnthropicSSETransformer {
+	return NewAnthropicSSETransformerWithLimits(model, outputLimits{})
+}
+
+// NewAnthropicSSETransformerWithLimits returns a transformer that also
+// enforces the request's output limits on text deltas.
+func NewAnthropicSSETransformerWithLimits(model string, limits outputLimits) *AnthropicSSETransformer {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		model = modelGPT5
+	}
+	return &AnthropicSSETransformer{model: model, limiter: newOutputLimiter(limits)}
+}
+
+// Stopped reports whether the output limits ended the message. Callers
+// should stop reading and cancel the upstream request.
+func (t *AnthropicSSETransformer) Stopped() bool {
+	return t.limited
+}
+
+func (t *AnthropicSSETransformer) Transform(dataLine []byte) (out []byte, done bool, err error) {
+	trimmed := bytes.TrimSpace(dataLine)
+	if len(trimmed) == 0 {
+		return nil, false, nil
+	}
+	if bytes.Equal(trimmed, []byte("[DONE]")) {
+		return nil, true, nil
+	}
+	if t.stopped {
+		return nil, false, nil
+	}
+
+	var upstream map[string]interface{}
+	if err := json.Unmarshal(trimmed, &upstream); err != nil {
+		return nil, false, fmt.Errorf("invalid upstream JSON chunk: %w", err)
+	}
+	eventType, _ := upstream["type"].(string)
+
+	var buf bytes.Buffer
+	emit := func(name string, payload interface{}) error {
+		b, err := anthropicSSEEvent(name, payload)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		return nil
+	}
+
+	if eventType == "response.created" {
+		if resp, ok := upstream["response"].(map[string]interface{}); ok {
+			if id, ok := resp["id"].(string); ok {
+				t.messageID = anthropicMessageID(id)
+			}
+		}
+	}
+	if err := t.ensureStarted(emit); err != nil {
+		return nil, false, err
+	}
+
+	if strings.HasPrefix(eventType, "response.reasoning") {
+		if !strings.Contains(eventType, ".delta") {
+			return buf.Bytes(), false, nil
+		}
+		text := extractReasoningContent(upstream)
+		if text == "" {
+			return buf.Bytes(), false, nil
+		}
+		itemID, _ := upstream["item_id"].(string)
+		key := "thinking:" + itemID
+		if t.blockOpen && t.openBlockKey == key {
+			if idx, ok := upstream["summary_index"].(float64); ok && idx != t.lastSummaryIndex {
+				text = "\n\n" + text
+				t.lastSummaryIndex = idx
+			}
+		} else {
+			if err := t.openBlock(emit, key, map[string]interface{}{"type": "thinking", "thinking": ""}); err != nil {
+				return nil, false, err
+			}
+			t.lastSummaryIndex, _ = upstream["summary_index"].(float64)
+		}
+		if err := emit("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": t.openBlockIndex,
+			"delta": map[string]interface{}{"type": "thinking_delta", "thinking": text},
+		}); err != nil {
+			return nil, false, err
+		}
+		return buf.Bytes(), false, nil
+	}
+
+	switch eventType {
+	case "response.output_text.delta":
+		delta, _ := upstream["delta"].(string)
+		itemID, _ := upstream["item_id"].(string)
+		finish := ""
+		if t.limiter != nil {
+			delta, finish = t.limiter.feed(delta)
+		}
+		if delta != "" || t.limiter == nil {
+			if err := t.textDelta(emit, "text:"+itemID, delta); err != nil {
+				return nil, false, err
+			}
+		}
+		if finish != "" {
+			// A proxy-enforced limit was hit: end the message ourselves.
+			t.limited = true
+			stopReason, stopSequence := anthropicLimitStop(t.limiter, finish)
+			if err := t.finish(emit, stopReason, stopSequence, anthropicStopUsage(t.limiter)); err != nil {
+				return nil, false, err
+			}
+		}
+
+	case "response.output_item.added":
+		item, _ := upstream["item"].(map[string]interface{})
+		if typ, _ := item["type"].(string); typ != "function_call" {
+			break
+		}
+		itemID, _ := item["id"].(string)
+		callID, _ := item["call_id"].(string)
+		if callID == "" {
+			callID = "call_" + itemID
+		}
+		name, _ := item["name"].(string)
+		t.sawToolUse = true
+		if err := t.openBlock(emit, "tool:"+itemID, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    callID,
+			"name":  name,
+			"input": map[string]interface{}{},
+		}); err != nil {
+			return nil, false, err
+		}
+
+	case "response.function_call_arguments.delta":
+		itemID, _ := upstream["item_id"].(string)
+		if !t.blockOpen || t.openBlockKey != "tool:"+itemID {
+			break
+		}
+		delta, _ := upstream["delta"].(string)
+		if err := emit("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": t.openBlockIndex,
+			"delta": map[string]interface{}{"type": "input_json_delta", "partial_json": delta},
+		}); err != nil {
+			return nil, false, err
+		}
+
+	case "response.output_item.done":
+		item, _ := upstream["item"].(map[string]interface{})
+		itemID, _ := item["id"].(string)
+		if typ, _ := item["type"].(string); typ == "message" && t.limiter != nil {
+			// Release text held back while checking for a stop sequence.
+			if held := t.limiter.flush(); held != "" {
+				if err := t.textDelta(emit, "text:"+itemID, held); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+		if t.blockOpen && strings.HasSuffix(t.openBlockKey, ":"+itemID) {
+			if err := t.closeBlock(emit); err != nil {
+				return nil, false, err
+			}
+		}
+
+	case "response.completed", "response.incomplete":
+		resp, _ := upstream["response"].(map[string]interface{})
+		if t.limiter != nil {
+			if held := t.limiter.flush(); held != "" {
+				key := "text:"
+				if t.blockOpen && strings.HasPrefix(t.openBlockKey, key) {
+					key = t.openBlockKey
+				}
+				if err := t.textDelta(emit, key, held); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+		stopReason := "end_turn"
+		if t.sawToolUse {
+			stopReason = "tool_use"
+		}
+		if eventType == "response.incomplete" {
+			stopReason = "max_tokens"
+		}
+		if err := t.finish(emit, stopReason, nil, anthropicUsageFromResponse(resp)); err != nil {
+			return nil, false, err
+		}
+
+	case "response.failed", "error":
+		if err := t.fail(emit, upstreamErrorMessage(upstream)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return buf.Bytes(), false, nil
+}
+
+// Finish terminates a stream that ended without response.completed. The
+// client receives an error event instead of a silently truncated message.
+func (t *AnthropicSSETransformer) Finish() ([]byte, error) {
+	if t.stopped {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	emit := func(name string, payload interface{}) error {
+		b, err := anthropicSSEEvent(name, payload)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		return nil
+	}
+	if err := t.fail(emit, "upstream stream ended before the response completed"); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *AnthropicSSETransformer) ensureStarted(emit func(string, interface{}) error) error {
+	if t.started {
+		return nil
+	}
+	if t.messageID == "" {
+		t.messageID = anthropicMessageID("")
+	}
+	t.started = true
+	return emit("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            t.messageID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         t.model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         map[string]interface{}{"input_tokens": 0, "output_tokens": 0},
+		},
+	})
+}
+
+func (t *AnthropicSSETransformer) openBlock(emit func(string, interface{}) error, key string, block map[string]interface{}) error {
+	if err := t.closeBlock(emit); err != nil {
+		return err
+	}
+	t.openBlockIndex = t.nextBlockIndex
+	t.nextBlockIndex++
+	t.openBlockKey = key
+	t.blockOpen = true
+	return emit("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         t.openBlockIndex,
+		"content_block": block,
+	})
+}
+
+// textDelta emits text into the text block key, opening it if needed.
+func (t *AnthropicSSETransformer) textDelta(emit func(string, interface{}) error, key, text string) error {
+	if !t.blockOpen || t.openBlockKey != key {
+		if err := t.openBlock(emit, key, map[string]interface{}{"type": "text", "text": ""}); err != nil {
+			return err
+		}
+	}
+	return emit("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": t.openBlockIndex,
+		"delta": map[string]interface{}{"type": "text_delta", "text": text},
+	})
+}
+
+func (t *AnthropicSSETransformer) closeBlock(emit func(string, interface{}) error) error {
+	if !t.blockOpen {
+		return nil
+	}
+	t.blockOpen = false
+	t.openBlockKey = ""
+	return emit("content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": t.openBlockIndex,
+	})
+}
+
+func (t *AnthropicSSETransformer) finish(emit func(string, interface{}) error, stopReason string, stopSequence *string, usage AnthropicUsage) error {
+	if err := t.closeBlock(emit); err != nil {
+		return err
+	}
+	t.stopped = true
+	if err := emit("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": usage,
+	}); err != nil {
+		return err
+	}
+	return emit("message_stop", map[string]interface{}{"type": "message_stop"})
+}
+
+func (t *AnthropicSSETransformer) fail(emit func(string, interface{}) error, message string) error {
+	t.stopped = true
+	return emit("error", map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": "api_error", "message": message},
+	})
+}
+
+func anthropicSSEEvent(name string, payload interface{}) ([]byte, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s event: %w", name, err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("event: ")
+	buf.WriteString(name)
+	buf.WriteString("\ndata: ")
+	buf.Write(b)
+	buf.WriteString("\n\n")
+	return buf.Bytes(), nil
+}
+
+// RewriteAnthropicSSEStream reads an upstream Codex SSE stream and writes the
+// equivalent Anthropic Messages streaming events to w, invoking onEvent for
+// debug visibility if set.
+func RewriteAnthropicSSEStream(r io.Reader, w io.Writer, model string, onEvent func(raw []byte, out []byte, done bool)) error {
+	return RewriteAnthropicSSEStreamWithLimits(r, w, model, outputLimits{}, onEvent)
+}
+
+// RewriteAnthropicSSEStreamWithLimits is RewriteAnthropicSSEStream with
+// max_tokens and stop_sequences enforced; once a limit is hit the message is
+// finished and the rest of r is left unread.
+func RewriteAnthropicSSEStreamWithLimits(r io.Reader, w io.Writer, model string, limits outputLimits, onEvent func(raw []byte, out []byte, done bool)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	transformer := NewAnthropicSSETransformerWithLimits(model, limits)
+
+	var dataLines [][]byte
+	flushEvent := func() error {
+		if len(dataLines) == 0 {
+			return nil
+		}
+		raw := bytes.Join(dataLines, []byte("\n"))
+		dataLines = dataLines[:0]
+
+		out, done, err := transformer.Transform(raw)
+		if onEvent != nil {
+			onEvent(raw, out, done)
+		}
+		if err != nil {
+			return err
+		}
+		if len(out) > 0 {
+			if _, err := w.Write(out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err := flushEvent(); err != nil {
+				return err
+			}
+			if transformer.Stopped() {
+				return nil
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(":")) {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("data:")) {
+			payload := bytes.TrimPrefix(line, []byte("data:"))
+			if len(payload) > 0 && payload[0] == ' ' {
+				payload = payload[1:]
+			}
+			cp := make([]byte, len(payload))
+			copy(cp, payload)
+			dataLines = append(dataLines, cp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flushEvent(); err != nil {
+		return err
+	}
+	out, err := transformer.Finish()
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnthropicToChatRequest_ToolRoundTrip(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "claude-sonnet-4",
+		"max_tokens": 1024,
+		"system": [{"type":"text","text":"Be brief.","cache_control":{"type":"ephemeral"}}],
+		"tools": [{"name":"get_weather","description":"Weather lookup","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}],
+		"tool_choice": {"type":"any","disable_parallel_tool_use":true},
+		"thinking": {"type":"enabled","budget_tokens":8000},
+		"messages": [
+			{"role":"user","content":"Weather in Paris?"},
+			{"role":"assistant","content":[
+				{"type":"thinking","thinking":"Need the tool","signature":"sig"},
+				{"type":"text","text":"Checking."},
+				{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}
+			]},
+			{"role":"user","content":[
+				{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"Sunny"}]},
+				{"type":"text","text":"Thanks"}
+			]}
+		]
+	}`), &requestData))
+
+	chat, err := anthropicToChatRequest(requestData)
+	require.NoError(t, err)
+
+	assert.Equal(t, "required", chat["tool_choice"])
+	assert.Equal(t, false, chat["parallel_tool_calls"])
+	assert.Equal(t, "medium", chat["reasoning_effort"])
+
+	messages := chat["messages"].([]interface{})
+	require.Len(t, messages, 5)
+	assert.Equal(t, "system", messages[0].(map[string]interface{})["role"])
+	assert.Equal(t, "Be brief.", messages[0].(map[string]interface{})["content"])
+
+	assistant := messages[2].(map[string]interface{})
+	assert.Equal(t, "Checking.", assistant["content"])
+	toolCall := assistant["tool_calls"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "toolu_1", toolCall["id"])
+	assert.JSONEq(t, `{"city":"Paris"}`, toolCall["function"].(map[string]interface{})["arguments"].(string))
+
+	toolMsg := messages[3].(map[string]interface{})
+	assert.Equal(t, "tool", toolMsg["role"])
+	assert.Equal(t, "toolu_1", toolMsg["tool_call_id"])
+	assert.Equal(t, "user", messages[4].(map[string]interface{})["role"])
+
+	body := buildCodexRequestBody(chat, nil, nil)
+	input := body["input"].([]interface{})
+	var types []string
+	for _, item := range input {
+		typ, _ := item.(map[string]interface{})["type"].(string)
+		types = append(types, typ)
+	}
+	assert.Contains(t, types, "function_call")
+	assert.Contains(t, types, "function_call_output")
+
+	tools := body["tools"].([]interface{})
+	require.Len(t, tools, 1)
+	assert.Equal(t, "get_weather", tools[0].(map[string]interface{})["name"])
+}
+
+func TestBufferAnthropicMessageFromSSE(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.created","response":{"id":"resp_abc"}}`,
+		"",
+		`data: {"type":"response.output_item.done","output_index":0,"item":{"type":"reasoning","summary":[{"type":"summary_text","text":"Thinking it over"}]}}`,
+		"",
+		`data: {"type":"response.output_item.done","output_index":1,"item":{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Let me check."}]}}`,
+		"",
+		`data: {"type":"response.output_item.done","output_index":2,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}`,
+		"",
+		`data: {"type":"response.completed","response":{"usage":{"input_tokens":100,"output_tokens":20,"input_tokens_details":{"cached_tokens":40}}}}`,
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+
+	msg, err := bufferAnthropicMessageFromSSE(strings.NewReader(src), "gpt-5", outputLimits{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "msg_abc", msg.ID)
+	assert.Equal(t, "message", msg.Type)
+	assert.Equal(t, "tool_use", msg.StopReason)
+	require.Len(t, msg.Content, 3)
+	assert.Equal(t, "thinking", msg.Content[0].Type)
+	assert.Equal(t, "Let me check.", msg.Content[1].Text)
+	assert.Equal(t, "tool_use", msg.Content[2].Type)
+	assert.Equal(t, "call_1", msg.Content[2].ID)
+	assert.Equal(t, "Paris", msg.Content[2].Input["city"])
+	assert.Equal(t, 60, msg.Usage.InputTokens)
+	assert.Equal(t, 40, msg.Usage.CacheReadInputTokens)
+	assert.Equal(t, 20, msg.Usage.OutputTokens)
+}
+
+func TestAnthropicContentBlockToolUseAlwaysHasInput(t *testing.T) {
+	for _, arguments := range []string{"", "null", "{}"} {
+		b, err := json.Marshal(AnthropicContentBlock{Type: "tool_use", ID: "call_1", Name: "now", Input: anthropicToolInput(arguments)})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"type":"tool_use","id":"call_1","name":"now","input":{}}`, string(b), arguments)
+	}
+	b, err := json.Marshal(AnthropicContentBlock{Type: "tool_use", ID: "call_1", Name: "now"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"tool_use","id":"call_1","name":"now","input":{}}`, string(b))
+
+	b, err = json.Marshal(AnthropicContentBlock{Type: "text", Text: "hi"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"text","text":"hi"}`, string(b))
+}
+
+func TestBufferAnthropicMessageFromSSE_Failed(t *testing.T) {
+	src := `data: {"type":"response.failed","response":{"error":{"message":"boom"}}}` + "\n\n"
+	_, err := bufferAnthropicMessageFromSSE(strings.NewReader(src), "gpt-5", outputLimits{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "boom")
+}
+
+func TestRewriteAnthropicSSEStream(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.created","response":{"id":"resp_stream"}}`,
+		"",
+		`data: {"type":"response.reasoning_summary_text.delta","item_id":"rs_1","summary_index":0,"delta":"Hmm"}`,
+		"",
+		`data: {"type":"response.output_item.done","item":{"id":"rs_1","type":"reasoning"}}`,
+		"",
+		`data: {"type":"response.output_text.delta","item_id":"msg_1","delta":"Hello"}`,
+		"",
+		`data: {"type":"response.output_item.done","item":{"id":"msg_1","type":"message"}}`,
+		"",
+		`data: {"type":"response.output_item.added","item":{"id":"fc_1","type":"function_call","call_id":"call_1","name":"get_weather"}}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","item_id":"fc_1","delta":"{\"city\":"}`,
+		"",
+		`data: {"type":"response.output_item.done","item":{"id":"fc_1","type":"function_call"}}`,
+		"",
+		`data: {"type":"response.completed","response":{"usage":{"input_tokens":10,"output_tokens":5}}}`,
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+
+	var dst strings.Builder
+	require.NoError(t, RewriteAnthropicSSEStream(strings.NewReader(src), &dst, "gpt-5", nil))
+	out := dst.String()
+
+	var events []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	assert.Equal(t, []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta",
+		"message_stop",
+	}, events)
+	assert.Contains(t, out, `"id":"msg_stream"`)
+	assert.Contains(t, out, `"delta":{"thinking":"Hmm","type":"thinking_delta"}`)
+	assert.Contains(t, out, `"delta":{"text":"Hello","type":"text_delta"}`)
+	assert.Contains(t, out, `"delta":{"partial_json":"{\"city\":","type":"input_json_delta"}`)
+	assert.Contains(t, out, `"stop_reason":"tool_use"`)
+	assert.Contains(t, out, `"output_tokens":5`)
+}
+
+func TestRewriteAnthropicSSEStream_TruncatedEmitsError(t *testing.T) {
+	src := `data: {"type":"response.output_text.delta","item_id":"msg_1","delta":"Hel"}` + "\n\n"
+	var dst strings.Builder
+	require.NoError(t, RewriteAnthropicSSEStream(strings.NewReader(src), &dst, "gpt-5", nil))
+	out := dst.String()
+	assert.Contains(t, out, "event: error\n")
+	assert.NotContains(t, out, "message_stop")
+}
+
+func TestRewriteAnthropicSSEStreamWithLimits_StopSequence(t *testing.T) {
+	src := &trackingReader{r: strings.NewReader(textDeltaStream("Thought: ok\nObs", "ervation: nope", " more"))}
+	var dst strings.Builder
+	require.NoError(t, RewriteAnthropicSSEStreamWithLimits(src, &dst, "gpt-5", outputLimits{stop: []string{"Observation:"}}, nil))
+
+	out := dst.String()
+	assert.Contains(t, out, `"delta":{"text":"Thought: ok\n","type":"text_delta"}`)
+	assert.NotContains(t, out, "nope")
+	assert.Contains(t, out, `"stop_reason":"stop_sequence","stop_sequence":"Observation:"`)
+	assert.Contains(t, out, "event: message_stop\n")
+	assert.False(t, src.eof, "upstream should not be drained after the stop sequence")
+}
+
+func TestRewriteAnthropicSSEStreamWithLimits_MaxTokens(t *testing.T) {
+	var dst strings.Builder
+	limits := outputLimits{maxTokens: 6}.withTokenizer(byteTokenizer(t), 42)
+	require.NoError(t, RewriteAnthropicSSEStreamWithLimits(strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl")), &dst, "gpt-5", limits, nil))
+
+	out := dst.String()
+	assert.Contains(t, out, `"text":"ef"`)
+	assert.NotContains(t, out, "ijkl")
+	assert.Contains(t, out, `"stop_reason":"max_tokens","stop_sequence":null`)
+	assert.Contains(t, out, `"usage":{"input_tokens":42,"output_tokens":6}`)
+}
+
+func TestRewriteAnthropicSSEStreamWithLimits_ReleasesHeldText(t *testing.T) {
+	var dst strings.Builder
+	require.NoError(t, RewriteAnthropicSSEStreamWithLimits(strings.NewReader(textDeltaStream("done Obs")), &dst, "gpt-5", outputLimits{stop: []string{"Observation:"}}, nil))
+
+	out := dst.String()
+	assert.Contains(t, out, `"text":"done "`)
+	assert.Contains(t, out, `"text":"Obs"`)
+	assert.Contains(t, out, `"stop_reason":"end_turn"`)
+}
+
+func TestBufferAnthropicMessageFromSSE_Limits(t *testing.T) {
+	src := &trackingReader{r: strings.NewReader(textDeltaStream("Thought: ok\nObs", "ervation: nope", " more"))}
+	msg, err := bufferAnthropicMessageFromSSE(src, "gpt-5", outputLimits{stop: []string{"Observation:"}})
+	require.NoError(t, err)
+	require.Len(t, msg.Content, 1)
+	assert.Equal(t, "Thought: ok\n", msg.Content[0].Text)
+	assert.Equal(t, "stop_sequence", msg.StopReason)
+	require.NotNil(t, msg.StopSequence)
+	assert.Equal(t, "Observation:", *msg.StopSequence)
+	assert.False(t, src.eof)
+
+	msg, err = bufferAnthropicMessageFromSSE(strings.NewReader(textDeltaStream("abcd", "efgh", "ijkl")), "gpt-5", outputLimits{maxTokens: 2})
+	require.NoError(t, err)
+	require.Len(t, msg.Content, 1)
+	assert.Equal(t, "abcdefgh", msg.Content[0].Text)
+	assert.Equal(t, "max_tokens", msg.StopReason)
+	assert.Nil(t, msg.StopSequence)
+
+	msg, err = bufferAnthropicMessageFromSSE(strings.NewReader(textDeltaStream("done Obs")), "gpt-5", outputLimits{stop: []string{"Observation:"}})
+	require.NoError(t, err)
+	require.Len(t, msg.Content, 1)
+	assert.Equal(t, "done Obs", msg.Content[0].Text)
+	assert.Equal(t, "end_turn", msg.StopReason)
+}
+
+func TestMessagesHandler_EnforcesMaxTokensAndStopSequences(t *testing.T) {
+	s := newTestServer(&fakeUpstream{respond: func(_ int, req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		assert.NotContains(t, string(body), "max_tokens")
+		return http.StatusOK, textDeltaStream("one two", " END three", " four")
+	}})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.messagesHandler(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec
+	}
+
+	var msg AnthropicMessageResponse
+	rec := post(`{"model":"gpt-5","max_tokens":1024,"stop_sequences":["END"],"messages":[{"role":"user","content":"count"}]}`)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+	require.Len(t, msg.Content, 1)
+	assert.Equal(t, "one two ", msg.Content[0].Text)
+	assert.Equal(t, "stop_sequence", msg.StopReason)
+	require.NotNil(t, msg.StopSequence)
+	assert.Equal(t, "END", *msg.StopSequence)
+
+	rec = post(`{"model":"gpt-5","max_tokens":1,"stream":true,"messages":[{"role":"user","content":"count"}]}`)
+	out := rec.Body.String()
+	assert.Contains(t, out, `"text":"one "`)
+	assert.NotContains(t, out, "three")
+	assert.Contains(t, out, `"stop_reason":"max_tokens"`)
+	assert.Contains(t, out, "event: message_stop\n")
+}
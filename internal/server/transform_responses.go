@@ -2,7 +2,7 @@ package server
 
 import "strings"
 
-func transformResponsesRequestBody(body map[string]interface{}, requestedModel string, requestedEffort string) (string, string) {
+func transformResponsesRequestBody(body map[string]interface{}, requestedModel string, requestedEffort string, names *nameRuleSet) (string, string) {
 	normalizedModel := normalizeModel(requestedModel)
 	body["model"] = normalizedModel
 
@@ -48,20 +48,20 @@ func transformResponsesRequestBody(body map[string]interface{}, requestedModel s
 		body["instructions"] = userInstr
 		developerMsg := map[string]interface{}{
 			"role":    "developer",
-			"content": replaceNames(systemText),
+			"content": systemText,
 		}
 		allInstructions = append([]interface{}{developerMsg}, allInstructions...)
 	} else if userInstr != "" {
 		body["instructions"] = userInstr
 	} else if systemText != "" {
-		body["instructions"] = replaceNames(systemText)
+		body["instructions"] = names.apply(nameRoleSystem, systemText)
 	} else {
 		body["instructions"] = ""
 	}
 
 	body["input"] = allInstructions
 
-	sanitizeResponsesInput(body)
+	sanitizeResponsesInput(body, names)
 
 	// Always request reasoning encrypted content to match Codex expectations
 	body["include"] = []interface{}{"reasoning.encrypted_content"}
@@ -100,18 +100,14 @@ func transformResponsesRequestBody(body map[string]interface{}, requestedModel s
 
 	delete(body, "reasoning_effort")
 
-	if _, ok := body["prompt_cache_key"].(string); !ok {
-		instructions, _ := body["instructions"].(string)
-		firstText := extractFirstUserText(body)
-		if key := derivePromptCacheKey(normalizedModel, instructions, firstText); key != "" {
-			body["prompt_cache_key"] = key
-		}
-	}
+	applyModelAlias(body, requestedModel)
 
 	return normalizedModel, clampedEffort
 }
 
-func sanitizeResponsesInput(body map[string]interface{}) {
+// sanitizeResponsesInput drops system messages from input, which are moved to
+// instructions, and rewrites names in user, developer and tool output items.
+func sanitizeResponsesInput(body map[string]interface{}, names *nameRuleSet) {
 	input, ok := body["input"].([]interface{})
 	if !ok {
 		return
@@ -123,21 +119,32 @@ func sanitizeResponsesInput(body map[string]interface{}) {
 			filtered = append(filtered, msg)
 			continue
 		}
-		if role, _ := msgMap["role"].(string); role == "system" {
+		role, _ := msgMap["role"].(string)
+		switch role {
+		case "system":
 			continue
+		case "developer":
+			role = nameRoleSystem
 		}
-		contents, ok := msgMap["content"].([]interface{})
-		if !ok {
-			filtered = append(filtered, msg)
-			continue
-		}
-		for _, item := range contents {
-			itemMap, ok := item.(map[string]interface{})
-			if !ok {
-				continue
+		switch typ, _ := msgMap["type"].(string); typ {
+		case "function_call_output", "custom_tool_call_output":
+			if output, ok := msgMap["output"].(string); ok {
+				msgMap["output"] = names.apply(nameRoleTool, output)
 			}
-			if text, ok := itemMap["text"].(string); ok && text != "" {
-				itemMap["text"] = replaceNames(text)
+		case "", "message":
+			switch contents := msgMap["content"].(type) {
+			case string:
+				msgMap["content"] = names.apply(role, contents)
+			case []interface{}:
+				for _, item := range contents {
+					itemMap, ok := item.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					if text, ok := itemMap["text"].(string); ok && text != "" {
+						itemMap["text"] = names.apply(role, text)
+					}
+				}
 			}
 		}
 		filtered = append(filtered, msg)
@@ -22,7 +22,7 @@ func TestTransformResponsesRequestBody(t *testing.T) {
 		"reasoning_effort": "none",
 	}
 
-	normalizedModel, normalizedEffort := transformResponsesRequestBody(body, "gpt-5-codex-preview", "none")
+	normalizedModel, normalizedEffort := transformResponsesRequestBody(body, "gpt-5-codex-preview", "none", defaultNameRuleSet())
 
 	if normalizedModel != "gpt-5-codex" {
 		t.Fatalf("expected normalized model gpt-5-codex, got %q", normalizedModel)
@@ -128,7 +128,7 @@ func TestTransformResponsesRequestBody_ModelSpecificReasoningClamp(t *testing.T)
 	// Case 1: explicit low effort gets clamped to medium
 	body1 := baseBody()
 	requestedEffort1 := "low"
-	nModel1, nEffort1 := transformResponsesRequestBody(body1, "gpt-5.1-codex-mini", requestedEffort1)
+	nModel1, nEffort1 := transformResponsesRequestBody(body1, "gpt-5.1-codex-mini", requestedEffort1, nil)
 	if nModel1 != "gpt-5.1-codex-mini" {
 		t.Fatalf("expected normalized model gpt-5.1-codex-mini, got %q", nModel1)
 	}
@@ -142,7 +142,7 @@ func TestTransformResponsesRequestBody_ModelSpecificReasoningClamp(t *testing.T)
 
 	// Case 2: no effort provided defaults to model-specific default (medium)
 	body2 := baseBody()
-	nModel2, nEffort2 := transformResponsesRequestBody(body2, "gpt-5.1-codex-mini", "")
+	nModel2, nEffort2 := transformResponsesRequestBody(body2, "gpt-5.1-codex-mini", "", nil)
 	if nModel2 != "gpt-5.1-codex-mini" {
 		t.Fatalf("expected normalized model gpt-5.1-codex-mini, got %q", nModel2)
 	}
@@ -157,7 +157,7 @@ func TestTransformResponsesRequestBody_ModelSpecificReasoningClamp(t *testing.T)
 	// Case 3: gpt-5.1-codex-max preserves xhigh and defaults to low when unspecified
 	body3 := baseBody()
 	requestedEffort3 := "xhigh"
-	nModel3, nEffort3 := transformResponsesRequestBody(body3, "gpt-5.1-codex-max", requestedEffort3)
+	nModel3, nEffort3 := transformResponsesRequestBody(body3, "gpt-5.1-codex-max", requestedEffort3, nil)
 	if nModel3 != "gpt-5.1-codex-max" {
 		t.Fatalf("expected normalized model gpt-5.1-codex-max, got %q", nModel3)
 	}
@@ -170,7 +170,7 @@ func TestTransformResponsesRequestBody_ModelSpecificReasoningClamp(t *testing.T)
 	}
 
 	body4 := baseBody()
-	nModel4, nEffort4 := transformResponsesRequestBody(body4, "gpt-5.1-codex-max", "")
+	nModel4, nEffort4 := transformResponsesRequestBody(body4, "gpt-5.1-codex-max", "", nil)
 	if nModel4 != "gpt-5.1-codex-max" {
 		t.Fatalf("expected normalized model gpt-5.1-codex-max, got %q", nModel4)
 	}
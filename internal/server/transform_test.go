@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -244,3 +245,195 @@ func TestClampReasoningEffortForModel(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildCodexInputMessages_ImageParts(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gpt-5.3-codex",
+		"messages": [
+			{"role":"user","content":[
+				{"type":"text","text":"What is this?"},
+				{"type":"image_url","image_url":{"url":"https://example.com/cat.png","detail":"high"}},
+				{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}
+			]},
+			{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"screenshot","arguments":"{}"}}]},
+			{"role":"tool","tool_call_id":"call_1","content":[
+				{"type":"text","text":"captured"},
+				{"type":"image_url","image_url":{"url":"data:image/jpeg;base64,/9j/4AAQ"}}
+			]}
+		]
+	}`), &requestData))
+
+	input := buildCodexInputMessages(requestData, nil)
+	require.Len(t, input, 4)
+
+	user := input[1].(map[string]interface{})
+	content := user["content"].([]interface{})
+	require.Len(t, content, 3)
+	assert.Equal(t, "input_text", content[0].(map[string]interface{})["type"])
+	assert.Equal(t, map[string]interface{}{"type": "input_image", "image_url": "https://example.com/cat.png", "detail": "high"}, content[1])
+	assert.Equal(t, "data:image/png;base64,iVBORw0KGgo=", content[2].(map[string]interface{})["image_url"])
+
+	toolOutput := input[3].(map[string]interface{})["output"].([]interface{})
+	require.Len(t, toolOutput, 2)
+	assert.Equal(t, "input_image", toolOutput[1].(map[string]interface{})["type"])
+}
+
+func TestBuildCodexInputMessages_ImagePlaceholderWithoutVision(t *testing.T) {
+	requestData := map[string]interface{}{
+		"model": modelGPT53CodexSpark,
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/a.png"}},
+			}},
+		},
+	}
+
+	input := buildCodexInputMessages(requestData, nil)
+	require.Len(t, input, 2)
+	content := input[1].(map[string]interface{})["content"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "input_text", "text": imageOmittedPlaceholder}, content[0])
+}
+
+func TestBuildCodexRequestBody_ResponseFormatJSONSchema(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gpt-5",
+		"messages": [{"role":"user","content":"Extract"}],
+		"response_format": {"type":"json_schema","json_schema":{"name":"invoice","strict":true,"schema":{"type":"object","properties":{"total":{"type":"number"}},"required":["total"],"additionalProperties":false}}}
+	}`), &requestData))
+
+	body := buildCodexRequestBody(requestData, nil, nil)
+	text, ok := body["text"].(map[string]interface{})
+	require.True(t, ok)
+	format := text["format"].(map[string]interface{})
+	assert.Equal(t, "json_schema", format["type"])
+	assert.Equal(t, "invoice", format["name"])
+	assert.Equal(t, true, format["strict"])
+	assert.NotNil(t, format["schema"])
+
+	requestData["response_format"] = map[string]interface{}{"type": "json_object"}
+	body = buildCodexRequestBody(requestData, nil, nil)
+	assert.Equal(t, map[string]interface{}{"format": map[string]interface{}{"type": "json_object"}}, body["text"])
+
+	delete(requestData, "response_format")
+	body = buildCodexRequestBody(requestData, nil, nil)
+	_, ok = body["text"]
+	assert.False(t, ok)
+}
+
+func TestValidateStructuredOutput(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"response_format": {"type":"json_schema","json_schema":{"name":"order","schema":{
+			"type":"object",
+			"properties":{"items":{"type":"array","items":{"$ref":"#/$defs/item"}},"note":{"type":["string","null"]}},
+			"required":["items","note"],
+			"additionalProperties":false,
+			"$defs":{"item":{"type":"object","properties":{"sku":{"type":"string"},"qty":{"type":"integer"}},"required":["sku","qty"]}}
+		}}}
+	}`), &requestData))
+
+	assert.NoError(t, validateStructuredOutput(requestData, `{"items":[{"sku":"a","qty":2}],"note":null}`))
+
+	err := validateStructuredOutput(requestData, `{"items":[{"sku":"a","qty":2.5}],"note":null}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "$.items[0].qty")
+
+	err = validateStructuredOutput(requestData, `{"items":[],"note":null,"extra":1}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `additional property "extra"`)
+
+	err = validateStructuredOutput(requestData, `Sure! Here is the JSON`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not valid JSON")
+
+	requestData["response_format"] = map[string]interface{}{"type": "json_object"}
+	assert.Error(t, validateStructuredOutput(requestData, `[1,2]`))
+	assert.NoError(t, validateStructuredOutput(requestData, `{"ok":true}`))
+}
+
+func TestMapToolChoiceToCodex(t *testing.T) {
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		want    interface{}
+	}{
+		{"default", map[string]interface{}{}, "auto"},
+		{"required", map[string]interface{}{"tool_choice": "required"}, "required"},
+		{"none", map[string]interface{}{"tool_choice": "none"}, "none"},
+		{"forced function", map[string]interface{}{"tool_choice": map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "lookup"}}}, map[string]interface{}{"type": "function", "name": "lookup"}},
+		{"legacy none", map[string]interface{}{"function_call": "none"}, "none"},
+		{"legacy forced", map[string]interface{}{"function_call": map[string]interface{}{"name": "lookup"}}, map[string]interface{}{"type": "function", "name": "lookup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mapToolChoiceToCodex(tt.request))
+		})
+	}
+}
+
+func TestBuildCodexRequestBody_LegacyFunctions(t *testing.T) {
+	var requestData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "gpt-5",
+		"functions": [{"name":"lookup","description":"Look up","parameters":{"type":"object"}}],
+		"function_call": {"name":"lookup"},
+		"parallel_tool_calls": true,
+		"messages": [
+			{"role":"user","content":"find x"},
+			{"role":"assistant","content":null,"function_call":{"name":"lookup","arguments":"{\"q\":\"x\"}"}},
+			{"role":"function","name":"lookup","content":"found"}
+		]
+	}`), &requestData))
+
+	body := buildCodexRequestBody(requestData, nil, nil)
+	assert.Equal(t, map[string]interface{}{"type": "function", "name": "lookup"}, body["tool_choice"])
+	assert.Equal(t, false, body["parallel_tool_calls"])
+
+	tools := body["tools"].([]interface{})
+	require.Len(t, tools, 1)
+	assert.Equal(t, "lookup", tools[0].(map[string]interface{})["name"])
+
+	var call, output map[string]interface{}
+	for _, item := range body["input"].([]interface{}) {
+		m := item.(map[string]interface{})
+		switch m["type"] {
+		case "function_call":
+			call = m
+		case "function_call_output":
+			output = m
+		}
+	}
+	require.NotNil(t, call)
+	require.NotNil(t, output)
+	assert.Equal(t, `{"q":"x"}`, call["arguments"])
+	assert.Equal(t, call["call_id"], output["call_id"])
+	assert.Equal(t, "found", output["output"])
+}
+
+func TestSSETransformer_LegacyFunctionCallDeltas(t *testing.T) {
+	src := strings.Join([]string{
+		`data: {"type":"response.output_item.added","sequence_number":1,"item":{"type":"function_call","id":"fc_1","call_id":"call_1","name":"lookup"}}`,
+		"",
+		`data: {"type":"response.function_call_arguments.delta","sequence_number":2,"item_id":"fc_1","delta":"{\"q\":1}"}`,
+		"",
+		`data: {"type":"response.completed","sequence_number":3,"response":{}}`,
+		"",
+	}, "\n")
+
+	var dst strings.Builder
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(src), &dst, "gpt-5", chatStreamOptions{legacyFunctions: true}, nil))
+	out := dst.String()
+	assert.Contains(t, out, `"function_call":{"arguments":"","name":"lookup"}`)
+	assert.Contains(t, out, `"function_call":{"arguments":"{\"q\":1}"}`)
+	assert.Contains(t, out, `"finish_reason":"function_call"`)
+	assert.NotContains(t, out, "tool_calls")
+
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(src), "gpt-5", chatStreamOptions{legacyFunctions: true})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Choices[0].Message.FunctionCall)
+	assert.Equal(t, "lookup", resp.Choices[0].Message.FunctionCall.Name)
+	assert.Equal(t, `{"q":1}`, resp.Choices[0].Message.FunctionCall.Arguments)
+	assert.Equal(t, "function_call", resp.Choices[0].FinishReason)
+}
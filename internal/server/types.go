@@ -3,8 +3,68 @@ package server
 import "encoding/json"
 
 type ChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string            `json:"role"`
+	Content          string            `json:"content"`
+	ReasoningContent string            `json:"reasoning_content,omitempty"`
+	Reasoning        string            `json:"reasoning,omitempty"`
+	Refusal          string            `json:"refusal,omitempty"`
+	ToolCalls        []ToolCall        `json:"tool_calls,omitempty"`
+	FunctionCall     *ToolCallFunction `json:"function_call,omitempty"`
+}
+
+// ToolCall is a completed tool call on an assistant message. Function is set
+// for function tools, Custom for freeform custom tools.
+type ToolCall struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Function *ToolCallFunction `json:"function,omitempty"`
+	Custom   *CustomToolCall   `json:"custom,omitempty"`
+}
+
+type CustomToolCall struct {
+	Name  string `json:"name"`
+	Input string `json:"input"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Usage is the OpenAI-style token usage object.
+type Usage struct {
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+// add accumulates o into u, including the token detail breakdowns.
+func (u *Usage) add(o *Usage) {
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.TotalTokens += o.TotalTokens
+	if o.PromptTokensDetails != nil {
+		if u.PromptTokensDetails == nil {
+			u.PromptTokensDetails = &PromptTokensDetails{}
+		}
+		u.PromptTokensDetails.CachedTokens += o.PromptTokensDetails.CachedTokens
+	}
+	if o.CompletionTokensDetails != nil {
+		if u.CompletionTokensDetails == nil {
+			u.CompletionTokensDetails = &CompletionTokensDetails{}
+		}
+		u.CompletionTokensDetails.ReasoningTokens += o.CompletionTokensDetails.ReasoningTokens
+	}
 }
 
 type ChatCompletionRequest struct {
@@ -54,4 +114,50 @@ type ChatCompletionResponse struct {
 	Created int64                  `json:"created"`
 	Model   string                 `json:"model"`
 	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *Usage                 `json:"usage,omitempty"`
+}
+
+// AnthropicContentBlock is a single content block in an Anthropic Messages API
+// response (text, thinking or tool_use).
+type AnthropicContentBlock struct {
+	Type      string                 `json:"type"`
+	Text      string                 `json:"text,omitempty"`
+	Thinking  string                 `json:"thinking,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Input     map[string]interface{} `json:"input"`
+}
+
+// MarshalJSON always writes input on tool_use blocks, which Anthropic clients
+// require even for tools without arguments, and leaves it off other blocks.
+func (b AnthropicContentBlock) MarshalJSON() ([]byte, error) {
+	type block AnthropicContentBlock
+	if b.Type == "tool_use" {
+		if b.Input == nil {
+			b.Input = map[string]interface{}{}
+		}
+		return json.Marshal(block(b))
+	}
+	return json.Marshal(struct {
+		block
+		Input map[string]interface{} `json:"input,omitempty"`
+	}{block: block(b)})
+}
+
+type AnthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
+}
+
+type AnthropicMessageResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
 }
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Upstream endpoints. Requests go to the Codex backend at UPSTREAM_BASE_URL
+// (default https://chatgpt.com/backend-api/codex): responses are posted to
+// UPSTREAM_RESPONSES_PATH under it, and the model catalog is read from
+// /models. The WebSocket transport derives its URL from the responses URL, so
+// pointing the base URL at a mock backend, an egress gateway or another proxy
+// tier moves every upstream request.
+const (
+	defaultUpstreamBaseURL       = "https://chatgpt.com/backend-api/codex"
+	defaultUpstreamResponsesPath = "/responses"
+	upstreamModelsPath           = "/models"
+)
+
+// UpstreamConfig locates the Codex backend.
+type UpstreamConfig struct {
+	// BaseURL is the backend root, such as https://chatgpt.com/backend-api/codex.
+	BaseURL string
+	// ResponsesPath is the Responses endpoint, relative to BaseURL.
+	ResponsesPath string
+}
+
+// UpstreamConfigFromEnv reads UPSTREAM_BASE_URL and UPSTREAM_RESPONSES_PATH.
+func UpstreamConfigFromEnv() UpstreamConfig {
+	return UpstreamConfig{
+		BaseURL:       env.GetOrDefault("UPSTREAM_BASE_URL", defaultUpstreamBaseURL),
+		ResponsesPath: env.GetOrDefault("UPSTREAM_RESPONSES_PATH", defaultUpstreamResponsesPath),
+	}
+}
+
+// normalize fills in defaults and checks that the base URL is absolute http(s).
+func (c UpstreamConfig) normalize() (UpstreamConfig, error) {
+	c.BaseURL = strings.TrimRight(strings.TrimSpace(c.BaseURL), "/")
+	if c.BaseURL == "" {
+		c.BaseURL = defaultUpstreamBaseURL
+	}
+	c.ResponsesPath = strings.TrimSpace(c.ResponsesPath)
+	if c.ResponsesPath == "" {
+		c.ResponsesPath = defaultUpstreamResponsesPath
+	}
+	if !strings.HasPrefix(c.ResponsesPath, "/") {
+		c.ResponsesPath = "/" + c.ResponsesPath
+	}
+
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return UpstreamConfig{}, fmt.Errorf("invalid upstream base URL %q: %w", c.BaseURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return UpstreamConfig{}, fmt.Errorf("upstream base URL %q must be an absolute http or https URL", c.BaseURL)
+	}
+	return c, nil
+}
+
+func (c UpstreamConfig) responsesURL() string {
+	return c.BaseURL + c.ResponsesPath
+}
+
+func (c UpstreamConfig) modelsURL() string {
+	return c.BaseURL + upstreamModelsPath
+}
+
+// SetUpstream points the server at a different Codex backend.
+func (s *Server) SetUpstream(cfg UpstreamConfig) error {
+	cfg, err := cfg.normalize()
+	if err != nil {
+		return err
+	}
+	s.upstream = cfg
+	s.logger.Info().
+		Str("responses_url", cfg.responsesURL()).
+		Str("models_url", cfg.modelsURL()).
+		Msg("Using upstream Codex backend")
+	return nil
+}
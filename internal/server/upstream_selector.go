@@ -1,19 +1,142 @@
 package server
 
-import "strings"
+import (
+	"fmt"
+	"net/http"
+	"strings"
 
-// shouldUseWebSocketUpstream determines whether a normalized backend model
-// should be routed to the WebSocket upstream transport.
-func shouldUseWebSocketUpstream(normalizedModel string) bool {
-	if !supportsWebSocketUpstream() {
-		return false
+	"github.com/dvcrn/codex-proxy/internal/env"
+)
+
+// Upstream transports. Codex serves responses over plain HTTP streaming and,
+// for some models, over a WebSocket. The transport is picked per request:
+//
+//  1. the X-Codex-Transport header ("http", "websocket" or "auto")
+//  2. the model's entry in UPSTREAM_TRANSPORTS ("model=transport,...", with
+//     "*" matching every model)
+//  3. websocket for gpt-5.3-codex-spark, http otherwise
+//
+// Builds without WebSocket support always use http, and a failed WebSocket
+// handshake is retried over http.
+const (
+	upstreamTransportHTTP      = "http"
+	upstreamTransportWebSocket = "websocket"
+	upstreamTransportAuto      = "auto"
+
+	upstreamTransportHeader = "X-Codex-Transport"
+)
+
+// upstreamTransports maps canonical backend models, or "*", to a transport.
+type upstreamTransports map[string]string
+
+func normalizeUpstreamTransport(transport string) string {
+	switch strings.ToLower(strings.TrimSpace(transport)) {
+	case upstreamTransportHTTP, "https", "sse":
+		return upstreamTransportHTTP
+	case upstreamTransportWebSocket, "ws", "wss":
+		return upstreamTransportWebSocket
+	case upstreamTransportAuto:
+		return upstreamTransportAuto
+	default:
+		return ""
+	}
+}
+
+func newUpstreamTransportsFromEnv() upstreamTransports {
+	t := upstreamTransports{}
+	for _, pair := range strings.Split(env.GetOrDefault("UPSTREAM_TRANSPORTS", ""), ",") {
+		model, transport, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if transport = normalizeUpstreamTransport(transport); transport != "" && transport != upstreamTransportAuto {
+			t[strings.TrimSpace(model)] = transport
+		}
 	}
-	return strings.TrimSpace(normalizedModel) == modelGPT53CodexSpark
+	return t
 }
 
-func upstreamTransportForModel(normalizedModel string) string {
-	if shouldUseWebSocketUpstream(normalizedModel) {
-		return "websocket"
+// selectUpstreamTransport picks the transport for a request to
+// normalizedModel and says why.
+func (t upstreamTransports) selectUpstreamTransport(r *http.Request, normalizedModel string) (transport, reason string) {
+	transport, reason = t.preferredTransport(r, normalizedModel)
+	if transport == upstreamTransportWebSocket && !supportsWebSocketUpstream() {
+		return upstreamTransportHTTP, reason + "; websocket is not supported in this build"
+	}
+	return transport, reason
+}
+
+func (t upstreamTransports) preferredTransport(r *http.Request, normalizedModel string) (string, string) {
+	if r != nil {
+		header := r.Header.Get(upstreamTransportHeader)
+		switch transport := normalizeUpstreamTransport(header); transport {
+		case upstreamTransportHTTP, upstreamTransportWebSocket:
+			return transport, upstreamTransportHeader + " header"
+		case "":
+			if header != "" {
+				return t.configuredTransport(normalizedModel, fmt.Sprintf("unknown %s %q ignored", upstreamTransportHeader, header))
+			}
+		}
+	}
+	return t.configuredTransport(normalizedModel, "")
+}
+
+func (t upstreamTransports) configuredTransport(normalizedModel, note string) (string, string) {
+	withNote := func(reason string) string {
+		if note == "" {
+			return reason
+		}
+		return note + "; " + reason
+	}
+	model := strings.TrimSpace(normalizedModel)
+	if transport, ok := t[model]; ok {
+		return transport, withNote("UPSTREAM_TRANSPORTS entry for " + model)
 	}
-	return "http"
+	for key, transport := range t {
+		if key != "*" && normalizeModel(key) == model {
+			return transport, withNote("UPSTREAM_TRANSPORTS entry for " + model)
+		}
+	}
+	if transport, ok := t["*"]; ok {
+		return transport, withNote("UPSTREAM_TRANSPORTS default")
+	}
+	if model == modelGPT53CodexSpark {
+		return upstreamTransportWebSocket, withNote("built-in default for " + model)
+	}
+	return upstreamTransportHTTP, withNote("built-in default")
+}
+
+// upstreamTransportForModel picks the transport for a request to
+// normalizedModel and logs the reason for the choice.
+func (s *Server) upstreamTransportForModel(r *http.Request, normalizedModel string) string {
+	transport, reason := s.upstreamTransports.selectUpstreamTransport(r, normalizedModel)
+	s.logger.Info().
+		Str("model", normalizedModel).
+		Str("upstream_transport", transport).
+		Str("reason", reason).
+		Msg("Selected upstream transport")
+	return transport
+}
+
+// websocketHandshakeError is returned when the WebSocket upstream refuses or
+// fails the handshake, so the request can be retried over HTTP.
+type websocketHandshakeError struct {
+	status int
+	err    error
+}
+
+func (e *websocketHandshakeError) Error() string {
+	if e.status != 0 {
+		return fmt.Sprintf("websocket handshake failed with status %d: %v", e.status, e.err)
+	}
+	return fmt.Sprintf("websocket handshake failed: %v", e.err)
+}
+
+func (e *websocketHandshakeError) Unwrap() error { return e.err }
+
+// isWebSocketHandshakeFailure reports whether a refused handshake should be
+// retried over HTTP. Auth and capacity errors are answers from Codex itself
+// and go through the usual refresh and fallback handling.
+func isWebSocketHandshakeFailure(status int) bool {
+	return status != http.StatusUnauthorized && !unavailableStatus(status)
 }
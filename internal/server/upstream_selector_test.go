@@ -1,9 +1,17 @@
 package server
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestUpstreamTransportForModel_DefaultsToHTTP(t *testing.T) {
-	if got := upstreamTransportForModel(modelGPT53Codex); got != "http" {
+	s := newTestServer(&fakeUpstream{})
+	if got := s.upstreamTransportForModel(nil, modelGPT53Codex); got != "http" {
 		t.Fatalf("expected non-spark model to use http transport, got %q", got)
 	}
 }
@@ -13,7 +21,78 @@ func TestUpstreamTransportForModel_SparkUsesWebSocketWhenSupported(t *testing.T)
 		t.Skip("websocket upstream is not available in this build")
 	}
 
-	if got := upstreamTransportForModel(modelGPT53CodexSpark); got != "websocket" {
+	s := newTestServer(&fakeUpstream{})
+	if got := s.upstreamTransportForModel(nil, modelGPT53CodexSpark); got != "websocket" {
 		t.Fatalf("expected spark model to use websocket transport, got %q", got)
 	}
 }
+
+func TestUpstreamTransportSelection(t *testing.T) {
+	if !supportsWebSocketUpstream() {
+		t.Skip("websocket upstream is not available in this build")
+	}
+
+	t.Setenv("UPSTREAM_TRANSPORTS", "gpt-5.5=ws, gpt-5.3-codex-spark=http, gpt-5=carrier-pigeon")
+	transports := newUpstreamTransportsFromEnv()
+	request := func(header string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+		if header != "" {
+			r.Header.Set("x-codex-transport", header)
+		}
+		return r
+	}
+
+	cases := []struct {
+		header, model, want, reason string
+	}{
+		{"", modelGPT55, "websocket", "UPSTREAM_TRANSPORTS entry for gpt-5.5"},
+		{"", modelGPT53CodexSpark, "http", "UPSTREAM_TRANSPORTS entry for gpt-5.3-codex-spark"},
+		{"", modelGPT5, "http", "built-in default"},
+		{"websocket", modelGPT5, "websocket", "X-Codex-Transport header"},
+		{"HTTP", modelGPT55, "http", "X-Codex-Transport header"},
+		{"auto", modelGPT55, "websocket", "UPSTREAM_TRANSPORTS entry for gpt-5.5"},
+		{"smoke", modelGPT5, "http", `unknown X-Codex-Transport "smoke" ignored; built-in default`},
+	}
+	for _, c := range cases {
+		transport, reason := transports.selectUpstreamTransport(request(c.header), c.model)
+		assert.Equal(t, c.want, transport, "%s %s", c.header, c.model)
+		assert.Equal(t, c.reason, reason, "%s %s", c.header, c.model)
+	}
+
+	transport, reason := upstreamTransports{"*": "websocket"}.selectUpstreamTransport(nil, modelGPT5)
+	assert.Equal(t, "websocket", transport)
+	assert.Equal(t, "UPSTREAM_TRANSPORTS default", reason)
+}
+
+func TestWebSocketHandshakeFailureFallsBackToHTTP(t *testing.T) {
+	if !supportsWebSocketUpstream() {
+		t.Skip("websocket upstream is not available in this build")
+	}
+
+	wsUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "websockets are not enabled here", http.StatusNotFound)
+	}))
+	defer wsUpstream.Close()
+
+	httpUpstream := &fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusOK, textSSE("over http", 1, 1)
+	}}
+	s := newTestServer(httpUpstream)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/responses", nil)
+	resp, status, err := s.makeChatGPTRequestOverWebSocket(r, wsUpstream.URL, []byte(`{"model":"gpt-5.5"}`), "token", "account")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(1), httpUpstream.calls)
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, usageLimitBody, http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	resp, status, err = s.makeChatGPTRequestOverWebSocket(r, limited.URL, []byte(`{"model":"gpt-5.5"}`), "token", "account")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, status, "capacity errors are not handshake failures")
+	assert.Equal(t, int32(1), httpUpstream.calls)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamConfigFromEnv(t *testing.T) {
+	cfg, err := UpstreamConfigFromEnv().normalize()
+	require.NoError(t, err)
+	assert.Equal(t, "https://chatgpt.com/backend-api/codex/responses", cfg.responsesURL())
+	assert.Equal(t, "https://chatgpt.com/backend-api/codex/models", cfg.modelsURL())
+
+	t.Setenv("UPSTREAM_BASE_URL", "http://localhost:8080/mock/")
+	t.Setenv("UPSTREAM_RESPONSES_PATH", "v2/responses")
+	cfg, err = UpstreamConfigFromEnv().normalize()
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/mock/v2/responses", cfg.responsesURL())
+	assert.Equal(t, "http://localhost:8080/mock/models", cfg.modelsURL())
+
+	for _, base := range []string{"localhost:8080", "ftp://example.com", "https://"} {
+		_, err := UpstreamConfig{BaseURL: base}.normalize()
+		assert.Error(t, err, base)
+	}
+}
+
+func TestSetUpstreamRoutesRequests(t *testing.T) {
+	t.Cleanup(func() { activeModels.Store(nil) })
+	var mu sync.Mutex
+	var requested []string
+	s := newTestServer(&fakeUpstream{respond: func(_ int, req *http.Request) (int, string) {
+		mu.Lock()
+		requested = append(requested, req.Method+" "+req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+		mu.Unlock()
+		if req.Method == http.MethodGet {
+			return http.StatusOK, `{"models":[]}`
+		}
+		return http.StatusOK, textSSE("hi", 1, 1)
+	}})
+	require.NoError(t, s.SetUpstream(UpstreamConfig{BaseURL: "http://gateway.internal/codex", ResponsesPath: "/v1/responses"}))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	s.modelCatalog = &modelCatalog{fetch: true, ttl: defaultModelCatalogTTL}
+	s.updateModelCatalog()
+
+	assert.Equal(t, []string{
+		"POST http://gateway.internal/codex/v1/responses",
+		"GET http://gateway.internal/codex/models",
+	}, requested)
+	assert.Error(t, s.SetUpstream(UpstreamConfig{BaseURL: "gateway.internal"}))
+}
+
+func TestNewRejectsInvalidUpstream(t *testing.T) {
+	_, err := New(zerolog.Nop(), staticCreds{}, UpstreamConfig{BaseURL: "chatgpt.example"})
+	require.Error(t, err)
+
+	s, err := New(zerolog.Nop(), staticCreds{}, UpstreamConfig{BaseURL: "http://localhost:8080/codex"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/codex/responses", s.upstream.responsesURL())
+}
@@ -41,7 +41,8 @@ func (s *Server) makeChatGPTWebSocketRequest(r *http.Request, rawURL string, bod
 		bareToken = strings.TrimSpace(bareToken[7:])
 	}
 
-	sessionID := newUUIDv4()
+	session := upstreamSessionFromContext(r.Context())
+	sessionID := session.id
 	headers := http.Header{}
 	headers.Set("authorization", "Bearer "+bareToken)
 	headers.Set("version", websocketResponsesVersion)
@@ -50,7 +51,7 @@ func (s *Server) makeChatGPTWebSocketRequest(r *http.Request, rawURL string, bod
 	headers.Set("chatgpt-account-id", accountID)
 	headers.Set("originator", "codex_cli_rs")
 	headers.Set("x-codex-beta-features", "collab,apps")
-	headers.Set("x-codex-turn-metadata", `{"sandbox":"none"}`)
+	headers.Set("x-codex-turn-metadata", `{"turn_id":"`+session.turnID+`","sandbox":"none"}`)
 
 	s.logger.Info().
 		Str("authorization_preview", "Bearer "+func() string {
@@ -73,13 +74,20 @@ func (s *Server) makeChatGPTWebSocketRequest(r *http.Request, rawURL string, bod
 
 	conn, resp, err := dialer.DialContext(r.Context(), wsURL, headers)
 	if err != nil {
-		if resp != nil {
+		if resp != nil && !isWebSocketHandshakeFailure(resp.StatusCode) {
 			if resp.Body == nil {
 				resp.Body = io.NopCloser(strings.NewReader(err.Error()))
 			}
 			return resp, resp.StatusCode, nil
 		}
-		return nil, 0, fmt.Errorf("failed to open websocket upstream connection: %w", err)
+		handshakeErr := &websocketHandshakeError{err: err}
+		if resp != nil {
+			handshakeErr.status = resp.StatusCode
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+		}
+		return nil, 0, handshakeErr
 	}
 
 	if err := conn.WriteMessage(websocket.TextMessage, createPayload); err != nil {
@@ -140,6 +148,14 @@ func (s *Server) makeChatGPTWebSocketRequest(r *http.Request, rawURL string, bod
 	responseHeaders.Set("Content-Type", "text/event-stream; charset=utf-8")
 	responseHeaders.Set("Cache-Control", "no-cache")
 	responseHeaders.Set("Connection", "keep-alive")
+	// Usage headers arrive on the handshake response.
+	if resp != nil {
+		for key, values := range resp.Header {
+			if strings.HasPrefix(strings.ToLower(key), "x-codex-") {
+				responseHeaders[key] = values
+			}
+		}
+	}
 
 	return &http.Response{
 		StatusCode: http.StatusOK,
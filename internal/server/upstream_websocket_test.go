@@ -0,0 +1,21 @@
+//go:build !js || !wasm
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketURLFollowsUpstream(t *testing.T) {
+	t.Setenv("UPSTREAM_BASE_URL", "http://localhost:8080/mock/")
+	t.Setenv("UPSTREAM_RESPONSES_PATH", "v2/responses")
+	cfg, err := UpstreamConfigFromEnv().normalize()
+	require.NoError(t, err)
+
+	wsURL, err := toWebSocketURL(cfg.responsesURL())
+	require.NoError(t, err)
+	assert.Equal(t, "ws://localhost:8080/mock/v2/responses", wsURL)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// addUsageDetails copies the Responses API token breakdowns in u into the
+// chat completions usage object out:
+//
+//	input_tokens_details.cached_tokens      -> prompt_tokens_details.cached_tokens
+//	output_tokens_details.reasoning_tokens  -> completion_tokens_details.reasoning_tokens
+func addUsageDetails(u, out map[string]interface{}) {
+	for _, m := range []struct{ from, to, field string }{
+		{"input_tokens_details", "prompt_tokens_details", "cached_tokens"},
+		{"output_tokens_details", "completion_tokens_details", "reasoning_tokens"},
+	} {
+		details, ok := u[m.from].(map[string]interface{})
+		if !ok {
+			details, ok = u[m.to].(map[string]interface{})
+		}
+		if !ok {
+			continue
+		}
+		if n, ok := details[m.field].(float64); ok {
+			out[m.to] = map[string]interface{}{m.field: int(n)}
+		}
+	}
+}
+
+// finishChunks builds the chunks that close a choice. By default usage rides
+// on the finish_reason chunk. With stream_options.include_usage it follows
+// instead in a separate usage-only chunk with empty choices, as OpenAI does.
+// A nil usage is left out.
+func (t *SSETransformer) finishChunks(seq interface{}, finish string, usage map[string]interface{}) ([][]byte, error) {
+	final := map[string]interface{}{
+		"id":      t.responseID,
+		"object":  "chat.completion.chunk",
+		"created": seq,
+		"model":   t.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         map[string]interface{}{},
+				"finish_reason": finish,
+			},
+		},
+	}
+	if !t.includeUsage && usage != nil {
+		final["usage"] = usage
+	}
+	finalBytes, err := json.Marshal(final)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal final chunk: %w", err)
+	}
+	if !t.includeUsage || usage == nil {
+		return [][]byte{finalBytes}, nil
+	}
+
+	usageBytes, err := json.Marshal(map[string]interface{}{
+		"id":      t.responseID,
+		"object":  "chat.completion.chunk",
+		"created": seq,
+		"model":   t.model,
+		"choices": []interface{}{},
+		"usage":   usage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal usage chunk: %w", err)
+	}
+	return [][]byte{finalBytes, usageBytes}, nil
+}
+
+// includeUsageRequested reports stream_options.include_usage.
+func includeUsageRequested(requestData map[string]interface{}) bool {
+	opts, _ := requestData["stream_options"].(map[string]interface{})
+	include, _ := opts["include_usage"].(bool)
+	return include
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const detailedUsageSSE = `data: {"type":"response.created","sequence_number":0,"response":{"id":"resp_u"}}
+
+data: {"type":"response.output_text.delta","sequence_number":1,"delta":"Hi"}
+
+data: {"type":"response.completed","sequence_number":2,"response":{"usage":{"input_tokens":100,"input_tokens_details":{"cached_tokens":80},"output_tokens":20,"output_tokens_details":{"reasoning_tokens":12},"total_tokens":120}}}
+
+`
+
+func TestBufferChatCompletion_UsageDetails(t *testing.T) {
+	resp, err := bufferChatCompletionFromSSE(strings.NewReader(detailedUsageSSE), "gpt-5", chatStreamOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Usage)
+	assert.Equal(t, 100, resp.Usage.PromptTokens)
+	require.NotNil(t, resp.Usage.PromptTokensDetails)
+	assert.Equal(t, 80, resp.Usage.PromptTokensDetails.CachedTokens)
+	require.NotNil(t, resp.Usage.CompletionTokensDetails)
+	assert.Equal(t, 12, resp.Usage.CompletionTokensDetails.ReasoningTokens)
+}
+
+func sseDataLines(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var m map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(data), &m))
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestRewriteSSEStream_IncludeUsage(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(detailedUsageSSE), &out, "gpt-5", chatStreamOptions{includeUsage: true}, nil))
+
+	chunks := sseDataLines(t, out.String())
+	require.GreaterOrEqual(t, len(chunks), 2)
+	finish := chunks[len(chunks)-2]
+	assert.NotContains(t, finish, "usage")
+	assert.Equal(t, "stop", finish["choices"].([]interface{})[0].(map[string]interface{})["finish_reason"])
+
+	last := chunks[len(chunks)-1]
+	assert.Empty(t, last["choices"])
+	usage := last["usage"].(map[string]interface{})
+	assert.Equal(t, float64(120), usage["total_tokens"])
+	assert.Equal(t, map[string]interface{}{"cached_tokens": float64(80)}, usage["prompt_tokens_details"])
+	assert.Equal(t, map[string]interface{}{"reasoning_tokens": float64(12)}, usage["completion_tokens_details"])
+}
+
+func TestRewriteSSEStream_UsageOnFinishChunkByDefault(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, RewriteSSEStreamWithOptions(strings.NewReader(detailedUsageSSE), &out, "gpt-5", chatStreamOptions{}, nil))
+
+	chunks := sseDataLines(t, out.String())
+	last := chunks[len(chunks)-1]
+	require.Contains(t, last, "usage")
+	assert.NotEmpty(t, last["choices"])
+}
+
+func TestChatCompletions_FanOutIncludeUsageSumsDetails(t *testing.T) {
+	s := newTestServer(&fakeUpstream{respond: func(int, *http.Request) (int, string) {
+		return http.StatusOK, detailedUsageSSE
+	}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","n":2,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	s.chatCompletionsHandler(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var usageChunks []map[string]interface{}
+	for _, c := range sseDataLines(t, rec.Body.String()) {
+		if _, ok := c["usage"]; ok {
+			usageChunks = append(usageChunks, c)
+		}
+	}
+	require.Len(t, usageChunks, 1)
+	usage := usageChunks[0]["usage"].(map[string]interface{})
+	assert.Equal(t, float64(240), usage["total_tokens"])
+	assert.Equal(t, map[string]interface{}{"cached_tokens": float64(160)}, usage["prompt_tokens_details"])
+}
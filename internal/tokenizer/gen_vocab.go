@@ -0,0 +1,66 @@
+//go:build ignore
+
+// gen_vocab downloads the o200k_base vocabulary into vocab/ and verifies its
+// checksum. It does nothing when a verified copy is already present.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	vocabURL    = "https://openaipublic.blob.core.windows.net/encodings/o200k_base.tiktoken"
+	vocabSHA256 = "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d"
+	vocabPath   = "vocab/o200k_base.tiktoken"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "gen_vocab:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if data, err := os.ReadFile(vocabPath); err == nil && checksum(data) == vocabSHA256 {
+		return nil
+	}
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Get(vocabURL)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", vocabURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: status %d", vocabURL, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", vocabURL, err)
+	}
+	if sum := checksum(data); sum != vocabSHA256 {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", vocabURL, sum, vocabSHA256)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(vocabPath), 0o755); err != nil {
+		return err
+	}
+	tmp := vocabPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vocabPath)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,53 @@
+package tokenizer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+//go:generate go run gen_vocab.go
+
+// O200kPattern is the o200k_base pre-tokenizer, with the \s+(?!\S)
+// alternative expressed through the trailing capture group (see New).
+const O200kPattern = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+	`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+	`|\p{N}{1,3}` +
+	`| ?[^\s\p{L}\p{N}]+[\r\n/]*` +
+	`|\s*[\r\n]+` +
+	`|(\s+)`
+
+const o200kVocabPath = "vocab/o200k_base.tiktoken"
+
+// ErrNoVocabulary is returned by O200k when the vocabulary was not embedded
+// at build time.
+var ErrNoVocabulary = errors.New("o200k_base vocabulary is not embedded; run go generate ./internal/tokenizer")
+
+//go:embed vocab
+var vocabFS embed.FS
+
+var (
+	o200kOnce sync.Once
+	o200k     *Tokenizer
+	o200kErr  error
+)
+
+// O200k returns the o200k_base tokenizer used by the GPT-5 family. The
+// embedded vocabulary is parsed on first use.
+func O200k() (*Tokenizer, error) {
+	o200kOnce.Do(func() {
+		data, err := vocabFS.ReadFile(o200kVocabPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			o200kErr = ErrNoVocabulary
+			return
+		}
+		if err != nil {
+			o200kErr = err
+			return
+		}
+		o200k, o200kErr = New(bytes.NewReader(data), O200kPattern)
+	})
+	return o200k, o200kErr
+}
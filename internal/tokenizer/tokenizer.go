@@ -0,0 +1,238 @@
+// Package tokenizer implements tiktoken-compatible byte pair encoding, used to
+// count prompt tokens the way the upstream models do.
+package tokenizer
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tokenizer encodes text with a byte pair encoding vocabulary.
+type Tokenizer struct {
+	ranks   map[string]int
+	tokens  map[int]string
+	pattern *regexp.Regexp
+}
+
+// New reads a vocabulary in the .tiktoken format ("<base64 token> <rank>" per
+// line) and pre-tokenizes text with pattern. The last capture group of pattern,
+// if any, marks whitespace runs that should leave their final character to the
+// next piece; RE2 has no lookahead to express that directly.
+func New(vocab io.Reader, pattern string) (*Tokenizer, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pre-tokenizer pattern: %w", err)
+	}
+	ranks := make(map[string]int, 200000)
+	scanner := bufio.NewScanner(vocab)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		encoded, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("vocabulary line %d: expected \"<token> <rank>\"", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: %w", line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: %w", line, err)
+		}
+		ranks[string(token)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vocabulary: %w", err)
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("vocabulary has no token for byte 0x%02x", b)
+		}
+	}
+	tokens := make(map[int]string, len(ranks))
+	for token, rank := range ranks {
+		tokens[rank] = token
+	}
+	return &Tokenizer{ranks: ranks, tokens: tokens, pattern: re}, nil
+}
+
+// Encode returns the token ids of text. Special tokens are encoded as
+// ordinary text.
+func (t *Tokenizer) Encode(text string) []int {
+	var tokens []int
+	t.each(text, func(piece string) {
+		if rank, ok := t.ranks[piece]; ok {
+			tokens = append(tokens, rank)
+			return
+		}
+		tokens = append(tokens, t.mergePiece(piece)...)
+	})
+	return tokens
+}
+
+// Count returns the number of tokens in text.
+func (t *Tokenizer) Count(text string) int {
+	n := 0
+	t.each(text, func(piece string) {
+		n += t.pieceCount(piece)
+	})
+	return n
+}
+
+// Truncate returns the longest prefix of text that encodes to at most n
+// tokens, cut at a token boundary and never inside a UTF-8 character.
+func (t *Tokenizer) Truncate(text string, n int) string {
+	end, used, full := 0, 0, false
+	t.each(text, func(piece string) {
+		if full {
+			return
+		}
+		if c := t.pieceCount(piece); used+c <= n {
+			used += c
+			end += len(piece)
+			return
+		}
+		full = true
+		ids := t.mergePiece(piece)
+		for _, id := range ids[:n-used] {
+			end += len(t.tokens[id])
+		}
+	})
+	for end < len(text) && end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end]
+}
+
+func (t *Tokenizer) pieceCount(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+	return len(t.mergePiece(piece))
+}
+
+// each calls fn with every pre-tokenized piece of text.
+func (t *Tokenizer) each(text string, fn func(piece string)) {
+	trailing := t.pattern.NumSubexp()
+	for pos := 0; pos < len(text); {
+		loc := t.pattern.FindStringSubmatchIndex(text[pos:])
+		if loc == nil || loc[1] == 0 {
+			// Not reachable with a pattern that matches every character; keep
+			// the text covered anyway.
+			_, size := utf8.DecodeRuneInString(text[pos:])
+			fn(text[pos : pos+size])
+			pos += size
+			continue
+		}
+		start, end := pos+loc[0], pos+loc[1]
+		if loc[0] > 0 {
+			fn(text[pos:start])
+		}
+		// A whitespace run followed by more text leaves its last character
+		// to prefix the next piece, like \s+(?!\S).
+		if trailing > 0 && loc[2*trailing] >= 0 && end < len(text) {
+			if _, size := utf8.DecodeLastRuneInString(text[start:end]); end-size > start {
+				end -= size
+			}
+		}
+		fn(text[start:end])
+		pos = end
+	}
+}
+
+// mergePiece applies byte pair merges to piece, lowest rank first, and returns
+// the resulting token ids.
+func (t *Tokenizer) mergePiece(piece string) []int {
+	n := len(piece)
+	next := make([]int, n)
+	prev := make([]int, n)
+	pairRank := make([]int, n)
+	for i := range next {
+		next[i] = i + 1
+		prev[i] = i - 1
+	}
+	rankAt := func(i int) int {
+		if i < 0 || next[i] >= n {
+			return -1
+		}
+		if rank, ok := t.ranks[piece[i:next[next[i]]]]; ok {
+			return rank
+		}
+		return -1
+	}
+	h := &mergeHeap{}
+	for i := 0; i < n; i++ {
+		pairRank[i] = rankAt(i)
+		if pairRank[i] >= 0 {
+			*h = append(*h, mergeCandidate{rank: pairRank[i], start: i})
+		}
+	}
+	heap.Init(h)
+
+	alive := make([]bool, n)
+	for i := range alive {
+		alive[i] = true
+	}
+	for h.Len() > 0 {
+		c := heap.Pop(h).(mergeCandidate)
+		if !alive[c.start] || pairRank[c.start] != c.rank {
+			continue
+		}
+		i, j := c.start, next[c.start]
+		alive[j] = false
+		next[i] = next[j]
+		if next[j] < n {
+			prev[next[j]] = i
+		}
+		for _, k := range []int{i, prev[i]} {
+			if k < 0 {
+				continue
+			}
+			pairRank[k] = rankAt(k)
+			if pairRank[k] >= 0 {
+				heap.Push(h, mergeCandidate{rank: pairRank[k], start: k})
+			}
+		}
+	}
+
+	var tokens []int
+	for i := 0; i < n; i = next[i] {
+		tokens = append(tokens, t.ranks[piece[i:next[i]]])
+	}
+	return tokens
+}
+
+type mergeCandidate struct {
+	rank  int
+	start int
+}
+
+// mergeHeap orders candidates by rank, then position, matching tiktoken's
+// leftmost-lowest merge order.
+type mergeHeap []mergeCandidate
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].start < h[j].start
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeCandidate)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,74 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testVocab(merges ...string) string {
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, merge := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), 256+i)
+	}
+	return b.String()
+}
+
+func TestPreTokenizer(t *testing.T) {
+	tok, err := New(strings.NewReader(testVocab()), O200kPattern)
+	require.NoError(t, err)
+
+	var pieces []string
+	tok.each("Hello world  foo\n\nbar 123456 don't", func(piece string) {
+		pieces = append(pieces, piece)
+	})
+	assert.Equal(t, []string{"Hello", " world", " ", " foo", "\n\n", "bar", " ", "123", "456", " don't"}, pieces)
+}
+
+func TestMergesLowestRankFirst(t *testing.T) {
+	tok, err := New(strings.NewReader(testVocab("bc", "ab", "bcd", "aa")), O200kPattern)
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{'a', 258}, tok.Encode("abcd"))
+	assert.Equal(t, []int{259, 259}, tok.Encode("aaaa"))
+	assert.Equal(t, []int{259, 'a'}, tok.Encode("aaa"), "ties merge leftmost first")
+	assert.Equal(t, []int{257}, tok.Encode("ab"))
+	assert.Equal(t, 5, tok.Count("abcd aaa"))
+	assert.Empty(t, tok.Encode(""))
+}
+
+func TestTruncate(t *testing.T) {
+	tok, err := New(strings.NewReader(testVocab("ab", " c", " cd")), O200kPattern)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ab cd", tok.Truncate("ab cd ef", 2))
+	assert.Equal(t, "ab cd e", tok.Truncate("ab cd ef", 4), "pieces are cut at token boundaries")
+	assert.Equal(t, "ab cd ef", tok.Truncate("ab cd ef", 10))
+	assert.Empty(t, tok.Truncate("ab", 0))
+	assert.Equal(t, "a", tok.Truncate("aé", 2), "characters are not split")
+}
+
+func TestNewRejectsIncompleteVocabulary(t *testing.T) {
+	_, err := New(strings.NewReader("YQ== 0\n"), O200kPattern)
+	assert.Error(t, err)
+	_, err = New(strings.NewReader("not-base64! 0\n"), O200kPattern)
+	assert.Error(t, err)
+}
+
+func TestO200k(t *testing.T) {
+	tok, err := O200k()
+	if errors.Is(err, ErrNoVocabulary) && os.Getenv("CI") == "" {
+		t.Skip("o200k_base vocabulary not embedded; run go generate ./internal/tokenizer")
+	}
+	require.NoError(t, err)
+	assert.Equal(t, 2, tok.Count("hello world"))
+}